@@ -0,0 +1,218 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	envDeviceBackend    = "DP_DEVICE_BACKEND"
+	envSimulatedDevices = "DP_SIMULATED_DEVICES"
+	envProcfsRoot       = "DP_PROCFS_ROOT"
+
+	nvmlBackendName      = "nvml"
+	simulatedBackendName = "simulated"
+	procfsBackendName    = "procfs"
+)
+
+// Device couples the device advertised to the Kubelet with the
+// attributes discovered by the backend.
+type Device struct {
+	pluginapi.Device
+
+	Index    uint
+	Path     string
+	Model    string
+	BusID    string
+	Memory   uint64 // MiB, 0 if unknown
+	Topology []p2pLink
+}
+
+// p2pLink describes how a device is connected to one of its peers.
+type p2pLink struct {
+	Peer string // UUID of the peer device
+	Link nvml.P2PLinkType
+}
+
+// deviceBackend discovers the GPUs of the node and watches their health.
+type deviceBackend interface {
+	Name() string
+	Init() error
+	Shutdown() error
+
+	// Devices returns the devices currently present on the node.
+	Devices() ([]*Device, error)
+	// WatchHealth sends the health events of the devices to the given
+	// channel until the context is cancelled or an error occurs.
+	WatchHealth(ctx context.Context, devs []*Device, events chan<- healthEvent) error
+	// Probe checks that a device can be used again before it recovers.
+	Probe(d *Device) error
+	// Telemetry returns the current value of the metrics of the given
+	// groups of a device, or nil if the backend cannot measure them. The
+	// metrics of the groups which could be sampled are returned along with
+	// the error of the others.
+	Telemetry(d *Device, groups telemetryGroups) (map[string]float64, error)
+}
+
+// healthEvent reports that a device became unhealthy, or only degraded if it
+// can still be used. RebootRequired is set when the device can only be used
+// again after the node reboots. Check is the name of the health check which
+// reported the event, XID the XID which caused it, if any.
+type healthEvent struct {
+	Device         *Device
+	Reason         string
+	Degraded       bool
+	RebootRequired bool
+	Check          string
+	// Probe is the name of the probe which reported the event, if any.
+	Probe string
+	XID   uint64
+}
+
+// newDeviceBackend returns the backend selected through DP_DEVICE_BACKEND.
+// The XIDs and the NVML events are recorded in the journal.
+func newDeviceBackend(journal *journal) (deviceBackend, error) {
+	switch name := os.Getenv(envDeviceBackend); name {
+	case "", nvmlBackendName:
+		policy, err := loadXIDPolicy()
+		if err != nil {
+			return nil, err
+		}
+		return &nvmlBackend{xids: newXIDTracker(policy), watchdog: newNVMLWatchdog(), journal: journal}, nil
+	case simulatedBackendName:
+		file := os.Getenv(envSimulatedDevices)
+		if file == "" {
+			return nil, fmt.Errorf("%s must be set when using the %s backend", envSimulatedDevices, name)
+		}
+		return &simulatedBackend{file: file}, nil
+	case procfsBackendName:
+		return newProcfsBackend(), nil
+	default:
+		return nil, fmt.Errorf("unknown device backend: %q", name)
+	}
+}
+
+// newProcfsBackend returns the procfs backend rooted at DP_PROCFS_ROOT.
+func newProcfsBackend() deviceBackend {
+	root := os.Getenv(envProcfsRoot)
+	if root == "" {
+		root = "/"
+	}
+	return &procfsBackend{root: root}
+}
+
+func deviceExists(devs []*Device, id string) bool {
+	return findDevice(devs, id) != nil
+}
+
+func findDevice(devs []*Device, id string) *Device {
+	for _, d := range devs {
+		if d.ID == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// mergeDevices reconciles the advertised devices with the ones discovered on
+// the node. Known devices keep their health but take the attributes they were
+// discovered with, e.g. their index shifts after a GPU is removed. New devices
+// are appended and devices which disappeared are kept but marked unhealthy.
+func mergeDevices(current, discovered []*Device) ([]*Device, bool) {
+	var merged []*Device
+	changed := false
+
+	for _, d := range current {
+		found := findDevice(discovered, d.ID)
+		if found == nil && d.Health == pluginapi.Healthy {
+			log.Printf("Device %s disappeared, marking it unhealthy.", d.ID)
+			d.Health = pluginapi.Unhealthy
+			changed = true
+		}
+		if found != nil && refreshDevice(d, found) {
+			changed = true
+		}
+		merged = append(merged, d)
+	}
+
+	for _, d := range discovered {
+		if !deviceExists(current, d.ID) {
+			log.Printf("Device %s appeared.", d.ID)
+			merged = append(merged, d)
+			changed = true
+		}
+	}
+
+	return merged, changed
+}
+
+// refreshDevice updates the attributes of a known device from its discovered
+// copy, keeping its health. It returns whether the location of the device
+// changed.
+func refreshDevice(d, discovered *Device) bool {
+	moved := d.Index != discovered.Index || d.BusID != discovered.BusID || d.Path != discovered.Path
+	if moved {
+		log.Printf("Device %s moved from index %d (%s) to index %d (%s).", d.ID, d.Index, d.BusID, discovered.Index, discovered.BusID)
+	}
+
+	d.Index = discovered.Index
+	d.Path = discovered.Path
+	d.BusID = discovered.BusID
+	d.Model = discovered.Model
+	d.Memory = discovered.Memory
+	d.Topology = discovered.Topology
+	d.Device.Topology = discovered.Device.Topology
+	return moved
+}
+
+// sendUnhealthy reports a device as unhealthy on the channel unless the
+// context is cancelled.
+func sendUnhealthy(ctx context.Context, c chan<- healthEvent, d *Device, reason string) {
+	sendHealthEvent(ctx, c, healthEvent{Device: d, Reason: reason})
+}
+
+// sendHealthEvent sends an event on the channel unless the context is
+// cancelled.
+func sendHealthEvent(ctx context.Context, c chan<- healthEvent, e healthEvent) {
+	select {
+	case c <- e:
+	case <-ctx.Done():
+	}
+}
+
+// copyDevices returns copies of the devices, which the health checks and the
+// allocations read while the advertised devices are refreshed.
+func copyDevices(devs []*Device) []*Device {
+	var res []*Device
+	for _, d := range devs {
+		c := &Device{
+			Index:    d.Index,
+			Path:     d.Path,
+			Model:    d.Model,
+			BusID:    d.BusID,
+			Memory:   d.Memory,
+			Topology: d.Topology,
+		}
+		c.ID = d.ID
+		c.Health = d.Health
+		c.Device.Topology = d.Device.Topology
+		res = append(res, c)
+	}
+	return res
+}
+
+func apiDevices(devs []*Device) []*pluginapi.Device {
+	var res []*pluginapi.Device
+	for _, d := range devs {
+		res = append(res, &d.Device)
+	}
+	return res
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// testDevice returns a device at the given index, with the given health.
+func testDevice(id string, index uint, health string) *Device {
+	d := &Device{
+		Index:  index,
+		Path:   fmt.Sprintf("/dev/nvidia%d", index),
+		BusID:  fmt.Sprintf("0000:%02x:00.0", index+1),
+		Memory: 16384,
+	}
+	d.ID = id
+	d.Health = health
+	return d
+}
+
+func TestMergeDevices(t *testing.T) {
+	healthy, unhealthy := pluginapi.Healthy, pluginapi.Unhealthy
+	moved := func(d *Device, index uint) *Device {
+		d.Index = index
+		d.Path = fmt.Sprintf("/dev/nvidia%d", index)
+		d.BusID = fmt.Sprintf("0000:%02x:00.0", index+1)
+		return d
+	}
+	// refreshed is GPU-a rediscovered with other attributes.
+	refreshed := func() *Device {
+		d := testDevice("GPU-a", 0, healthy)
+		d.Model = "Tesla V100"
+		d.Memory = 32768
+		d.Topology = []p2pLink{{Peer: "GPU-b"}}
+		return d
+	}
+
+	tests := []struct {
+		name       string
+		current    []*Device
+		discovered []*Device
+		want       []*Device
+		changed    bool
+	}{
+		{
+			name:       "unchanged",
+			current:    []*Device{testDevice("GPU-a", 0, healthy), testDevice("GPU-b", 1, healthy)},
+			discovered: []*Device{testDevice("GPU-a", 0, healthy), testDevice("GPU-b", 1, healthy)},
+			want:       []*Device{testDevice("GPU-a", 0, healthy), testDevice("GPU-b", 1, healthy)},
+		},
+		{
+			name:       "added",
+			current:    []*Device{testDevice("GPU-a", 0, healthy)},
+			discovered: []*Device{testDevice("GPU-a", 0, healthy), testDevice("GPU-b", 1, healthy)},
+			want:       []*Device{testDevice("GPU-a", 0, healthy), testDevice("GPU-b", 1, healthy)},
+			changed:    true,
+		},
+		{
+			name:       "removed",
+			current:    []*Device{testDevice("GPU-a", 0, healthy), testDevice("GPU-b", 1, healthy)},
+			discovered: []*Device{testDevice("GPU-b", 1, healthy)},
+			want:       []*Device{testDevice("GPU-a", 0, unhealthy), testDevice("GPU-b", 1, healthy)},
+			changed:    true,
+		},
+		{
+			name:       "still removed",
+			current:    []*Device{testDevice("GPU-a", 0, unhealthy), testDevice("GPU-b", 1, healthy)},
+			discovered: []*Device{testDevice("GPU-b", 1, healthy)},
+			want:       []*Device{testDevice("GPU-a", 0, unhealthy), testDevice("GPU-b", 1, healthy)},
+		},
+		{
+			name:       "moved",
+			current:    []*Device{testDevice("GPU-a", 0, healthy), testDevice("GPU-b", 1, healthy), testDevice("GPU-c", 2, healthy)},
+			discovered: []*Device{testDevice("GPU-a", 0, healthy), testDevice("GPU-c", 1, healthy)},
+			want:       []*Device{testDevice("GPU-a", 0, healthy), testDevice("GPU-b", 1, unhealthy), moved(testDevice("GPU-c", 2, healthy), 1)},
+			changed:    true,
+		},
+		{
+			name:       "health kept",
+			current:    []*Device{testDevice("GPU-a", 0, unhealthy), testDevice("GPU-b", 1, healthy)},
+			discovered: []*Device{testDevice("GPU-b", 0, healthy), testDevice("GPU-a", 1, healthy)},
+			want:       []*Device{moved(testDevice("GPU-a", 0, unhealthy), 1), moved(testDevice("GPU-b", 1, healthy), 0)},
+			changed:    true,
+		},
+		{
+			name:       "attributes refreshed",
+			current:    []*Device{testDevice("GPU-a", 0, healthy)},
+			discovered: []*Device{refreshed()},
+			want:       []*Device{refreshed()},
+		},
+	}
+
+	for _, tt := range tests {
+		got, changed := mergeDevices(tt.current, tt.discovered)
+		if changed != tt.changed {
+			t.Errorf("%s: got changed %v, want %v", tt.name, changed, tt.changed)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %d devices, want %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for i, d := range got {
+			if !reflect.DeepEqual(d, tt.want[i]) {
+				t.Errorf("%s: got device %d %+v, want %+v", tt.name, i, d, tt.want[i])
+			}
+			// The known devices are updated in place.
+			if i < len(tt.current) && d != tt.current[i] {
+				t.Errorf("%s: device %s was replaced", tt.name, d.ID)
+			}
+		}
+	}
+}
+
+func TestCopyDevices(t *testing.T) {
+	devs := []*Device{testDevice("GPU-a", 0, pluginapi.Healthy), testDevice("GPU-b", 1, pluginapi.Healthy)}
+	copies := copyDevices(devs)
+	if !reflect.DeepEqual(copies, devs) {
+		t.Fatalf("got %+v, want %+v", copies, devs)
+	}
+
+	// GPU-a disappeared and GPU-b took its index.
+	mergeDevices(devs, []*Device{testDevice("GPU-b", 0, pluginapi.Healthy)})
+	if want := testDevice("GPU-a", 0, pluginapi.Healthy); !reflect.DeepEqual(copies[0], want) {
+		t.Errorf("got copy %+v, want %+v", copies[0], want)
+	}
+	if want := testDevice("GPU-b", 1, pluginapi.Healthy); !reflect.DeepEqual(copies[1], want) {
+		t.Errorf("got copy %+v, want %+v", copies[1], want)
+	}
+}
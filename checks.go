@@ -0,0 +1,232 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names of the health checks, as used in the configuration file, the flags
+// and DP_DISABLE_HEALTHCHECKS.
+const (
+	// checkXIDs is the health watcher of the backend: the XIDs and NVML
+	// events, missing device nodes in degraded mode.
+	checkXIDs         = "xids"
+	checkTelemetry    = "telemetry"
+	checkPCIe         = "pcie"
+	checkRetiredPages = "retiredPages"
+	checkNVLink       = "nvlink"
+	checkProbes       = "probes"
+)
+
+// checkDefaults are the defaults of a health check. Event driven checks have
+// no interval.
+type checkDefaults struct {
+	enabled     bool
+	interval    time.Duration
+	gracePeriod time.Duration
+}
+
+var healthChecks = map[string]checkDefaults{
+	checkXIDs:         {enabled: true},
+	checkTelemetry:    {enabled: true, interval: 30 * time.Second},
+	checkPCIe:         {enabled: false, interval: time.Minute, gracePeriod: 5 * time.Minute},
+	checkRetiredPages: {enabled: true, interval: time.Minute},
+	checkNVLink:       {enabled: false, interval: time.Minute},
+	checkProbes:       {enabled: true, interval: 5 * time.Minute},
+}
+
+// checkConfig configures a health check.
+type checkConfig struct {
+	Enabled *bool `yaml:"enabled"`
+	// Interval is how often the check runs.
+	Interval time.Duration `yaml:"interval"`
+	// Severity, unhealthy or degraded, overrides the severity of the
+	// events reported by the check.
+	Severity string `yaml:"severity"`
+	// GracePeriod is how long the check must keep reporting a device before
+	// its health changes.
+	GracePeriod time.Duration `yaml:"gracePeriod"`
+}
+
+func checkNames() []string {
+	var names []string
+	for name := range healthChecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validateChecks(checks map[string]checkConfig) error {
+	for name, c := range checks {
+		defaults, ok := healthChecks[name]
+		if !ok {
+			return fmt.Errorf("health.checks: unknown check %q, expected one of %s", name, strings.Join(checkNames(), ", "))
+		}
+		if err := c.validate(defaults); err != nil {
+			return fmt.Errorf("health.checks.%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (c checkConfig) validate(defaults checkDefaults) error {
+	if c.Interval < 0 || c.GracePeriod < 0 {
+		return fmt.Errorf("negative duration")
+	}
+	if defaults.interval == 0 && c.Interval != 0 {
+		return fmt.Errorf("interval is not supported by event driven checks")
+	}
+	if defaults.interval == 0 && c.GracePeriod != 0 {
+		return fmt.Errorf("gracePeriod is not supported by event driven checks")
+	}
+	if c.Severity != "" && !validHealthAction(c.Severity) {
+		return fmt.Errorf("invalid severity %q, expected %s or %s", c.Severity, healthActionUnhealthy, healthActionDegraded)
+	}
+	return nil
+}
+
+// check returns the configuration of a check with its defaults applied.
+func (c healthConfig) check(name string) checkConfig {
+	defaults := healthChecks[name]
+	check := c.Checks[name]
+	if check.Enabled == nil {
+		check.Enabled = &defaults.enabled
+	}
+	if check.Interval == 0 {
+		check.Interval = defaults.interval
+	}
+	if check.GracePeriod == 0 {
+		check.GracePeriod = defaults.gracePeriod
+	}
+	return check
+}
+
+func (c checkConfig) enabled() bool {
+	return c.Enabled != nil && *c.Enabled
+}
+
+// setCheck sets a parameter of a check from a "check.parameter=value"
+// assignment, as given to the -health-check flag.
+func (c *healthConfig) setCheck(assignment string) error {
+	kv := strings.SplitN(assignment, "=", 2)
+	parts := strings.SplitN(kv[0], ".", 2)
+	if len(kv) != 2 || len(parts) != 2 {
+		return fmt.Errorf("invalid health check setting %q, expected <check>.<parameter>=<value>", assignment)
+	}
+	name, param, value := parts[0], parts[1], kv[1]
+
+	if _, ok := healthChecks[name]; !ok {
+		return fmt.Errorf("unknown health check %q, expected one of %s", name, strings.Join(checkNames(), ", "))
+	}
+	if c.Checks == nil {
+		c.Checks = make(map[string]checkConfig)
+	}
+	check := c.Checks[name]
+
+	var err error
+	switch param {
+	case "enabled":
+		var enabled bool
+		enabled, err = strconv.ParseBool(value)
+		check.Enabled = &enabled
+	case "interval":
+		check.Interval, err = time.ParseDuration(value)
+	case "gracePeriod":
+		check.GracePeriod, err = time.ParseDuration(value)
+	case "severity":
+		check.Severity = value
+	default:
+		return fmt.Errorf("unknown parameter %q of health check %s, expected enabled, interval, severity or gracePeriod", param, name)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s.%s: %v", name, param, err)
+	}
+
+	c.Checks[name] = check
+	return nil
+}
+
+// disableChecks disables the checks listed in DP_DISABLE_HEALTHCHECKS, all of
+// them if it is "all". Like in the previous versions, a check is disabled if
+// the variable contains its name.
+func (c *healthConfig) disableChecks(disabled string) {
+	disabled = strings.ToLower(disabled)
+	if disabled == "" {
+		return
+	}
+	if c.Checks == nil {
+		c.Checks = make(map[string]checkConfig)
+	}
+
+	for _, name := range checkNames() {
+		if disabled != "all" && !strings.Contains(disabled, strings.ToLower(name)) {
+			continue
+		}
+
+		check := c.Checks[name]
+		enabled := false
+		check.Enabled = &enabled
+		c.Checks[name] = check
+		log.Printf("Health check %s disabled by %s.", name, envDisableHealthChecks)
+	}
+}
+
+// graceState is when a check started and last reported a device.
+type graceState struct {
+	first, last time.Time
+}
+
+// checkFilter applies the severity and the grace period of the checks to
+// their events.
+type checkFilter struct {
+	config   healthConfig
+	reported map[string]*graceState
+}
+
+func newCheckFilter(config healthConfig) *checkFilter {
+	return &checkFilter{config: config, reported: make(map[string]*graceState)}
+}
+
+// filter returns the event with the severity of its check, or false while
+// the check has not reported the device for its grace period. A device is
+// reported continuously as long as the check reports it at every interval.
+// Each probe is tracked separately, at its own interval.
+func (f *checkFilter) filter(e healthEvent, now time.Time) (healthEvent, bool) {
+	check := f.config.check(e.Check)
+	if check.Severity != "" {
+		e.Degraded = check.Severity == healthActionDegraded
+	}
+	if check.GracePeriod == 0 {
+		return e, true
+	}
+
+	key := e.Check + "/" + e.Device.ID
+	interval := check.Interval
+	if e.Probe != "" {
+		key = e.Check + "/" + e.Probe + "/" + e.Device.ID
+		for _, p := range f.config.Probes {
+			if p.Name == e.Probe && p.Interval != 0 {
+				interval = p.Interval
+			}
+		}
+	}
+	s, ok := f.reported[key]
+	if !ok || now.Sub(s.last) > 2*interval {
+		s = &graceState{first: now}
+		f.reported[key] = s
+	}
+	s.last = now
+
+	if now.Sub(s.first) < check.GracePeriod {
+		return e, false
+	}
+	e.Reason = fmt.Sprintf("%s for %s", e.Reason, now.Sub(s.first).Truncate(time.Second))
+	return e, true
+}
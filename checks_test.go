@@ -0,0 +1,156 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// enabledChecks returns the names of the enabled checks.
+func enabledChecks(c healthConfig) []string {
+	var names []string
+	for _, name := range checkNames() {
+		if c.check(name).enabled() {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func TestDisableChecks(t *testing.T) {
+	enabled := false
+	tests := []struct {
+		disabled string
+		checks   map[string]checkConfig
+		want     []string
+	}{
+		{disabled: "", want: []string{checkProbes, checkRetiredPages, checkTelemetry, checkXIDs}},
+		{disabled: "all", want: nil},
+		{disabled: "ALL", want: nil},
+		// The retired pages were checked with the XIDs before they had
+		// their own check.
+		{disabled: "xids", want: []string{checkProbes, checkRetiredPages, checkTelemetry}},
+		{disabled: "XIDs,telemetry", want: []string{checkProbes, checkRetiredPages}},
+		{disabled: "retiredpages probes", want: []string{checkTelemetry, checkXIDs}},
+		{disabled: "nvlink", checks: map[string]checkConfig{checkNVLink: {Interval: time.Minute}}, want: []string{checkProbes, checkRetiredPages, checkTelemetry, checkXIDs}},
+		{disabled: "pcie", checks: map[string]checkConfig{checkTelemetry: {Enabled: &enabled}}, want: []string{checkProbes, checkRetiredPages, checkXIDs}},
+		{disabled: "unknown", want: []string{checkProbes, checkRetiredPages, checkTelemetry, checkXIDs}},
+	}
+
+	for _, tt := range tests {
+		c := healthConfig{Checks: tt.checks}
+		c.disableChecks(tt.disabled)
+		if got := enabledChecks(c); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got enabled checks %v, want %v", tt.disabled, got, tt.want)
+		}
+	}
+}
+
+func TestSetCheck(t *testing.T) {
+	enabled, disabled := true, false
+	tests := []struct {
+		assignments []string
+		want        map[string]checkConfig
+		// err is part of the error of setCheck or of the validation.
+		err string
+	}{
+		{
+			assignments: []string{"pcie.enabled=true", "pcie.interval=30s", "pcie.gracePeriod=10m"},
+			want:        map[string]checkConfig{checkPCIe: {Enabled: &enabled, Interval: 30 * time.Second, GracePeriod: 10 * time.Minute}},
+		},
+		{
+			assignments: []string{"nvlink.severity=degraded", "xids.enabled=false"},
+			want:        map[string]checkConfig{checkNVLink: {Severity: healthActionDegraded}, checkXIDs: {Enabled: &disabled}},
+		},
+		{assignments: []string{"pcie.enabled=false", "pcie.enabled=true"}, want: map[string]checkConfig{checkPCIe: {Enabled: &enabled}}},
+		{assignments: []string{"pcie"}, err: "expected <check>.<parameter>=<value>"},
+		{assignments: []string{"pcie=true"}, err: "expected <check>.<parameter>=<value>"},
+		{assignments: []string{"gpu.enabled=true"}, err: `unknown health check "gpu"`},
+		{assignments: []string{"pcie.threshold=2"}, err: `unknown parameter "threshold"`},
+		{assignments: []string{"pcie.enabled=maybe"}, err: "invalid pcie.enabled"},
+		{assignments: []string{"pcie.interval=1"}, err: "invalid pcie.interval"},
+		{assignments: []string{"pcie.interval=-1m"}, err: "negative duration"},
+		{assignments: []string{"pcie.severity=fatal"}, err: `invalid severity "fatal"`},
+		{assignments: []string{"xids.interval=1m"}, err: "interval is not supported"},
+		{assignments: []string{"xids.gracePeriod=1m"}, err: "gracePeriod is not supported"},
+	}
+
+	for _, tt := range tests {
+		name := strings.Join(tt.assignments, " ")
+		var c healthConfig
+		var err error
+		for _, a := range tt.assignments {
+			if err = c.setCheck(a); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = validateChecks(c.Checks)
+		}
+
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(c.Checks, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", name, c.Checks, tt.want)
+		}
+	}
+}
+
+func TestCheckFilter(t *testing.T) {
+	config := healthConfig{
+		Checks: map[string]checkConfig{
+			checkProbes: {GracePeriod: 10 * time.Minute},
+			checkNVLink: {Severity: healthActionDegraded},
+		},
+		Probes: []execProbe{{Name: "fast", Interval: time.Minute}, {Name: "slow"}},
+	}
+	filter := newCheckFilter(config)
+	a, b := testDevice("GPU-a", 0, ""), testDevice("GPU-b", 1, "")
+	probe := func(name string, d *Device) healthEvent {
+		return healthEvent{Device: d, Check: checkProbes, Probe: name, Reason: "probe " + name}
+	}
+
+	start := time.Now()
+	steps := []struct {
+		name     string
+		at       time.Duration
+		event    healthEvent
+		passed   bool
+		reason   string
+		degraded bool
+	}{
+		{name: "no grace period", event: healthEvent{Device: a, Check: checkXIDs, Reason: "XID 79"}, passed: true, reason: "XID 79"},
+		{name: "severity", event: healthEvent{Device: a, Check: checkNVLink, Reason: "nvlink"}, passed: true, reason: "nvlink", degraded: true},
+		{name: "slow reported", event: probe("slow", a), passed: false},
+		{name: "fast reported", at: time.Minute, event: probe("fast", a), passed: false},
+		{name: "other device", at: 2 * time.Minute, event: probe("fast", b), passed: false},
+		{name: "fast still reported", at: 2 * time.Minute, event: probe("fast", a), passed: false},
+		// The gap is within 2 intervals of the slow probe, 5 minutes by
+		// default, but not of the fast one.
+		{name: "fast reset", at: 10 * time.Minute, event: probe("fast", a), passed: false},
+		{name: "slow grace period", at: 10 * time.Minute, event: probe("slow", a), passed: true, reason: "probe slow for 10m0s"},
+		{name: "fast reported again", at: 11 * time.Minute, event: probe("fast", a), passed: false},
+	}
+
+	for _, step := range steps {
+		e, passed := filter.filter(step.event, start.Add(step.at))
+		if passed != step.passed {
+			t.Errorf("%s: got passed %v, want %v", step.name, passed, step.passed)
+			continue
+		}
+		if passed && (e.Reason != step.reason || e.Degraded != step.degraded) {
+			t.Errorf("%s: got reason %q and degraded %v, want %q and %v", step.name, e.Reason, e.Degraded, step.reason, step.degraded)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	defaultConditionType  = "GPUHealthy"
+	defaultTaintKey       = "nvidia.com/gpu-unhealthy"
+	defaultTaintThreshold = 0.5
+
+	// nodeResyncInterval is how often the condition and the taint are
+	// applied again, e.g. after the Node was recreated.
+	nodeResyncInterval = 5 * time.Minute
+	nodeRetryDelay     = 30 * time.Second
+	nodeUpdateRetries  = 5
+
+	conditionReasonHealthy   = "GPUsHealthy"
+	conditionReasonUnhealthy = "GPUsUnhealthy"
+)
+
+// conditionConfig configures the condition of the Node summarizing the
+// health of its GPUs.
+type conditionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Type defaults to GPUHealthy.
+	Type string `yaml:"type"`
+}
+
+func (c conditionConfig) conditionType() corev1.NodeConditionType {
+	if c.Type == "" {
+		return defaultConditionType
+	}
+	return corev1.NodeConditionType(c.Type)
+}
+
+// taintConfig configures the taint of the Node applied once the share of its
+// unhealthy GPUs reaches the threshold.
+type taintConfig struct {
+	Enabled bool               `yaml:"enabled"`
+	Key     string             `yaml:"key"`
+	Value   string             `yaml:"value"`
+	Effect  corev1.TaintEffect `yaml:"effect"`
+	// Threshold is the share of unhealthy GPUs, between 0 and 1, from
+	// which the Node is tainted.
+	Threshold float64 `yaml:"threshold"`
+}
+
+func (c taintConfig) validate() error {
+	switch c.Effect {
+	case "", corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+	default:
+		return fmt.Errorf("kubernetes.taint: invalid effect %q", c.Effect)
+	}
+	if c.Threshold < 0 || c.Threshold > 1 {
+		return fmt.Errorf("kubernetes.taint: threshold must be between 0 and 1")
+	}
+	return nil
+}
+
+func (c taintConfig) taint() corev1.Taint {
+	t := corev1.Taint{Key: c.Key, Value: c.Value, Effect: c.Effect}
+	if t.Key == "" {
+		t.Key = defaultTaintKey
+	}
+	if t.Effect == "" {
+		t.Effect = corev1.TaintEffectNoSchedule
+	}
+	return t
+}
+
+func (c taintConfig) threshold() float64 {
+	if c.Threshold == 0 {
+		return defaultTaintThreshold
+	}
+	return c.Threshold
+}
+
+// healthSummary is the health of all the GPUs of the node.
+type healthSummary struct {
+	total int
+	// unhealthy maps the unhealthy GPUs to the reason.
+	unhealthy map[string]string
+	// reboot maps the GPUs which require a reboot of the node to the
+	// reason.
+	reboot map[string]string
+}
+
+func (s healthSummary) message() string {
+	message := fmt.Sprintf("All the %d GPUs are healthy", s.total)
+	if len(s.unhealthy) > 0 {
+		message = fmt.Sprintf("%d of %d GPUs are unhealthy: %s", len(s.unhealthy), s.total, listReasons(s.unhealthy))
+	}
+	if len(s.reboot) > 0 {
+		message += fmt.Sprintf("; the node requires a reboot: %s", listReasons(s.reboot))
+	}
+	return message
+}
+
+// listReasons lists GPUs along with their reason, sorted.
+func listReasons(reasons map[string]string) string {
+	var gpus []string
+	for id, reason := range reasons {
+		gpus = append(gpus, fmt.Sprintf("%s (%s)", id, reason))
+	}
+	sort.Strings(gpus)
+	return strings.Join(gpus, ", ")
+}
+
+// nodeHealth maintains the condition and the taint of the Node according to
+// the health of its GPUs. The Node is updated in the background so that a
+// slow API server never blocks the health checks.
+type nodeHealth struct {
+	client    corev1client.NodesGetter
+	node      string
+	condition conditionConfig
+	taint     taintConfig
+	changed   chan struct{}
+
+	mu      sync.Mutex
+	summary *healthSummary
+}
+
+// newNodeHealth returns the updater of the condition and the taint of a node,
+// e.g. given the CoreV1() of a fake clientset in tests.
+func newNodeHealth(client corev1client.NodesGetter, node string, condition conditionConfig, taint taintConfig) *nodeHealth {
+	return &nodeHealth{
+		client:    client,
+		node:      node,
+		condition: condition,
+		taint:     taint,
+		changed:   make(chan struct{}, 1),
+	}
+}
+
+// update makes the Node reflect the health of the GPUs, it never blocks.
+func (h *nodeHealth) update(s healthSummary) {
+	h.mu.Lock()
+	h.summary = &s
+	h.mu.Unlock()
+
+	select {
+	case h.changed <- struct{}{}:
+	default:
+	}
+}
+
+// run updates the Node whenever the health of the GPUs changes until stop is
+// closed.
+func (h *nodeHealth) run(stop <-chan struct{}) {
+	resync := time.NewTicker(nodeResyncInterval)
+	defer resync.Stop()
+
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case <-h.changed:
+		case <-resync.C:
+		case <-retry:
+		}
+
+		h.mu.Lock()
+		s := h.summary
+		h.mu.Unlock()
+		if s == nil {
+			continue
+		}
+
+		retry = nil
+		if err := h.sync(*s); err != nil {
+			log.Printf("Warning: could not update node %s: %s, retrying in %s.", h.node, err, nodeRetryDelay)
+			retry = time.After(nodeRetryDelay)
+		}
+	}
+}
+
+// sync applies the condition and the taint to the Node.
+func (h *nodeHealth) sync(s healthSummary) error {
+	ctx, cancel := context.WithTimeout(context.Background(), kubernetesAPITimeout)
+	defer cancel()
+
+	if h.condition.Enabled {
+		if err := h.syncCondition(ctx, s); err != nil {
+			return err
+		}
+	}
+	if h.taint.Enabled {
+		return h.syncTaint(ctx, s)
+	}
+	return nil
+}
+
+// syncCondition patches the condition of the Node, the transition time only
+// changes with the status.
+func (h *nodeHealth) syncCondition(ctx context.Context, s healthSummary) error {
+	node, err := h.client.Nodes().Get(ctx, h.node, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	now := metav1.Now()
+	condition := corev1.NodeCondition{
+		Type:               h.condition.conditionType(),
+		Status:             corev1.ConditionTrue,
+		Reason:             conditionReasonHealthy,
+		Message:            s.message(),
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+	}
+	if len(s.unhealthy) > 0 {
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = conditionReasonUnhealthy
+	}
+	for _, c := range node.Status.Conditions {
+		if c.Type == condition.Type && c.Status == condition.Status {
+			condition.LastTransitionTime = c.LastTransitionTime
+		}
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []corev1.NodeCondition{condition},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = h.client.Nodes().PatchStatus(ctx, h.node, patch)
+	return err
+}
+
+// syncTaint adds the taint to the Node once the share of unhealthy GPUs
+// reaches the threshold and removes it otherwise.
+func (h *nodeHealth) syncTaint(ctx context.Context, s healthSummary) error {
+	taint := h.taint.taint()
+	tainted := s.total > 0 && float64(len(s.unhealthy))/float64(s.total) >= h.taint.threshold()
+
+	for i := 0; ; i++ {
+		node, err := h.client.Nodes().Get(ctx, h.node, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		var taints []corev1.Taint
+		found := false
+		for _, t := range node.Spec.Taints {
+			if t.Key == taint.Key && t.Effect == taint.Effect {
+				found = true
+				continue
+			}
+			taints = append(taints, t)
+		}
+		if found == tainted {
+			return nil
+		}
+		if tainted {
+			now := metav1.Now()
+			taint.TimeAdded = &now
+			taints = append(taints, taint)
+		}
+
+		node.Spec.Taints = taints
+		_, err = h.client.Nodes().Update(ctx, node, metav1.UpdateOptions{})
+		if errors.IsConflict(err) && i < nodeUpdateRetries {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if tainted {
+			log.Printf("Tainted node %s with %s: %s.", h.node, taint.ToString(), s.message())
+		} else {
+			log.Printf("Removed taint %s from node %s.", taint.ToString(), h.node)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/typed/core/v1/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func testNode(taints ...corev1.Taint) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Spec:       corev1.NodeSpec{Taints: taints},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+		},
+	}
+}
+
+func getNode(t *testing.T, client *fake.FakeCoreV1) *corev1.Node {
+	node, err := client.Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+func findCondition(node *corev1.Node, conditionType corev1.NodeConditionType) *corev1.NodeCondition {
+	for i, c := range node.Status.Conditions {
+		if c.Type == conditionType {
+			return &node.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// summary returns the health of total GPUs, of which the listed ones are
+// unhealthy.
+func summary(total int, unhealthy ...string) healthSummary {
+	s := healthSummary{total: total, unhealthy: make(map[string]string)}
+	for _, id := range unhealthy {
+		s.unhealthy[id] = "XID 79"
+	}
+	return s
+}
+
+func TestSyncCondition(t *testing.T) {
+	// The condition was last changed an hour ago, the API server stores
+	// the times with a precision of a second.
+	changed := metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+	node := testNode()
+	node.Status.Conditions = append(node.Status.Conditions, corev1.NodeCondition{
+		Type:               "GPUHealthy",
+		Status:             corev1.ConditionTrue,
+		Reason:             conditionReasonHealthy,
+		LastHeartbeatTime:  changed,
+		LastTransitionTime: changed,
+	})
+	client := newFakeClient(node)
+	h := newNodeHealth(client, "node1", conditionConfig{Enabled: true}, taintConfig{})
+
+	steps := []struct {
+		name    string
+		summary healthSummary
+		status  corev1.ConditionStatus
+		reason  string
+		message string
+		// transitioned is set when the transition time must change.
+		transitioned bool
+	}{
+		{
+			name:    "still healthy",
+			summary: summary(2),
+			status:  corev1.ConditionTrue,
+			reason:  conditionReasonHealthy,
+			message: "All the 2 GPUs are healthy",
+		},
+		{
+			name:         "unhealthy",
+			summary:      summary(2, "GPU-a"),
+			status:       corev1.ConditionFalse,
+			reason:       conditionReasonUnhealthy,
+			message:      "1 of 2 GPUs are unhealthy: GPU-a (XID 79)",
+			transitioned: true,
+		},
+		{
+			name:    "still unhealthy",
+			summary: summary(2, "GPU-a", "GPU-b"),
+			status:  corev1.ConditionFalse,
+			reason:  conditionReasonUnhealthy,
+			message: "2 of 2 GPUs are unhealthy: GPU-a (XID 79), GPU-b (XID 79)",
+		},
+		{
+			name:         "recovered",
+			summary:      summary(2),
+			status:       corev1.ConditionTrue,
+			reason:       conditionReasonHealthy,
+			message:      "All the 2 GPUs are healthy",
+			transitioned: true,
+		},
+	}
+
+	for _, step := range steps {
+		// Only a new transition time differs from the one of an hour ago.
+		node := getNode(t, client)
+		if c := findCondition(node, "GPUHealthy"); c != nil {
+			c.LastTransitionTime = changed
+			if _, err := client.Nodes().UpdateStatus(context.Background(), node, metav1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		start := time.Now().Truncate(time.Second)
+
+		if err := h.sync(step.summary); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		node = getNode(t, client)
+		if findCondition(node, corev1.NodeReady) == nil {
+			t.Errorf("%s: the Ready condition was removed", step.name)
+		}
+		c := findCondition(node, "GPUHealthy")
+		if c == nil {
+			t.Fatalf("%s: no GPUHealthy condition", step.name)
+		}
+		if c.Status != step.status || c.Reason != step.reason || c.Message != step.message {
+			t.Errorf("%s: got %s %s %q, want %s %s %q", step.name, c.Status, c.Reason, c.Message, step.status, step.reason, step.message)
+		}
+		if c.LastHeartbeatTime.Time.Before(start) {
+			t.Errorf("%s: got heartbeat time %s, want after %s", step.name, c.LastHeartbeatTime, start)
+		}
+		if step.transitioned {
+			if c.LastTransitionTime.Time.Before(start) {
+				t.Errorf("%s: got transition time %s, want after %s", step.name, c.LastTransitionTime, start)
+			}
+		} else if !c.LastTransitionTime.Equal(&changed) {
+			t.Errorf("%s: got transition time %s, want %s", step.name, c.LastTransitionTime, changed)
+		}
+	}
+}
+
+func TestSyncTaint(t *testing.T) {
+	other := corev1.Taint{Key: "dedicated", Value: "gpu", Effect: corev1.TaintEffectNoSchedule}
+	client := newFakeClient(testNode(other))
+
+	tests := []struct {
+		name    string
+		config  taintConfig
+		summary healthSummary
+		want    []corev1.Taint
+	}{
+		{name: "no GPUs", summary: summary(0), want: []corev1.Taint{other}},
+		{name: "below the threshold", summary: summary(4, "GPU-a"), want: []corev1.Taint{other}},
+		{
+			name:    "threshold reached",
+			summary: summary(4, "GPU-a", "GPU-b"),
+			want:    []corev1.Taint{other, {Key: defaultTaintKey, Effect: corev1.TaintEffectNoSchedule}},
+		},
+		{
+			name:    "above the threshold",
+			summary: summary(4, "GPU-a", "GPU-b", "GPU-c"),
+			want:    []corev1.Taint{other, {Key: defaultTaintKey, Effect: corev1.TaintEffectNoSchedule}},
+		},
+		{name: "below the threshold again", summary: summary(4, "GPU-c"), want: []corev1.Taint{other}},
+		{
+			name:    "configured taint",
+			config:  taintConfig{Key: "example.com/gpu", Value: "broken", Effect: corev1.TaintEffectNoExecute, Threshold: 0.25},
+			summary: summary(4, "GPU-c"),
+			want:    []corev1.Taint{other, {Key: "example.com/gpu", Value: "broken", Effect: corev1.TaintEffectNoExecute}},
+		},
+		{
+			name:    "configured taint removed",
+			config:  taintConfig{Key: "example.com/gpu", Value: "broken", Effect: corev1.TaintEffectNoExecute, Threshold: 0.25},
+			summary: summary(4),
+			want:    []corev1.Taint{other},
+		},
+	}
+
+	for _, tt := range tests {
+		tt.config.Enabled = true
+		h := newNodeHealth(client, "node1", conditionConfig{}, tt.config)
+		if err := h.sync(tt.summary); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		var got []corev1.Taint
+		for _, taint := range getNode(t, client).Spec.Taints {
+			if taint.TimeAdded == nil && taint.Key != other.Key {
+				t.Errorf("%s: taint %s has no time", tt.name, taint.ToString())
+			}
+			taint.TimeAdded = nil
+			got = append(got, taint)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got taints %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSyncTaintConflict(t *testing.T) {
+	tests := []struct {
+		name      string
+		conflicts int
+		updates   int
+		tainted   bool
+	}{
+		{name: "no conflict", conflicts: 0, updates: 1, tainted: true},
+		{name: "retried", conflicts: 2, updates: 3, tainted: true},
+		{name: "too many conflicts", conflicts: nodeUpdateRetries + 1, updates: nodeUpdateRetries + 1},
+	}
+
+	for _, tt := range tests {
+		client := newFakeClient(testNode())
+		conflicts, updates := tt.conflicts, 0
+		client.PrependReactor("update", "nodes", func(action clienttesting.Action) (bool, runtime.Object, error) {
+			updates++
+			if conflicts > 0 {
+				conflicts--
+				return true, nil, errors.NewConflict(corev1.Resource("nodes"), "node1", fmt.Errorf("the object has been modified"))
+			}
+			return false, nil, nil
+		})
+
+		h := newNodeHealth(client, "node1", conditionConfig{}, taintConfig{Enabled: true})
+		err := h.sync(summary(1, "GPU-a"))
+		if tt.tainted && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.tainted && !errors.IsConflict(err) {
+			t.Errorf("%s: got %v, want a conflict", tt.name, err)
+		}
+		if updates != tt.updates {
+			t.Errorf("%s: got %d updates, want %d", tt.name, updates, tt.updates)
+		}
+		if tainted := len(getNode(t, client).Spec.Taints) == 1; tainted != tt.tainted {
+			t.Errorf("%s: got tainted %v, want %v", tt.name, tainted, tt.tainted)
+		}
+	}
+}
+
+func TestNodeHealthRun(t *testing.T) {
+	client := newFakeClient(testNode())
+	h := newNodeHealth(client, "node1", conditionConfig{Enabled: true}, taintConfig{Enabled: true})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go h.run(stop)
+	h.update(summary(2, "GPU-a"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		node := getNode(t, client)
+		c := findCondition(node, "GPUHealthy")
+		if c != nil && c.Status == corev1.ConditionFalse && len(node.Spec.Taints) == 1 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got condition %+v and taints %v", c, node.Spec.Taints)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
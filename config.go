@@ -0,0 +1,96 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+const envConfigFile = "DP_CONFIG_FILE"
+
+// Config is the content of the JSON or YAML file pointed to by
+// DP_CONFIG_FILE.
+type Config struct {
+	Devices   deviceFilter    `yaml:"devices"`
+	Resources []resourceClass `yaml:"resources"`
+	// Sharing applies to the resources which do not configure sharing.
+	Sharing sharingConfig `yaml:"sharing"`
+	Health  healthConfig  `yaml:"health"`
+	// Kubernetes configures what is reported to the API server.
+	Kubernetes kubernetesConfig `yaml:"kubernetes"`
+	// Notifications are the sinks the health transitions are sent to.
+	Notifications []sinkConfig `yaml:"notifications"`
+}
+
+// loadConfig reads the configuration file pointed to by DP_CONFIG_FILE, if
+// set, then applies the health check settings given as flags and the checks
+// disabled through DP_DISABLE_HEALTHCHECKS.
+func loadConfig(checks []string) (*Config, error) {
+	config := &Config{}
+
+	file := os.Getenv(envConfigFile)
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := yaml.UnmarshalStrict(b, config); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %v", file, err)
+		}
+	}
+
+	for _, c := range checks {
+		if err := config.Health.setCheck(c); err != nil {
+			return nil, fmt.Errorf("invalid -health-check flag: %v", err)
+		}
+	}
+	config.Health.disableChecks(os.Getenv(envDisableHealthChecks))
+
+	if err := config.validate(); err != nil {
+		if file == "" {
+			return nil, err
+		}
+		return nil, fmt.Errorf("invalid config file %s: %v", file, err)
+	}
+
+	return config, nil
+}
+
+func (c *Config) validate() error {
+	if err := c.Devices.validate(); err != nil {
+		return err
+	}
+	if err := c.Health.validate(); err != nil {
+		return err
+	}
+	if err := c.Kubernetes.validate(); err != nil {
+		return err
+	}
+	if err := validateSinks(c.Notifications); err != nil {
+		return err
+	}
+	return validateResourceClasses(c.Resources)
+}
+
+// resourceClasses returns the configured resource classes, or the default
+// nvidia.com/gpu class if none is configured.
+func (c *Config) resourceClasses() []resourceClass {
+	classes := c.Resources
+	if len(classes) == 0 {
+		classes = defaultResourceClasses
+	}
+
+	var res []resourceClass
+	for _, class := range classes {
+		if !class.Sharing.enabled() && !class.Memory.enabled() {
+			class.Sharing = c.Sharing
+		}
+		res = append(res, class)
+	}
+	return res
+}
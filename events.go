@@ -0,0 +1,207 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+	defaultEventsDedupWindow = 10 * time.Minute
+	defaultEventsBurst       = 10
+	defaultEventsPerMinute   = 6
+
+	// eventsNamespace is where the Events of the nodes are created, as
+	// done by the Kubelet.
+	eventsNamespace = "default"
+	eventsComponent = "nvidia-device-plugin"
+	eventsQueueSize = 100
+
+	annotationGPUUUID = "nvidia.com/gpu.uuid"
+	annotationGPUXID  = "nvidia.com/gpu.xid"
+)
+
+// Reasons of the Events published on the Node.
+const (
+	eventReasonUnhealthy = "GPUUnhealthy"
+	eventReasonDegraded  = "GPUDegraded"
+	eventReasonRecovered = "GPURecovered"
+	// eventReasonRebootRequired is published when a GPU requires a reboot
+	// of the node, e.g. to retire its pages.
+	eventReasonRebootRequired = "GPURebootRequired"
+)
+
+// eventsConfig configures the Kubernetes Events published on the Node when a
+// GPU becomes unhealthy or recovers.
+type eventsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// DedupWindow is how long an identical Event is not published again.
+	DedupWindow time.Duration `yaml:"dedupWindow"`
+	// Burst and PerMinute rate-limit the Events, the Events above the
+	// limit are dropped.
+	Burst     int `yaml:"burst"`
+	PerMinute int `yaml:"perMinute"`
+}
+
+func (c eventsConfig) validate() error {
+	if c.DedupWindow < 0 || c.Burst < 0 || c.PerMinute < 0 {
+		return fmt.Errorf("kubernetes.events: negative value")
+	}
+	return nil
+}
+
+// nodeEvents publishes the health transitions of the GPUs as Events of the
+// Node. The Events are published in the background so that a slow API
+// server never blocks the health checks.
+type nodeEvents struct {
+	client  corev1client.EventsGetter
+	node    string
+	window  time.Duration
+	limiter flowcontrol.RateLimiter
+	queue   chan *corev1.Event
+
+	mu sync.Mutex
+	// sent maps the Events to when they were last published.
+	sent map[string]time.Time
+	// stamp names the Events, it increases with every Event.
+	stamp int64
+}
+
+// newNodeEvents returns the publisher of the Events of a node, e.g. given
+// the CoreV1() of a fake clientset in tests.
+func newNodeEvents(client corev1client.EventsGetter, node string, config eventsConfig) *nodeEvents {
+	window := config.DedupWindow
+	if window == 0 {
+		window = defaultEventsDedupWindow
+	}
+	burst := config.Burst
+	if burst == 0 {
+		burst = defaultEventsBurst
+	}
+	perMinute := config.PerMinute
+	if perMinute == 0 {
+		perMinute = defaultEventsPerMinute
+	}
+
+	return &nodeEvents{
+		client:  client,
+		node:    node,
+		window:  window,
+		limiter: flowcontrol.NewTokenBucketRateLimiter(float32(perMinute)/60, burst),
+		queue:   make(chan *corev1.Event, eventsQueueSize),
+		sent:    make(map[string]time.Time),
+	}
+}
+
+// transition queues the Event of a health transition, unless it was already
+// published within the dedup window or the rate limit is exceeded.
+func (n *nodeEvents) transition(t healthTransition, now time.Time) {
+	eventType := corev1.EventTypeWarning
+	var reason, message string
+	switch {
+	case t.RebootRequired:
+		reason = eventReasonRebootRequired
+		message = fmt.Sprintf("GPU %s requires a reboot of the node: %s", t.Device, t.Reason)
+	case t.To == healthStateUnhealthy:
+		reason = eventReasonUnhealthy
+		message = fmt.Sprintf("GPU %s is unhealthy: %s", t.Device, t.Reason)
+	case t.To == healthStateDegraded:
+		reason = eventReasonDegraded
+		message = fmt.Sprintf("GPU %s is degraded: %s", t.Device, t.Reason)
+	case t.To == healthStateHealthy:
+		eventType = corev1.EventTypeNormal
+		reason = eventReasonRecovered
+		message = fmt.Sprintf("GPU %s recovered", t.Device)
+	default:
+		return
+	}
+
+	stamp, ok := n.accept(reason+"/"+message, now)
+	if !ok {
+		return
+	}
+
+	annotations := map[string]string{annotationGPUUUID: t.Device}
+	if t.XID != 0 {
+		annotations[annotationGPUXID] = strconv.FormatUint(t.XID, 10)
+	}
+	e := &corev1.Event{
+		// Named as by the event recorder of client-go.
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        fmt.Sprintf("%s.%x", n.node, stamp),
+			Namespace:   eventsNamespace,
+			Annotations: annotations,
+		},
+		// The Kubelet and kubectl use the name of the node as its UID.
+		InvolvedObject: corev1.ObjectReference{Kind: "Node", Name: n.node, UID: types.UID(n.node)},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         corev1.EventSource{Component: eventsComponent, Host: n.node},
+		FirstTimestamp: metav1.NewTime(now),
+		LastTimestamp:  metav1.NewTime(now),
+		Count:          1,
+	}
+
+	select {
+	case n.queue <- e:
+	default:
+		log.Printf("Warning: dropping the %s Event of %s, too many Events are pending.", reason, t.Device)
+	}
+}
+
+// accept returns whether an Event can be published and records it, along with
+// the stamp naming it. Events published within the dedup window are dropped
+// silently, the Events above the rate limit with a warning.
+func (n *nodeEvents) accept(key string, now time.Time) (int64, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for k, sent := range n.sent {
+		if now.Sub(sent) >= n.window {
+			delete(n.sent, k)
+		}
+	}
+	if _, ok := n.sent[key]; ok {
+		return 0, false
+	}
+	if !n.limiter.TryAccept() {
+		log.Printf("Warning: dropping Event %q, rate limit exceeded.", key)
+		return 0, false
+	}
+	n.sent[key] = now
+
+	n.stamp++
+	if stamp := now.UnixNano(); stamp > n.stamp {
+		n.stamp = stamp
+	}
+	return n.stamp, true
+}
+
+// run publishes the queued Events until stop is closed.
+func (n *nodeEvents) run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case e := <-n.queue:
+			ctx, cancel := context.WithTimeout(context.Background(), kubernetesAPITimeout)
+			_, err := n.client.Events(eventsNamespace).Create(ctx, e, metav1.CreateOptions{})
+			cancel()
+			if err != nil {
+				log.Printf("Warning: could not publish the %s Event of %s: %s", e.Reason, e.Annotations[annotationGPUUUID], err)
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// waitEvents waits for the Events published on the fake API server.
+func waitEvents(t *testing.T, client corev1client.EventsGetter, n int) []corev1.Event {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		list, err := client.Events(eventsNamespace).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Items) >= n || time.Now().After(deadline) {
+			sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+			return list.Items
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNodeEvents(t *testing.T) {
+	unhealthy := func(device string, xid uint64) healthTransition {
+		return healthTransition{Device: device, From: healthStateHealthy, To: healthStateUnhealthy, Reason: "XID 79", XID: xid}
+	}
+
+	start := time.Now()
+	tests := []struct {
+		name   string
+		config eventsConfig
+		steps  []healthTransition
+		at     []time.Duration
+		want   []string // messages of the published Events
+	}{
+		{
+			name:   "dedup",
+			config: eventsConfig{DedupWindow: time.Minute},
+			steps:  []healthTransition{unhealthy("GPU-a", 79), unhealthy("GPU-a", 79), unhealthy("GPU-b", 79), unhealthy("GPU-a", 79)},
+			at:     []time.Duration{0, 30 * time.Second, 30 * time.Second, 2 * time.Minute},
+			want:   []string{"GPU GPU-a is unhealthy: XID 79", "GPU GPU-b is unhealthy: XID 79", "GPU GPU-a is unhealthy: XID 79"},
+		},
+		{
+			name:   "rate limit",
+			config: eventsConfig{Burst: 2, PerMinute: 1},
+			steps:  []healthTransition{unhealthy("GPU-a", 79), unhealthy("GPU-b", 79), unhealthy("GPU-c", 79), unhealthy("GPU-d", 79)},
+			at:     []time.Duration{0, 0, 0, 0},
+			want:   []string{"GPU GPU-a is unhealthy: XID 79", "GPU GPU-b is unhealthy: XID 79"},
+		},
+	}
+
+	for _, tt := range tests {
+		client := newFakeClient()
+		events := newNodeEvents(client, "node1", tt.config)
+		for i, step := range tt.steps {
+			events.transition(step, start.Add(tt.at[i]))
+		}
+
+		stop := make(chan struct{})
+		go events.run(stop)
+		published := waitEvents(t, client, len(tt.want))
+		close(stop)
+
+		var got []string
+		for _, e := range published {
+			got = append(got, e.Message)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNodeEventsContent(t *testing.T) {
+	tests := []struct {
+		transition  healthTransition
+		eventType   string
+		reason      string
+		message     string
+		annotations map[string]string
+	}{
+		{
+			transition:  healthTransition{Device: "GPU-a", From: healthStateHealthy, To: healthStateUnhealthy, Reason: "XID 79", XID: 79},
+			eventType:   corev1.EventTypeWarning,
+			reason:      eventReasonUnhealthy,
+			message:     "GPU GPU-a is unhealthy: XID 79",
+			annotations: map[string]string{annotationGPUUUID: "GPU-a", annotationGPUXID: "79"},
+		},
+		{
+			transition:  healthTransition{Device: "GPU-b", From: healthStateHealthy, To: healthStateDegraded, Reason: "pcie: width x8"},
+			eventType:   corev1.EventTypeWarning,
+			reason:      eventReasonDegraded,
+			message:     "GPU GPU-b is degraded: pcie: width x8",
+			annotations: map[string]string{annotationGPUUUID: "GPU-b"},
+		},
+		{
+			transition:  healthTransition{Device: "GPU-c", From: healthStateUnhealthy, To: healthStateHealthy},
+			eventType:   corev1.EventTypeNormal,
+			reason:      eventReasonRecovered,
+			message:     "GPU GPU-c recovered",
+			annotations: map[string]string{annotationGPUUUID: "GPU-c"},
+		},
+		{
+			transition:  healthTransition{Device: "GPU-d", From: healthStateUnhealthy, To: healthStateUnhealthy, Reason: "pages pending retirement", XID: 63, RebootRequired: true},
+			eventType:   corev1.EventTypeWarning,
+			reason:      eventReasonRebootRequired,
+			message:     "GPU GPU-d requires a reboot of the node: pages pending retirement",
+			annotations: map[string]string{annotationGPUUUID: "GPU-d", annotationGPUXID: "63"},
+		},
+	}
+
+	for _, tt := range tests {
+		client := newFakeClient()
+		events := newNodeEvents(client, "node1", eventsConfig{})
+		now := time.Now().Truncate(time.Second)
+		events.transition(tt.transition, now)
+
+		stop := make(chan struct{})
+		go events.run(stop)
+		published := waitEvents(t, client, 1)
+		close(stop)
+
+		if len(published) != 1 {
+			t.Errorf("%s: got %d Events, want 1", tt.transition.Device, len(published))
+			continue
+		}
+		e := published[0]
+		if e.Type != tt.eventType || e.Reason != tt.reason || e.Message != tt.message {
+			t.Errorf("%s: got %s %s %q, want %s %s %q", tt.transition.Device, e.Type, e.Reason, e.Message, tt.eventType, tt.reason, tt.message)
+		}
+		if !reflect.DeepEqual(e.Annotations, tt.annotations) {
+			t.Errorf("%s: got annotations %v, want %v", tt.transition.Device, e.Annotations, tt.annotations)
+		}
+		if e.InvolvedObject.Kind != "Node" || e.InvolvedObject.Name != "node1" || e.Source.Component != eventsComponent || e.Namespace != eventsNamespace {
+			t.Errorf("%s: got involved object %+v, source %+v in %s", tt.transition.Device, e.InvolvedObject, e.Source, e.Namespace)
+		}
+		if !e.FirstTimestamp.Time.Equal(now) || e.Count != 1 {
+			t.Errorf("%s: got first timestamp %s, count %d", tt.transition.Device, e.FirstTimestamp, e.Count)
+		}
+	}
+}
+
+func TestNodeEventsIgnoresRecovering(t *testing.T) {
+	events := newNodeEvents(newFakeClient(), "node1", eventsConfig{})
+	events.transition(healthTransition{Device: "GPU-a", From: healthStateUnhealthy, To: healthStateRecovering}, time.Now())
+	if n := len(events.queue); n != 0 {
+		t.Errorf("got %d Events, want none", n)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+)
+
+// deviceSelector matches devices on their attributes. All the fields which
+// are set must match for the selector to match.
+type deviceSelector struct {
+	Index     *uint  `yaml:"index"`
+	UUID      string `yaml:"uuid"`
+	BusID     string `yaml:"busID"`
+	Model     string `yaml:"model"`     // shell pattern, e.g. "Tesla V100*"
+	MinMemory uint64 `yaml:"minMemory"` // MiB
+}
+
+// deviceFilter selects the devices advertised by the plugin. When Include is
+// not empty a device must match one of its selectors, and it must match none
+// of the Exclude selectors.
+type deviceFilter struct {
+	Include []deviceSelector `yaml:"include"`
+	Exclude []deviceSelector `yaml:"exclude"`
+}
+
+func (s deviceSelector) validate() error {
+	if s.Index == nil && s.UUID == "" && s.BusID == "" && s.Model == "" && s.MinMemory == 0 {
+		return fmt.Errorf("empty device selector")
+	}
+	if _, err := path.Match(s.Model, ""); err != nil {
+		return fmt.Errorf("invalid model pattern %q: %v", s.Model, err)
+	}
+	return nil
+}
+
+func (s deviceSelector) matches(d *Device) bool {
+	if s.Index != nil && *s.Index != d.Index {
+		return false
+	}
+	if s.UUID != "" && s.UUID != d.ID {
+		return false
+	}
+	if s.BusID != "" && normalizeBusID(s.BusID) != normalizeBusID(d.BusID) {
+		return false
+	}
+	if s.Model != "" {
+		if ok, _ := path.Match(s.Model, d.Model); !ok {
+			return false
+		}
+	}
+	if s.MinMemory != 0 && d.Memory < s.MinMemory {
+		return false
+	}
+	return true
+}
+
+func (s deviceSelector) String() string {
+	var fields []string
+	if s.Index != nil {
+		fields = append(fields, fmt.Sprintf("index=%d", *s.Index))
+	}
+	if s.UUID != "" {
+		fields = append(fields, "uuid="+s.UUID)
+	}
+	if s.BusID != "" {
+		fields = append(fields, "busID="+s.BusID)
+	}
+	if s.Model != "" {
+		fields = append(fields, fmt.Sprintf("model=%q", s.Model))
+	}
+	if s.MinMemory != 0 {
+		fields = append(fields, fmt.Sprintf("minMemory=%dMiB", s.MinMemory))
+	}
+	return "{" + strings.Join(fields, ",") + "}"
+}
+
+// normalizeBusID makes NVML ("00000000:06:00.0") and sysfs ("0000:06:00.0")
+// PCI bus IDs comparable.
+func normalizeBusID(id string) string {
+	id = strings.ToLower(id)
+	if i := strings.Index(id, ":"); i > 4 {
+		id = id[i-4:]
+	}
+	return id
+}
+
+func (f deviceFilter) empty() bool {
+	return len(f.Include) == 0 && len(f.Exclude) == 0
+}
+
+func (f deviceFilter) validate() error {
+	for _, s := range f.Include {
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("devices.include: %v", err)
+		}
+	}
+	for _, s := range f.Exclude {
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("devices.exclude: %v", err)
+		}
+	}
+	return nil
+}
+
+// reason returns why the device is filtered out, or an empty string if it
+// should be advertised.
+func (f deviceFilter) reason(d *Device) string {
+	if len(f.Include) > 0 {
+		included := false
+		for _, s := range f.Include {
+			if s.matches(d) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return "not matched by any include selector"
+		}
+	}
+
+	for _, s := range f.Exclude {
+		if s.matches(d) {
+			return fmt.Sprintf("matched by exclude selector %s", s)
+		}
+	}
+
+	return ""
+}
+
+// filteredBackend only exposes the devices of a backend selected by a filter.
+// The devices filtered out are logged and recorded in the journal.
+type filteredBackend struct {
+	deviceBackend
+	filter  deviceFilter
+	journal *journal
+
+	mu       sync.Mutex
+	filtered map[string]string
+}
+
+func newFilteredBackend(backend deviceBackend, filter deviceFilter, journal *journal) deviceBackend {
+	if filter.empty() {
+		return backend
+	}
+	return &filteredBackend{deviceBackend: backend, filter: filter, journal: journal}
+}
+
+func (b *filteredBackend) Devices() ([]*Device, error) {
+	all, err := b.deviceBackend.Devices()
+	if err != nil {
+		return nil, err
+	}
+
+	var devs []*Device
+	filtered := make(map[string]string)
+	for _, d := range all {
+		if reason := b.filter.reason(d); reason != "" {
+			filtered[d.ID] = reason
+			continue
+		}
+		devs = append(devs, d)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for id, reason := range filtered {
+		if _, ok := b.filtered[id]; !ok {
+			log.Printf("Device %s is filtered out: %s.", id, reason)
+			b.journal.record(journalEntry{Kind: journalFiltered, Device: id, Reason: reason})
+		}
+	}
+	if len(filtered) != len(b.filtered) {
+		log.Printf("Advertising %d devices, %d filtered out.", len(devs), len(filtered))
+	}
+	b.filtered = filtered
+
+	return devs, nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestNormalizeBusID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{id: "00000000:06:00.0", want: "0000:06:00.0"},
+		{id: "0000:06:00.0", want: "0000:06:00.0"},
+		{id: "00000000:3B:00.0", want: "0000:3b:00.0"},
+		{id: "0000:3B:00.0", want: "0000:3b:00.0"},
+		{id: "00000001:af:00.0", want: "0001:af:00.0"},
+		{id: "06:00.0", want: "06:00.0"},
+		{id: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeBusID(tt.id); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestDeviceFilter(t *testing.T) {
+	index := func(i uint) *uint { return &i }
+	// GPU-a is an NVML device, GPU-b a sysfs one.
+	a := testDevice("GPU-a", 0, pluginapi.Healthy)
+	a.BusID = "00000000:3B:00.0"
+	a.Model = "Tesla V100-SXM2-16GB"
+	b := testDevice("GPU-b", 1, pluginapi.Healthy)
+	b.BusID = "0000:af:00.0"
+	b.Model = "Tesla T4"
+	b.Memory = 15109
+
+	tests := []struct {
+		name   string
+		filter deviceFilter
+		// want are the devices which are not filtered out.
+		want []string
+	}{
+		{name: "empty", want: []string{"GPU-a", "GPU-b"}},
+		{name: "uuid", filter: deviceFilter{Include: []deviceSelector{{UUID: "GPU-b"}}}, want: []string{"GPU-b"}},
+		{name: "uuid case", filter: deviceFilter{Include: []deviceSelector{{UUID: "gpu-b"}}}, want: nil},
+		{name: "index", filter: deviceFilter{Include: []deviceSelector{{Index: index(0)}}}, want: []string{"GPU-a"}},
+		{name: "index 0 is set", filter: deviceFilter{Exclude: []deviceSelector{{Index: index(0)}}}, want: []string{"GPU-b"}},
+		{name: "bus ID", filter: deviceFilter{Include: []deviceSelector{{BusID: "00000000:3B:00.0"}}}, want: []string{"GPU-a"}},
+		{name: "bus ID case", filter: deviceFilter{Include: []deviceSelector{{BusID: "0000:3b:00.0"}}}, want: []string{"GPU-a"}},
+		{name: "bus ID domain", filter: deviceFilter{Include: []deviceSelector{{BusID: "00000000:AF:00.0"}}}, want: []string{"GPU-b"}},
+		{name: "bus ID without domain", filter: deviceFilter{Include: []deviceSelector{{BusID: "af:00.0"}}}, want: nil},
+		{name: "model", filter: deviceFilter{Include: []deviceSelector{{Model: "Tesla V100*"}}}, want: []string{"GPU-a"}},
+		{name: "memory", filter: deviceFilter{Include: []deviceSelector{{MinMemory: 16000}}}, want: []string{"GPU-a"}},
+		{name: "all fields match", filter: deviceFilter{Include: []deviceSelector{{UUID: "GPU-a", Index: index(1)}}}, want: nil},
+		{name: "any selector", filter: deviceFilter{Include: []deviceSelector{{UUID: "GPU-a"}, {Index: index(1)}}}, want: []string{"GPU-a", "GPU-b"}},
+		{
+			name:   "exclude wins",
+			filter: deviceFilter{Include: []deviceSelector{{Model: "Tesla*"}}, Exclude: []deviceSelector{{BusID: "0000:AF:00.0"}}},
+			want:   []string{"GPU-a"},
+		},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, d := range []*Device{a, b} {
+			if tt.filter.reason(d) == "" {
+				got = append(got, d.ID)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDeviceFilterValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter deviceFilter
+		err    string
+	}{
+		{name: "empty filter"},
+		{name: "valid", filter: deviceFilter{Include: []deviceSelector{{Model: "Tesla*"}}, Exclude: []deviceSelector{{UUID: "GPU-a"}}}},
+		{name: "empty include", filter: deviceFilter{Include: []deviceSelector{{}}}, err: "devices.include: empty device selector"},
+		{name: "empty exclude", filter: deviceFilter{Exclude: []deviceSelector{{}}}, err: "devices.exclude: empty device selector"},
+		{name: "invalid model", filter: deviceFilter{Include: []deviceSelector{{Model: "Tesla [V100"}}}, err: `invalid model pattern "Tesla [V100"`},
+	}
+
+	for _, tt := range tests {
+		err := tt.filter.validate()
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const recoveryCheckInterval = 5 * time.Second
+
+// healthState is the health of a device as tracked by the plugin. Only
+// Healthy and Degraded devices are advertised as healthy to the Kubelet.
+type healthState string
+
+const (
+	healthStateHealthy   healthState = "Healthy"
+	healthStateDegraded  healthState = "Degraded"
+	healthStateUnhealthy healthState = "Unhealthy"
+	// healthStateRecovering devices were quiet for the recovery period but
+	// did not pass the probe yet.
+	healthStateRecovering healthState = "Recovering"
+)
+
+// Actions of the health checks which can either take a device out of the
+// allocatable devices or only report it.
+const (
+	healthActionUnhealthy = "unhealthy"
+	healthActionDegraded  = "degraded"
+)
+
+func validHealthAction(action string) bool {
+	return action == healthActionUnhealthy || action == healthActionDegraded
+}
+
+// healthConfig configures how the health of the devices is handled.
+type healthConfig struct {
+	// Checks configures the health checks by name.
+	Checks    map[string]checkConfig `yaml:"checks"`
+	Recovery  recoveryConfig         `yaml:"recovery"`
+	State     stateConfig            `yaml:"state"`
+	Journal   journalConfig          `yaml:"journal"`
+	Telemetry telemetryConfig        `yaml:"telemetry"`
+	PCIe      pcieConfig             `yaml:"pcie"`
+	NVLink    nvlinkConfig           `yaml:"nvlink"`
+	Probes    []execProbe            `yaml:"probes"`
+	// RebootRequiredFile is created when a device requires the node to
+	// reboot.
+	RebootRequiredFile string `yaml:"rebootRequiredFile"`
+}
+
+func (c healthConfig) validate() error {
+	if err := validateChecks(c.Checks); err != nil {
+		return err
+	}
+	if err := c.Recovery.validate(); err != nil {
+		return err
+	}
+	if err := c.State.validate(); err != nil {
+		return err
+	}
+	if err := c.Journal.validate(); err != nil {
+		return err
+	}
+	if err := c.Telemetry.validate(); err != nil {
+		return err
+	}
+	if err := c.NVLink.validate(); err != nil {
+		return err
+	}
+	return validateProbes(c.Probes)
+}
+
+// recoveryConfig lets unhealthy devices become healthy again once no health
+// event was reported for QuietPeriod and, if Probe is set, the backend could
+// probe them successfully.
+type recoveryConfig struct {
+	QuietPeriod time.Duration `yaml:"quietPeriod"`
+	Probe       bool          `yaml:"probe"`
+}
+
+func (c recoveryConfig) validate() error {
+	if c.QuietPeriod < 0 {
+		return fmt.Errorf("health.recovery: negative quietPeriod")
+	}
+	if c.Probe && !c.enabled() {
+		return fmt.Errorf("health.recovery: probe requires a quietPeriod")
+	}
+	return nil
+}
+
+func (c recoveryConfig) enabled() bool {
+	return c.QuietPeriod > 0
+}
+
+// deviceHealth is the health state machine of a device.
+type deviceHealth struct {
+	state     healthState
+	reason    string
+	lastEvent time.Time
+}
+
+func newDeviceHealth() *deviceHealth {
+	return &deviceHealth{state: healthStateHealthy}
+}
+
+// event records a health event, the device becomes unhealthy or degraded. A
+// degraded event does not affect devices which are already unhealthy. It
+// returns whether the state changed.
+func (h *deviceHealth) event(now time.Time, reason string, degraded bool) bool {
+	next := healthStateUnhealthy
+	if degraded {
+		if h.state != healthStateHealthy && h.state != healthStateDegraded {
+			return false
+		}
+		next = healthStateDegraded
+	}
+
+	h.lastEvent = now
+	h.reason = reason
+	if h.state == next {
+		return false
+	}
+	h.state = next
+	return true
+}
+
+// healthy returns whether the device is advertised as healthy.
+func (h *deviceHealth) healthy() bool {
+	return h.state == healthStateHealthy || h.state == healthStateDegraded
+}
+
+// quiet returns whether the device is not healthy and no health event was
+// reported for the recovery period, i.e. whether it can recover.
+func (h *deviceHealth) quiet(now time.Time, config recoveryConfig) bool {
+	return h.state != healthStateHealthy && config.enabled() && now.Sub(h.lastEvent) >= config.QuietPeriod
+}
+
+// recover moves an unhealthy or degraded device towards Healthy once it has
+// been quiet for the recovery period. probeErr is the result of the probe of
+// the device, nil when no probe is required, degraded devices are never
+// probed. It returns whether the state changed.
+func (h *deviceHealth) recover(now time.Time, config recoveryConfig, probeErr error) bool {
+	if !h.quiet(now, config) {
+		return false
+	}
+
+	next := healthStateHealthy
+	if h.state != healthStateDegraded && probeErr != nil {
+		next = healthStateRecovering
+	}
+
+	if next == h.state {
+		return false
+	}
+	h.state = next
+	if next == healthStateHealthy {
+		h.reason = ""
+	}
+	return true
+}
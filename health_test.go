@@ -0,0 +1,53 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeviceHealthRecover(t *testing.T) {
+	now := time.Now()
+	config := recoveryConfig{QuietPeriod: time.Minute, Probe: true}
+	failed := errors.New("probe failed")
+
+	tests := []struct {
+		name     string
+		state    healthState
+		quiet    time.Duration // since the last event
+		config   recoveryConfig
+		probeErr error
+		want     healthState
+		changed  bool
+	}{
+		{name: "healthy", state: healthStateHealthy, quiet: time.Hour, config: config, want: healthStateHealthy},
+		{name: "disabled", state: healthStateUnhealthy, quiet: time.Hour, want: healthStateUnhealthy},
+		{name: "quiet period", state: healthStateUnhealthy, quiet: 59 * time.Second, config: config, want: healthStateUnhealthy},
+		{name: "recovered", state: healthStateUnhealthy, quiet: time.Minute, config: config, want: healthStateHealthy, changed: true},
+		{name: "failed probe", state: healthStateUnhealthy, quiet: time.Minute, config: config, probeErr: failed, want: healthStateRecovering, changed: true},
+		{name: "failed probe again", state: healthStateRecovering, quiet: time.Hour, config: config, probeErr: failed, want: healthStateRecovering},
+		{name: "probe passed", state: healthStateRecovering, quiet: time.Hour, config: config, want: healthStateHealthy, changed: true},
+		{name: "degraded", state: healthStateDegraded, quiet: time.Minute, config: config, probeErr: failed, want: healthStateHealthy, changed: true},
+		{name: "degraded quiet period", state: healthStateDegraded, quiet: time.Second, config: config, want: healthStateDegraded},
+	}
+
+	for _, tt := range tests {
+		h := &deviceHealth{state: tt.state, reason: "XID 48", lastEvent: now.Add(-tt.quiet)}
+		if changed := h.recover(now, tt.config, tt.probeErr); changed != tt.changed {
+			t.Errorf("%s: got changed %v, want %v", tt.name, changed, tt.changed)
+		}
+		if h.state != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, h.state, tt.want)
+		}
+		// The reason is cleared once the device is healthy again.
+		wantReason := "XID 48"
+		if tt.changed && tt.want == healthStateHealthy {
+			wantReason = ""
+		}
+		if h.reason != wantReason {
+			t.Errorf("%s: got reason %q, want %q", tt.name, h.reason, wantReason)
+		}
+	}
+}
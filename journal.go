@@ -0,0 +1,370 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	defaultJournalFile       = pluginapi.DevicePluginPath + "nvidia-journal.jsonl"
+	defaultJournalMaxSize    = 10 // MiB
+	defaultJournalMaxFiles   = 5
+	defaultJournalBufferSize = 1000
+)
+
+// Kinds of the journal entries.
+const (
+	// journalXID is an XID reported by a GPU, along with the action of the
+	// XID policy.
+	journalXID = "xid"
+	// journalNVMLEvent is an NVML event other than an XID.
+	journalNVMLEvent = "event"
+	// journalHealth is a health event reported by a health check.
+	journalHealth = "health"
+	// journalTransition is a change of the health state of a device.
+	journalTransition = "transition"
+	// journalFiltered is a device held back by the device selection.
+	journalFiltered = "filtered"
+)
+
+// journalConfig configures the journal of the GPU events.
+type journalConfig struct {
+	Enabled *bool  `yaml:"enabled"`
+	File    string `yaml:"file"`
+	// MaxSize is the size in MiB above which the file is rotated.
+	MaxSize int `yaml:"maxSize"`
+	// MaxFiles is the number of rotated files which are kept.
+	MaxFiles int `yaml:"maxFiles"`
+	// BufferSize is the number of entries kept in memory.
+	BufferSize int `yaml:"bufferSize"`
+}
+
+func (c journalConfig) validate() error {
+	if c.MaxSize < 0 || c.MaxFiles < 0 || c.BufferSize < 0 {
+		return fmt.Errorf("health.journal: negative size")
+	}
+	return nil
+}
+
+func (c journalConfig) enabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+func (c journalConfig) file() string {
+	if c.File == "" {
+		return defaultJournalFile
+	}
+	return c.File
+}
+
+// journalEntry is a line of the journal.
+type journalEntry struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Device string    `json:"device"`
+	XID    uint64    `json:"xid,omitempty"`
+	// Event is the name of an NVML event.
+	Event  string `json:"event,omitempty"`
+	Check  string `json:"check,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Action is the action of the XID policy, or the severity of a health
+	// event.
+	Action string      `json:"action,omitempty"`
+	From   healthState `json:"from,omitempty"`
+	To     healthState `json:"to,omitempty"`
+}
+
+func (e journalEntry) String() string {
+	s := fmt.Sprintf("%s %s %s", e.Time.Format(time.RFC3339), e.Device, e.Kind)
+	switch e.Kind {
+	case journalXID:
+		s += fmt.Sprintf(" %d", e.XID)
+	case journalNVMLEvent:
+		s += " " + e.Event
+	case journalHealth:
+		s += " " + e.Check
+	case journalTransition:
+		s += fmt.Sprintf(" %s -> %s", e.From, e.To)
+	}
+	if e.Action != "" {
+		s += ", action: " + e.Action
+	}
+	if e.Reason != "" {
+		s += " (" + e.Reason + ")"
+	}
+	return s
+}
+
+// journal records the XIDs, the health events, the health transitions and
+// the filtered out devices in a ring buffer and, unless disabled, in a JSON
+// lines file rotated once it reaches its maximum size.
+type journal struct {
+	file     string
+	maxSize  int64
+	maxFiles int
+
+	mu      sync.Mutex
+	entries []journalEntry
+	next    int
+	full    bool
+	f       *os.File
+	size    int64
+}
+
+func newJournal(config journalConfig) *journal {
+	j := &journal{
+		maxSize:  int64(config.MaxSize) << 20,
+		maxFiles: config.MaxFiles,
+	}
+	if j.maxSize == 0 {
+		j.maxSize = defaultJournalMaxSize << 20
+	}
+	if j.maxFiles == 0 {
+		j.maxFiles = defaultJournalMaxFiles
+	}
+
+	size := config.BufferSize
+	if size == 0 {
+		size = defaultJournalBufferSize
+	}
+	j.entries = make([]journalEntry, size)
+
+	if config.enabled() {
+		j.file = config.file()
+	}
+	return j
+}
+
+// record adds an entry to the journal.
+func (j *journal) record(e journalEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.entries[j.next] = e
+	j.next = (j.next + 1) % len(j.entries)
+	if j.next == 0 {
+		j.full = true
+	}
+
+	if j.file == "" {
+		return
+	}
+	if err := j.write(e); err != nil {
+		log.Printf("Warning: could not write the journal %s: %s", j.file, err)
+	}
+}
+
+// write appends an entry to the file, rotating it first if needed, j.mu must
+// be held.
+func (j *journal) write(e journalEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if j.f == nil {
+		if err := j.open(); err != nil {
+			return err
+		}
+	}
+	// An empty file is not rotated, even for an entry above the maximum size.
+	if j.size > 0 && j.size+int64(len(b)) > j.maxSize {
+		j.f.Close()
+		j.f = nil
+		if err := j.rotate(); err != nil {
+			return err
+		}
+		if err := j.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := j.f.Write(b)
+	j.size += int64(n)
+	return err
+}
+
+// open opens the file for appending, j.mu must be held.
+func (j *journal) open() error {
+	f, err := os.OpenFile(j.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	j.f, j.size = f, st.Size()
+	return nil
+}
+
+// rotate renames the file to file.1, file.1 to file.2 and so on, dropping
+// the oldest file.
+func (j *journal) rotate() error {
+	for i := j.maxFiles; i > 0; i-- {
+		src := j.file
+		if i > 1 {
+			src = fmt.Sprintf("%s.%d", j.file, i-1)
+		}
+		err := os.Rename(src, fmt.Sprintf("%s.%d", j.file, i))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// recent returns the entries of the ring buffer, oldest first.
+func (j *journal) recent() []journalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if !j.full {
+		return append([]journalEntry(nil), j.entries[:j.next]...)
+	}
+	return append(append([]journalEntry(nil), j.entries[j.next:]...), j.entries[:j.next]...)
+}
+
+// close closes the file of the journal.
+func (j *journal) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.f != nil {
+		j.f.Close()
+		j.f = nil
+	}
+}
+
+// journalQuery selects journal entries.
+type journalQuery struct {
+	// Device is empty to select all the devices.
+	Device string
+	// Since and Until are zero when the range is open.
+	Since time.Time
+	Until time.Time
+}
+
+func (q journalQuery) match(e journalEntry) bool {
+	if q.Device != "" && e.Device != q.Device {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+// readJournal returns the entries of the journal files matching the query,
+// oldest first. Lines which cannot be parsed are skipped.
+func readJournal(file string, maxFiles int, q journalQuery) ([]journalEntry, error) {
+	var entries []journalEntry
+	for i := maxFiles; i >= 0; i-- {
+		name := file
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", file, i)
+		}
+
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var e journalEntry
+			if json.Unmarshal(scanner.Bytes(), &e) != nil {
+				continue
+			}
+			if q.match(e) {
+				entries = append(entries, e)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %v", name, err)
+		}
+	}
+	return entries, nil
+}
+
+// journalCommand implements the journal subcommand, which prints the entries
+// of the journal file for a device and a time range.
+func journalCommand(config journalConfig, args []string) error {
+	flags := flag.NewFlagSet("journal", flag.ContinueOnError)
+	device := flags.String("device", "", "only print the entries of the device with this UUID")
+	since := flags.String("since", "", "only print the entries since an RFC 3339 time, or a duration ago, e.g. 24h")
+	until := flags.String("until", "", "only print the entries until an RFC 3339 time, or a duration ago")
+	asJSON := flags.Bool("json", false, "print the entries as JSON lines")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	q := journalQuery{Device: *device}
+	var err error
+	if q.Since, err = parseJournalTime(*since, now); err != nil {
+		return fmt.Errorf("invalid -since: %v", err)
+	}
+	if q.Until, err = parseJournalTime(*until, now); err != nil {
+		return fmt.Errorf("invalid -until: %v", err)
+	}
+
+	maxFiles := config.MaxFiles
+	if maxFiles == 0 {
+		maxFiles = defaultJournalMaxFiles
+	}
+	entries, err := readJournal(config.file(), maxFiles, q)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if !*asJSON {
+			fmt.Println(e)
+			continue
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	}
+	return nil
+}
+
+// parseJournalTime parses an RFC 3339 time or a duration before now. The
+// empty string is the zero time.
+func parseJournalTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var journalStart = time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+
+// testJournalEntry returns the i-th entry of a test, all the entries have
+// the same size.
+func testJournalEntry(i int) journalEntry {
+	device := "GPU-a"
+	if i%2 == 0 {
+		device = "GPU-b"
+	}
+	return journalEntry{
+		Time:   journalStart.Add(time.Duration(i) * time.Minute),
+		Kind:   journalXID,
+		Device: device,
+		XID:    79,
+		Reason: fmt.Sprintf("e%d", i),
+		Action: healthActionUnhealthy,
+	}
+}
+
+func journalReasons(entries []journalEntry) []string {
+	reasons := []string{}
+	for _, e := range entries {
+		reasons = append(reasons, e.Reason)
+	}
+	return reasons
+}
+
+func TestJournalRotation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "journal.jsonl")
+	b, err := json.Marshal(testJournalEntry(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := int64(len(b) + 1)
+
+	j := newJournal(journalConfig{File: file, MaxFiles: 2, BufferSize: 3})
+	// Two entries per file.
+	j.maxSize = 2 * line
+	for i := 1; i <= 8; i++ {
+		j.record(testJournalEntry(i))
+	}
+	j.close()
+
+	files := map[string][]string{
+		file:        {"e7", "e8"},
+		file + ".1": {"e5", "e6"},
+		file + ".2": {"e3", "e4"},
+	}
+	for name, want := range files {
+		entries, err := readJournal(name, 0, journalQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := journalReasons(entries); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+	if _, err := os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3: got %v, want the oldest file to be dropped", file, err)
+	}
+
+	if got, want := journalReasons(j.recent()), []string{"e6", "e7", "e8"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got recent entries %v, want %v", got, want)
+	}
+
+	// A full file is rotated by the next plugin.
+	j = newJournal(journalConfig{File: file, MaxFiles: 2})
+	j.maxSize = 2 * line
+	j.record(testJournalEntry(9))
+	j.close()
+
+	entries, err := readJournal(file, 2, journalQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := journalReasons(entries), []string{"e5", "e6", "e7", "e8", "e9"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestJournalDisabled(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "journal.jsonl")
+	j := newJournal(journalConfig{Enabled: new(bool), File: file, BufferSize: 2})
+	for i := 1; i <= 3; i++ {
+		j.record(testJournalEntry(i))
+	}
+	j.close()
+
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("got %v, want no journal file", err)
+	}
+	if got, want := journalReasons(j.recent()), []string{"e2", "e3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got recent entries %v, want %v", got, want)
+	}
+}
+
+func TestReadJournal(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "journal.jsonl")
+	write := func(name string, entries ...int) {
+		var lines []byte
+		for _, i := range entries {
+			b, err := json.Marshal(testJournalEntry(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(append(lines, b...), '\n')
+		}
+		// Lines which cannot be parsed are skipped.
+		lines = append(lines, "{not json\n"...)
+		if err := ioutil.WriteFile(name, lines, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(file+".3", 1, 2)
+	write(file+".1", 3, 4)
+	write(file, 5, 6)
+
+	at := func(i int) time.Time {
+		return journalStart.Add(time.Duration(i) * time.Minute)
+	}
+	tests := []struct {
+		name     string
+		maxFiles int
+		query    journalQuery
+		want     []string
+	}{
+		{name: "all", maxFiles: 3, want: []string{"e1", "e2", "e3", "e4", "e5", "e6"}},
+		{name: "max files", maxFiles: 2, want: []string{"e3", "e4", "e5", "e6"}},
+		{name: "current file", maxFiles: 0, want: []string{"e5", "e6"}},
+		{name: "device", maxFiles: 3, query: journalQuery{Device: "GPU-a"}, want: []string{"e1", "e3", "e5"}},
+		{name: "since", maxFiles: 3, query: journalQuery{Since: at(4)}, want: []string{"e4", "e5", "e6"}},
+		{name: "until", maxFiles: 3, query: journalQuery{Until: at(2)}, want: []string{"e1", "e2"}},
+		{name: "range", maxFiles: 3, query: journalQuery{Device: "GPU-b", Since: at(2), Until: at(5)}, want: []string{"e2", "e4"}},
+		{name: "no match", maxFiles: 3, query: journalQuery{Device: "GPU-c"}, want: []string{}},
+	}
+
+	for _, tt := range tests {
+		entries, err := readJournal(file, tt.maxFiles, tt.query)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := journalReasons(entries); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if entries, err := readJournal(filepath.Join(t.TempDir(), "missing.jsonl"), 3, journalQuery{}); err != nil || len(entries) != 0 {
+		t.Errorf("missing journal: got %v, %v", entries, err)
+	}
+}
+
+func TestParseJournalTime(t *testing.T) {
+	now := time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		s    string
+		want time.Time
+		err  bool
+	}{
+		{s: "", want: time.Time{}},
+		{s: "24h", want: now.Add(-24 * time.Hour)},
+		{s: "90m", want: now.Add(-90 * time.Minute)},
+		{s: "2026-03-01T08:30:00Z", want: time.Date(2026, 3, 1, 8, 30, 0, 0, time.UTC)},
+		{s: "2026-03-01T08:30:00+02:00", want: time.Date(2026, 3, 1, 6, 30, 0, 0, time.UTC)},
+		{s: "yesterday", err: true},
+		{s: "2026-03-01", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseJournalTime(tt.s, now)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: got %s, want an error", tt.s, got)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("%q: got %s, %v, want %s", tt.s, got, err, tt.want)
+		}
+	}
+}
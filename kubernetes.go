@@ -0,0 +1,65 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	envNodeName = "NODE_NAME"
+
+	kubernetesAPITimeout = 10 * time.Second
+)
+
+// kubernetesConfig configures what the plugin reports about the health of
+// the GPUs to the Kubernetes API server.
+type kubernetesConfig struct {
+	// NodeName is the name of the node running the plugin, it defaults to
+	// NODE_NAME.
+	NodeName  string          `yaml:"nodeName"`
+	Events    eventsConfig    `yaml:"events"`
+	Condition conditionConfig `yaml:"condition"`
+	Taint     taintConfig     `yaml:"taint"`
+}
+
+func (c kubernetesConfig) validate() error {
+	if err := c.Events.validate(); err != nil {
+		return err
+	}
+	if err := c.Taint.validate(); err != nil {
+		return err
+	}
+	if c.enabled() && c.nodeName() == "" {
+		return fmt.Errorf("kubernetes: nodeName or %s must be set", envNodeName)
+	}
+	return nil
+}
+
+// enabled returns whether the plugin talks to the API server.
+func (c kubernetesConfig) enabled() bool {
+	return c.Events.Enabled || c.Condition.Enabled || c.Taint.Enabled
+}
+
+func (c kubernetesConfig) nodeName() string {
+	if c.NodeName == "" {
+		return os.Getenv(envNodeName)
+	}
+	return c.NodeName
+}
+
+// newKubernetesClient returns a client of the core API using the in-cluster
+// configuration, i.e. the service account of the pod.
+func newKubernetesClient() (corev1client.CoreV1Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.UserAgent = "nvidia-device-plugin"
+	return corev1client.NewForConfig(config)
+}
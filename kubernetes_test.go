@@ -0,0 +1,25 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/kubernetes/typed/core/v1/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// newFakeClient returns a client of the core API backed by an in-memory
+// tracker holding objects.
+func newFakeClient(objects ...runtime.Object) *fake.FakeCoreV1 {
+	tracker := clienttesting.NewObjectTracker(scheme.Scheme, scheme.Codecs.UniversalDecoder())
+	for _, o := range objects {
+		if err := tracker.Add(o); err != nil {
+			panic(err)
+		}
+	}
+
+	client := &fake.FakeCoreV1{Fake: &clienttesting.Fake{}}
+	client.AddReactor("*", "*", clienttesting.ObjectReaction(tracker))
+	return client
+}
@@ -3,31 +3,104 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
+	"strings"
 	"syscall"
+	"time"
 
-	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
 	"github.com/fsnotify/fsnotify"
-	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
+// stringsFlag is a flag which can be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
 func main() {
-	log.Println("Loading NVML")
-	if err := nvml.Init(); err != nil {
-		log.Printf("Failed to initialize NVML: %s.", err)
+	var checks stringsFlag
+	flag.Var(&checks, "health-check", "set a parameter of a health check, e.g. pcie.enabled=true or nvlink.severity=degraded (repeatable)")
+	resetHealth := flag.Bool("reset-health-state", false, "discard the persisted health of the devices, e.g. after replacing a GPU")
+	flag.Parse()
+
+	config, err := loadConfig(checks)
+	if err != nil {
+		log.Printf("Failed to load configuration: %s.", err)
+		os.Exit(1)
+	}
+
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+	case "journal":
+		if err := journalCommand(config.Health.Journal, flag.Args()[1:]); err != nil {
+			log.Printf("Failed to query the journal: %s.", err)
+			os.Exit(1)
+		}
+		return
+	default:
+		log.Printf("Unknown command %q.", cmd)
+		os.Exit(2)
+	}
+
+	journal := newJournal(config.Health.Journal)
+	defer journal.close()
+
+	backend, err := newDeviceBackend(journal)
+	if err != nil {
+		log.Printf("Failed to create device backend: %s.", err)
+		os.Exit(1)
+	}
+
+	log.Printf("Loading %s backend", backend.Name())
+	if err := backend.Init(); err != nil {
+		log.Printf("Failed to initialize %s backend: %s.", backend.Name(), err)
+		if backend.Name() != nvmlBackendName {
+			select {}
+		}
+
 		log.Printf("If this is a GPU node, did you set the docker default runtime to `nvidia`?")
 		log.Printf("You can check the prerequisites at: https://github.com/NVIDIA/k8s-device-plugin#prerequisites")
 		log.Printf("You can learn how to set the runtime at: https://github.com/NVIDIA/k8s-device-plugin#quick-start")
 
-		select {}
+		log.Println("Falling back to procfs discovery.")
+		backend = newProcfsBackend()
+		if err := backend.Init(); err != nil {
+			log.Printf("Failed to initialize %s backend: %s.", backend.Name(), err)
+			select {}
+		}
 	}
-	defer func() { log.Println("Shutdown of NVML returned:", nvml.Shutdown()) }()
+	defer func() { log.Printf("Shutdown of %s backend returned: %v", backend.Name(), backend.Shutdown()) }()
+
+	backend = newFilteredBackend(backend, config.Devices, journal)
 
+	// The devices are discovered again at the interval of the health check
+	// loop until the backend responds, e.g. once a hung NVML is
+	// re-initialized.
 	log.Println("Fetching devices.")
-	if len(getDevices()) == 0 {
-		log.Println("No devices found. Waiting indefinitely.")
-		select {}
+	devs, err := backend.Devices()
+	for err != nil {
+		interval := discoveryInterval()
+		log.Printf("Could not discover the devices: %s, retrying in %s.", err, interval)
+		time.Sleep(interval)
+		devs, err = backend.Devices()
+	}
+	if len(devs) == 0 {
+		log.Println("No devices found, waiting for devices to be hot-added.")
+	}
+
+	for _, d := range devs {
+		if classifyDevice(config.resourceClasses(), d) == -1 {
+			log.Printf("Device %s does not belong to any resource, it will not be advertised.", d.ID)
+		}
 	}
 
 	log.Println("Starting FS watcher.")
@@ -39,29 +112,82 @@ func main() {
 	defer watcher.Close()
 
 	log.Println("Starting OS watcher.")
-	sigs := newOSWatcher(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	sigs := newOSWatcher(syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	classBackends := newClassBackends(backend, config.resourceClasses())
+	var events *nodeEvents
+	var health *nodeHealth
+	if config.Kubernetes.enabled() {
+		client, err := newKubernetesClient()
+		if err != nil {
+			log.Printf("Failed to create the Kubernetes client: %s.", err)
+			os.Exit(1)
+		}
+
+		stop := make(chan struct{})
+		defer close(stop)
+		if config.Kubernetes.Events.Enabled {
+			events = newNodeEvents(client, config.Kubernetes.nodeName(), config.Kubernetes.Events)
+			go events.run(stop)
+		}
+		if config.Kubernetes.Condition.Enabled || config.Kubernetes.Taint.Enabled {
+			health = newNodeHealth(client, config.Kubernetes.nodeName(), config.Kubernetes.Condition, config.Kubernetes.Taint)
+			go health.run(stop)
+		}
+	}
+	var notifiers *notifiers
+	if len(config.Notifications) > 0 {
+		notifiers, err = newNotifiers(config.Notifications, notificationNode(config.Kubernetes))
+		if err != nil {
+			log.Printf("Failed to create the notification sinks: %s.", err)
+			os.Exit(1)
+		}
+
+		stop := make(chan struct{})
+		defer close(stop)
+		notifiers.run(stop)
+	}
+	node := newNodeState(config.Health, journal, events, health, notifiers)
+	store := loadHealthStore(config.Health.State, devs, *resetHealth, time.Now())
 
 	restart := true
-	var devicePlugin *NvidiaDevicePlugin
+	var devicePlugins []*NvidiaDevicePlugin
+	var retry <-chan time.Time
 
 L:
 	for {
 		if restart {
-			if devicePlugin != nil {
-				devicePlugin.Stop()
+			for _, p := range devicePlugins {
+				p.Stop()
 			}
 
-			devicePlugin = NewNvidiaDevicePlugin()
-			if err := devicePlugin.Serve(); err != nil {
-				log.Println("Could not contact Kubelet, retrying. Did you enable the device plugin feature gate?")
-				log.Printf("You can check the prerequisites at: https://github.com/NVIDIA/k8s-device-plugin#prerequisites")
-				log.Printf("You can learn how to set the runtime at: https://github.com/NVIDIA/k8s-device-plugin#quick-start")
-			} else {
-				restart = false
+			devicePlugins = nil
+			restart = false
+			retry = nil
+			for _, b := range classBackends {
+				p, err := NewNvidiaDevicePlugin(b.class(), config.Health, node, store, b)
+				if err != nil {
+					log.Printf("Could not discover the devices of %s: %s, retrying in %s.", b.class().Name, err, watchRetryDelay)
+					retry = time.After(watchRetryDelay)
+					restart = true
+					break
+				}
+				devicePlugins = append(devicePlugins, p)
+
+				if err := p.Serve(); err != nil {
+					log.Println("Could not contact Kubelet, retrying. Did you enable the device plugin feature gate?")
+					log.Printf("You can check the prerequisites at: https://github.com/NVIDIA/k8s-device-plugin#prerequisites")
+					log.Printf("You can learn how to set the runtime at: https://github.com/NVIDIA/k8s-device-plugin#quick-start")
+					restart = true
+					break
+				}
 			}
 		}
 
 		select {
+		case <-retry:
+			retry = nil
+
 		case event := <-watcher.Events:
 			if event.Name == pluginapi.KubeletSocket && event.Op&fsnotify.Create == fsnotify.Create {
 				log.Printf("inotify: %s created, restarting.", pluginapi.KubeletSocket)
@@ -76,9 +202,16 @@ L:
 			case syscall.SIGHUP:
 				log.Println("Received SIGHUP, restarting.")
 				restart = true
+			case syscall.SIGUSR1:
+				log.Println("Received SIGUSR1, dumping the recent GPU events.")
+				for _, e := range journal.recent() {
+					log.Printf("Journal: %s", e)
+				}
 			default:
 				log.Printf("Received signal \"%v\", shutting down.", s)
-				devicePlugin.Stop()
+				for _, p := range devicePlugins {
+					p.Stop()
+				}
 				break L
 			}
 		}
@@ -0,0 +1,172 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	envGPUMemoryLimit    = "NVIDIA_GPU_MEMORY_LIMIT"
+	envGPUMemoryFraction = "NVIDIA_GPU_MEMORY_FRACTION"
+
+	// minMemoryChunkSize bounds the number of chunks advertised, e.g. 320
+	// for an 80 GiB GPU.
+	minMemoryChunkSize = 256 // MiB
+)
+
+// memoryConfig advertises the memory of the GPUs of a resource in chunks of
+// ChunkSize MiB instead of whole GPUs. The chunks allocated to a container
+// must all belong to the same GPU.
+type memoryConfig struct {
+	ChunkSize uint64 `yaml:"chunkSize"` // MiB
+}
+
+func (c memoryConfig) enabled() bool {
+	return c.ChunkSize > 0
+}
+
+func (c memoryConfig) validate() error {
+	if c.enabled() && c.ChunkSize < minMemoryChunkSize {
+		return fmt.Errorf("memory chunk size must be at least %d MiB", minMemoryChunkSize)
+	}
+	return nil
+}
+
+// chunks returns the number of memory chunks advertised for the device.
+func (c memoryConfig) chunks(d *Device) uint {
+	return uint(d.Memory / c.ChunkSize)
+}
+
+// memoryChunks returns the memory chunks of the given devices, each chunk
+// having the health and NUMA node of its GPU.
+func memoryChunks(devs []*Device, config memoryConfig) []*pluginapi.Device {
+	var res []*pluginapi.Device
+	for _, d := range devs {
+		for i := uint(0); i < config.chunks(d); i++ {
+			res = append(res, &pluginapi.Device{
+				ID:       replicaID(d.ID, i),
+				Health:   d.Health,
+				Topology: d.Device.Topology,
+			})
+		}
+	}
+	return res
+}
+
+// allocateMemory returns the environment of a container allocated the given
+// memory chunks, which must all belong to one GPU.
+func allocateMemory(devs []*Device, config memoryConfig, chunks []string) (map[string]string, error) {
+	var dev *Device
+	for _, c := range chunks {
+		id, i, err := parseReplicaID(c)
+		if err != nil {
+			return nil, err
+		}
+
+		if dev == nil {
+			for _, d := range devs {
+				if d.ID == id {
+					dev = d
+				}
+			}
+			if dev == nil {
+				return nil, fmt.Errorf("unknown device: %s", c)
+			}
+		}
+
+		if id != dev.ID {
+			return nil, fmt.Errorf("memory chunks span several GPUs: %s and %s", dev.ID, id)
+		}
+		if i >= config.chunks(dev) {
+			return nil, fmt.Errorf("unknown device: %s", c)
+		}
+	}
+
+	if dev == nil {
+		return nil, fmt.Errorf("no memory chunk requested")
+	}
+
+	limit := uint64(len(chunks)) * config.ChunkSize
+	return map[string]string{
+		"NVIDIA_VISIBLE_DEVICES": dev.ID,
+		envGPUMemoryLimit:        strconv.FormatUint(limit, 10),
+		envGPUMemoryFraction:     strconv.FormatFloat(float64(limit)/float64(dev.Memory), 'f', 4, 64),
+	}, nil
+}
+
+// preferredMemoryChunks returns size chunks out of available, all on the GPU
+// of the required chunks if any. Otherwise the GPU with the fewest available
+// chunks which can satisfy the request is chosen to keep larger GPUs free.
+// The chunks of a GPU are interchangeable, the required chunks are completed
+// with the first available ones.
+func preferredMemoryChunks(available, required []string, size int) ([]string, error) {
+	if size < len(required) {
+		return nil, fmt.Errorf("allocation size %d is smaller than the %d required chunks", size, len(required))
+	}
+
+	var gpus []string
+	chunks := make(map[string][]string)
+	for _, c := range available {
+		id, _, err := parseReplicaID(c)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := chunks[id]; !ok {
+			gpus = append(gpus, id)
+		}
+		chunks[id] = append(chunks[id], c)
+	}
+
+	gpu := ""
+	for _, c := range required {
+		id, _, err := parseReplicaID(c)
+		if err != nil {
+			return nil, err
+		}
+		if gpu != "" && id != gpu {
+			return nil, fmt.Errorf("memory chunks span several GPUs: %s and %s", gpu, id)
+		}
+		gpu = id
+	}
+
+	if gpu == "" {
+		for _, id := range gpus {
+			if len(chunks[id]) >= size && (gpu == "" || len(chunks[id]) < len(chunks[gpu])) {
+				gpu = id
+			}
+		}
+		if gpu == "" {
+			return nil, fmt.Errorf("no GPU has %d memory chunks available", size)
+		}
+	}
+
+	isAvailable := make(map[string]bool)
+	for _, c := range chunks[gpu] {
+		isAvailable[c] = true
+	}
+	isRequired := make(map[string]bool)
+	for _, c := range required {
+		if !isAvailable[c] {
+			return nil, fmt.Errorf("required chunk %s is not available", c)
+		}
+		isRequired[c] = true
+	}
+
+	ids := append([]string{}, required...)
+	for _, c := range chunks[gpu] {
+		if len(ids) == size {
+			break
+		}
+		if !isRequired[c] {
+			ids = append(ids, c)
+		}
+	}
+	if len(ids) < size {
+		return nil, fmt.Errorf("GPU %s only has %d memory chunks available", gpu, len(chunks[gpu]))
+	}
+	return sortLike(ids, available), nil
+}
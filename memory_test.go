@@ -0,0 +1,174 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestMemoryChunks(t *testing.T) {
+	a := testDevice("GPU-a", 0, pluginapi.Healthy)
+	a.Memory = 16160
+	a.Device.Topology = numaTopology(1)
+	b := testDevice("GPU-b", 1, pluginapi.Unhealthy)
+	b.Memory = 1024
+
+	tests := []struct {
+		chunkSize uint64
+		devs      []*Device
+		want      int // number of chunks
+		lastID    string
+	}{
+		{chunkSize: 1024, devs: []*Device{a, b}, want: 16, lastID: "GPU-b::0"},
+		// The memory which does not fill a chunk is not advertised.
+		{chunkSize: 4096, devs: []*Device{a}, want: 3, lastID: "GPU-a::2"},
+		{chunkSize: 16160, devs: []*Device{a}, want: 1, lastID: "GPU-a::0"},
+		{chunkSize: 16384, devs: []*Device{a, b}, want: 0},
+		{chunkSize: 256, devs: []*Device{b}, want: 4, lastID: "GPU-b::3"},
+	}
+
+	for _, tt := range tests {
+		chunks := memoryChunks(tt.devs, memoryConfig{ChunkSize: tt.chunkSize})
+		if len(chunks) != tt.want {
+			t.Errorf("chunk size %d: got %d chunks, want %d", tt.chunkSize, len(chunks), tt.want)
+			continue
+		}
+		if tt.want == 0 {
+			continue
+		}
+		if last := chunks[len(chunks)-1]; last.ID != tt.lastID {
+			t.Errorf("chunk size %d: got last chunk %s, want %s", tt.chunkSize, last.ID, tt.lastID)
+		}
+		for _, c := range chunks {
+			id, _, _ := parseReplicaID(c.ID)
+			d := findDevice(tt.devs, id)
+			if d == nil || c.Health != d.Health || !reflect.DeepEqual(c.Topology, d.Device.Topology) {
+				t.Errorf("chunk size %d: got chunk %+v, want the health and topology of its GPU", tt.chunkSize, c)
+			}
+		}
+	}
+}
+
+func TestAllocateMemory(t *testing.T) {
+	a := testDevice("GPU-a", 0, pluginapi.Healthy)
+	a.Memory = 16160
+	b := testDevice("GPU-b", 1, pluginapi.Healthy)
+	b.Memory = 40960
+	devs := []*Device{a, b}
+	config := memoryConfig{ChunkSize: 4096}
+
+	tests := []struct {
+		name   string
+		chunks []string
+		want   map[string]string
+		err    bool
+	}{
+		{
+			name:   "one chunk",
+			chunks: []string{"GPU-a::0"},
+			want:   map[string]string{"NVIDIA_VISIBLE_DEVICES": "GPU-a", envGPUMemoryLimit: "4096", envGPUMemoryFraction: "0.2535"},
+		},
+		{
+			name:   "all the chunks",
+			chunks: []string{"GPU-a::2", "GPU-a::0", "GPU-a::1"},
+			want:   map[string]string{"NVIDIA_VISIBLE_DEVICES": "GPU-a", envGPUMemoryLimit: "12288", envGPUMemoryFraction: "0.7604"},
+		},
+		{
+			name:   "whole GPU",
+			chunks: []string{"GPU-b::0", "GPU-b::1", "GPU-b::2", "GPU-b::3", "GPU-b::4", "GPU-b::5", "GPU-b::6", "GPU-b::7", "GPU-b::8", "GPU-b::9"},
+			want:   map[string]string{"NVIDIA_VISIBLE_DEVICES": "GPU-b", envGPUMemoryLimit: "40960", envGPUMemoryFraction: "1.0000"},
+		},
+		// GPU-a only has 3 whole chunks.
+		{name: "over-subscribed", chunks: []string{"GPU-a::0", "GPU-a::3"}, err: true},
+		{name: "several GPUs", chunks: []string{"GPU-a::0", "GPU-b::0"}, err: true},
+		{name: "unknown GPU", chunks: []string{"GPU-c::0"}, err: true},
+		{name: "not a chunk", chunks: []string{"GPU-a"}, err: true},
+		{name: "no chunks", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := allocateMemory(devs, config, tt.chunks)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPreferredMemoryChunks(t *testing.T) {
+	available := []string{"GPU-a::0", "GPU-a::1", "GPU-a::2", "GPU-b::0", "GPU-b::1", "GPU-a::3"}
+
+	tests := []struct {
+		name      string
+		available []string
+		required  []string
+		size      int
+		want      []string
+		err       bool
+	}{
+		{name: "fewest chunks", available: available, size: 2, want: []string{"GPU-b::0", "GPU-b::1"}},
+		{name: "only GPU large enough", available: available, size: 3, want: []string{"GPU-a::0", "GPU-a::1", "GPU-a::2"}},
+		{name: "required chunks first", available: available, required: []string{"GPU-a::3"}, size: 2, want: []string{"GPU-a::0", "GPU-a::3"}},
+		{name: "required chunks only", available: available, required: []string{"GPU-b::1"}, size: 1, want: []string{"GPU-b::1"}},
+		{name: "too large", available: available, size: 5, err: true},
+		{name: "too large for the required GPU", available: available, required: []string{"GPU-b::0"}, size: 3, err: true},
+		{name: "required chunks span GPUs", available: available, required: []string{"GPU-a::0", "GPU-b::0"}, size: 2, err: true},
+		{name: "required chunk unavailable", available: available, required: []string{"GPU-a::9"}, size: 2, err: true},
+		{name: "smaller than required", available: available, required: []string{"GPU-a::0", "GPU-a::1"}, size: 1, err: true},
+		{name: "not a chunk", available: []string{"GPU-a"}, size: 1, err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := preferredMemoryChunks(tt.available, tt.required, tt.size)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPreferredMemoryChunksLargeGPU(t *testing.T) {
+	// 80 GiB in chunks of the minimum size.
+	var available []string
+	for i := uint(0); i < 320; i++ {
+		available = append(available, replicaID("GPU-a", i))
+	}
+
+	got, err := preferredMemoryChunks(available, nil, 200)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(got, available[:200]) {
+		t.Errorf("got %v, want the first 200 chunks", got)
+	}
+}
+
+func TestMemoryConfigValidate(t *testing.T) {
+	for size, valid := range map[uint64]bool{0: true, 1: false, minMemoryChunkSize - 1: false, minMemoryChunkSize: true, 4096: true} {
+		err := memoryConfig{ChunkSize: size}.validate()
+		if valid != (err == nil) {
+			t.Errorf("chunk size %d: got error %v", size, err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nodeState is the state of the node shared by the device plugins of all the
+// resources.
+type nodeState struct {
+	// rebootFile is created when the node requires a reboot, e.g.
+	// /var/run/reboot-required to let kured reboot it.
+	rebootFile string
+	journal    *journal
+	// events is nil unless the Events are published on the Node.
+	events *nodeEvents
+	// health is nil unless the condition or the taint of the Node is
+	// maintained.
+	health *nodeHealth
+	// notifiers is nil unless notification sinks are configured.
+	notifiers *notifiers
+
+	mu sync.Mutex
+	// reboot maps the devices which require a reboot to the reason.
+	reboot map[string]string
+	// gpus maps the devices of all the resources to the reason they are
+	// advertised unhealthy, or to "" if they are healthy.
+	gpus map[string]string
+}
+
+// healthTransition is a change of the health state of a device.
+type healthTransition struct {
+	Device string
+	From   healthState
+	To     healthState
+	Reason string
+	// XID is the XID which caused the transition, if any.
+	XID uint64
+	// Restored is set when the state was restored after a restart.
+	Restored bool
+	// RebootRequired is set when the device requires a reboot of the node
+	// rather than changing state, From and To are then its current state.
+	RebootRequired bool
+}
+
+func newNodeState(config healthConfig, journal *journal, events *nodeEvents, health *nodeHealth, notifiers *notifiers) *nodeState {
+	return &nodeState{
+		rebootFile: config.RebootRequiredFile,
+		journal:    journal,
+		events:     events,
+		health:     health,
+		notifiers:  notifiers,
+		reboot:     make(map[string]string),
+		gpus:       make(map[string]string),
+	}
+}
+
+// healthEvent records a health event of a device.
+func (n *nodeState) healthEvent(e healthEvent) {
+	action := healthActionUnhealthy
+	if e.Degraded {
+		action = healthActionDegraded
+	}
+	n.journal.record(journalEntry{Kind: journalHealth, Device: e.Device.ID, XID: e.XID, Check: e.Check, Reason: e.Reason, Action: action})
+}
+
+// transition records a change of the health state of a device and publishes
+// it. Restored states were already published before the restart.
+func (n *nodeState) transition(t healthTransition) {
+	reason := t.Reason
+	if t.Restored {
+		reason = "restored: " + reason
+	}
+	n.journal.record(journalEntry{Kind: journalTransition, Device: t.Device, XID: t.XID, From: t.From, To: t.To, Reason: reason})
+
+	if t.Restored {
+		return
+	}
+	n.publish(t)
+}
+
+// publish sends a transition to the Events and the notification sinks.
+func (n *nodeState) publish(t healthTransition) {
+	now := time.Now()
+	if n.events != nil {
+		n.events.transition(t, now)
+	}
+	if n.notifiers != nil {
+		n.notifiers.transition(t, now)
+	}
+}
+
+// report records the health advertised for devices, mapping them to the
+// reason they are unhealthy or to "", and updates the Node.
+func (n *nodeState) report(gpus map[string]string) {
+	if n.health == nil {
+		return
+	}
+
+	n.mu.Lock()
+	s := healthSummary{unhealthy: make(map[string]string), reboot: make(map[string]string)}
+	for id, reason := range gpus {
+		n.gpus[id] = reason
+	}
+	for id, reason := range n.gpus {
+		if reason != "" {
+			s.unhealthy[id] = reason
+		}
+	}
+	for id, reason := range n.reboot {
+		s.reboot[id] = reason
+	}
+	s.total = len(n.gpus)
+	n.mu.Unlock()
+
+	n.health.update(s)
+}
+
+// requireReboot records that the node requires a reboot for a device and
+// reports it on the Node, as an Event and to the notification sinks, unless
+// it was restored. The requirement is persisted with the health of the
+// device until the node reboots.
+func (n *nodeState) requireReboot(t healthTransition) {
+	t.RebootRequired = true
+	if !n.recordReboot(t.Device, t.Reason) {
+		return
+	}
+
+	if !t.Restored {
+		n.publish(t)
+	}
+	n.report(nil)
+}
+
+// recordReboot returns whether the reboot requirement of a device is new and
+// writes the reboot file.
+func (n *nodeState) recordReboot(id, reason string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.reboot[id]; ok {
+		return false
+	}
+	n.reboot[id] = reason
+	log.Printf("Node requires a reboot: %s: %s.", id, reason)
+
+	if n.rebootFile == "" {
+		return true
+	}
+	if err := ioutil.WriteFile(n.rebootFile, []byte(n.rebootReasons()), 0644); err != nil {
+		log.Printf("Warning: could not write %s: %s", n.rebootFile, err)
+	}
+	return true
+}
+
+// rebootReasons lists why the node requires a reboot, one device per line,
+// n.mu must be held.
+func (n *nodeState) rebootReasons() string {
+	var lines []string
+	for id, reason := range n.reboot {
+		lines = append(lines, fmt.Sprintf("%s: %s\n", id, reason))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRequireReboot(t *testing.T) {
+	dir := t.TempDir()
+	events := newNodeEvents(nil, "node1", eventsConfig{})
+	notifiers, err := newNotifiers(nil, "node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &notifier{queue: make(chan notification, 10)}
+	notifiers.notifiers = append(notifiers.notifiers, sink)
+
+	rebootFile := filepath.Join(dir, "reboot-required")
+	j := newJournal(journalConfig{Enabled: new(bool)})
+	node := newNodeState(healthConfig{RebootRequiredFile: rebootFile}, j, events, nil, notifiers)
+
+	restored := healthTransition{Device: "GPU-a", From: healthStateUnhealthy, To: healthStateUnhealthy, Reason: "pages pending retirement", Restored: true}
+	node.requireReboot(restored)
+	if len(events.queue) != 0 || len(sink.queue) != 0 {
+		t.Errorf("restored reboot requirement was published")
+	}
+
+	required := healthTransition{Device: "GPU-b", From: healthStateUnhealthy, To: healthStateUnhealthy, Reason: "pages pending retirement", XID: 63}
+	node.requireReboot(required)
+	node.requireReboot(required)
+
+	if n := len(events.queue); n != 1 {
+		t.Fatalf("got %d Events, want 1", n)
+	}
+	if e := <-events.queue; e.Reason != eventReasonRebootRequired || e.Message != "GPU GPU-b requires a reboot of the node: pages pending retirement" {
+		t.Errorf("got Event %s: %q", e.Reason, e.Message)
+	}
+
+	if n := len(sink.queue); n != 1 {
+		t.Fatalf("got %d notifications, want 1", n)
+	}
+	notif := <-sink.queue
+	if !notif.RebootRequired || notif.Device != "GPU-b" || notif.XID != 63 {
+		t.Errorf("got notification %+v", notif)
+	}
+	tmpl, _ := sinkConfig{}.template()
+	text, err := render(tmpl, notif)
+	if want := "node1: GPU GPU-b requires a reboot of the node (pages pending retirement)"; err != nil || text != want {
+		t.Errorf("got %q (%v), want %q", text, err, want)
+	}
+
+	b, err := ioutil.ReadFile(rebootFile)
+	if want := "GPU-a: pages pending retirement\nGPU-b: pages pending retirement\n"; err != nil || string(b) != want {
+		t.Errorf("got %s %q (%v), want %q", rebootFile, b, err, want)
+	}
+}
+
+func TestHealthSummaryMessage(t *testing.T) {
+	tests := []struct {
+		summary healthSummary
+		want    string
+	}{
+		{
+			summary: healthSummary{total: 2},
+			want:    "All the 2 GPUs are healthy",
+		},
+		{
+			summary: healthSummary{total: 2, unhealthy: map[string]string{"GPU-b": "XID 79", "GPU-a": "XID 48"}},
+			want:    "2 of 2 GPUs are unhealthy: GPU-a (XID 48), GPU-b (XID 79)",
+		},
+		{
+			summary: healthSummary{total: 2, unhealthy: map[string]string{"GPU-a": "XID 63"}, reboot: map[string]string{"GPU-a": "pages pending retirement"}},
+			want:    "1 of 2 GPUs are unhealthy: GPU-a (XID 63); the node requires a reboot: GPU-a (pages pending retirement)",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.summary.message(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
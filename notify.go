@@ -0,0 +1,419 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/syslog"
+	"net/http"
+	"os"
+	"text/template"
+	"time"
+)
+
+// Types of notification sinks.
+const (
+	sinkWebhook = "webhook"
+	sinkSyslog  = "syslog"
+	sinkFile    = "file"
+)
+
+// Formats of the webhook requests.
+const (
+	webhookJSON  = "json"
+	webhookSlack = "slack"
+)
+
+const (
+	defaultSinkQueueSize = 100
+	defaultSinkRetries   = 5
+	defaultSinkTimeout   = 10 * time.Second
+	defaultSyslogTag     = "nvidia-device-plugin"
+
+	sinkRetryDelay    = time.Second
+	sinkMaxRetryDelay = time.Minute
+
+	defaultNotificationTemplate = `{{.Node}}: GPU {{.Device}} {{if .RebootRequired}}requires a reboot of the node{{else}}{{.From}} -> {{.To}}{{end}}{{if .Reason}} ({{.Reason}}){{end}}`
+)
+
+// sinkConfig configures a sink the health transitions of the GPUs are sent to.
+type sinkConfig struct {
+	// Type is webhook, syslog or file.
+	Type string `yaml:"type"`
+
+	// URL receives a POST request per transition, with the transition as
+	// JSON or, with the slack Format, a Slack message.
+	URL    string `yaml:"url"`
+	Format string `yaml:"format"`
+	// Template is the text/template of the Slack and syslog messages.
+	Template string `yaml:"template"`
+
+	// Network and Address of the syslog server, the local syslog by
+	// default.
+	Network string `yaml:"network"`
+	Address string `yaml:"address"`
+	Tag     string `yaml:"tag"`
+
+	// Path of the file the transitions are appended to, as JSON lines.
+	Path string `yaml:"path"`
+
+	// Timeout of a webhook request.
+	Timeout time.Duration `yaml:"timeout"`
+	// QueueSize bounds the transitions waiting to be delivered, the
+	// transitions above are dropped.
+	QueueSize int `yaml:"queueSize"`
+	// Retries is the number of times a failed delivery is retried.
+	Retries *int `yaml:"retries"`
+}
+
+func validateSinks(sinks []sinkConfig) error {
+	for i, s := range sinks {
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("notifications[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (c sinkConfig) validate() error {
+	switch c.Type {
+	case sinkWebhook:
+		if c.URL == "" {
+			return fmt.Errorf("webhook requires a url")
+		}
+		if c.Format != "" && c.Format != webhookJSON && c.Format != webhookSlack {
+			return fmt.Errorf("invalid format %q, expected %s or %s", c.Format, webhookJSON, webhookSlack)
+		}
+	case sinkSyslog:
+		switch c.Network {
+		case "", "udp", "tcp", "unix", "unixgram":
+		default:
+			return fmt.Errorf("invalid syslog network %q", c.Network)
+		}
+		if (c.Network == "") != (c.Address == "") {
+			return fmt.Errorf("syslog network and address must be set together")
+		}
+	case sinkFile:
+		if c.Path == "" {
+			return fmt.Errorf("file requires a path")
+		}
+	default:
+		return fmt.Errorf("invalid type %q, expected %s, %s or %s", c.Type, sinkWebhook, sinkSyslog, sinkFile)
+	}
+
+	if c.Timeout < 0 || c.QueueSize < 0 || (c.Retries != nil && *c.Retries < 0) {
+		return fmt.Errorf("negative value")
+	}
+	if _, err := c.template(); err != nil {
+		return fmt.Errorf("invalid template: %v", err)
+	}
+	return nil
+}
+
+func (c sinkConfig) template() (*template.Template, error) {
+	text := c.Template
+	if text == "" {
+		text = defaultNotificationTemplate
+	}
+	return template.New("notification").Parse(text)
+}
+
+// notification is a health transition of a GPU as delivered to the sinks.
+type notification struct {
+	Time   time.Time   `json:"time"`
+	Node   string      `json:"node"`
+	Device string      `json:"device"`
+	From   healthState `json:"from"`
+	To     healthState `json:"to"`
+	Reason string      `json:"reason,omitempty"`
+	XID    uint64      `json:"xid,omitempty"`
+	// RebootRequired is set when the GPU requires a reboot of the node
+	// rather than changing state.
+	RebootRequired bool `json:"rebootRequired,omitempty"`
+}
+
+// notificationSink delivers notifications to an external system.
+type notificationSink interface {
+	send(n notification) error
+	String() string
+}
+
+// notifier delivers the notifications to a sink in the background, retrying
+// the failed deliveries with an exponential backoff. The notifications which
+// do not fit in its queue are dropped so that a slow sink never blocks the
+// health checks.
+type notifier struct {
+	sink    notificationSink
+	retries int
+	queue   chan notification
+	// retryDelay is the delay before the first retry, it doubles with
+	// every retry up to maxRetryDelay.
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration
+}
+
+func newNotifier(config sinkConfig) (*notifier, error) {
+	tmpl, err := config.template()
+	if err != nil {
+		return nil, err
+	}
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = defaultSinkTimeout
+	}
+
+	var sink notificationSink
+	switch config.Type {
+	case sinkWebhook:
+		sink = &webhookSink{
+			url:      config.URL,
+			slack:    config.Format == webhookSlack,
+			template: tmpl,
+			client:   &http.Client{Timeout: timeout},
+		}
+	case sinkSyslog:
+		tag := config.Tag
+		if tag == "" {
+			tag = defaultSyslogTag
+		}
+		sink = &syslogSink{network: config.Network, address: config.Address, tag: tag, template: tmpl}
+	case sinkFile:
+		sink = &fileSink{path: config.Path}
+	}
+
+	size := config.QueueSize
+	if size == 0 {
+		size = defaultSinkQueueSize
+	}
+	retries := defaultSinkRetries
+	if config.Retries != nil {
+		retries = *config.Retries
+	}
+	return &notifier{
+		sink:          sink,
+		retries:       retries,
+		queue:         make(chan notification, size),
+		retryDelay:    sinkRetryDelay,
+		maxRetryDelay: sinkMaxRetryDelay,
+	}, nil
+}
+
+// notify queues a notification, it never blocks.
+func (n *notifier) notify(notif notification) {
+	select {
+	case n.queue <- notif:
+	default:
+		log.Printf("Warning: dropping the notification of %s to %s, too many notifications are pending.", notif.Device, n.sink)
+	}
+}
+
+// run delivers the queued notifications until stop is closed.
+func (n *notifier) run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case notif := <-n.queue:
+			n.deliver(notif, stop)
+		}
+	}
+}
+
+// deliver sends a notification, retrying on failures.
+func (n *notifier) deliver(notif notification, stop <-chan struct{}) {
+	delay := n.retryDelay
+	for i := 0; ; i++ {
+		err := n.sink.send(notif)
+		if err == nil {
+			return
+		}
+		if i == n.retries {
+			log.Printf("Warning: could not notify %s of %s: %s, giving up.", n.sink, notif.Device, err)
+			return
+		}
+		log.Printf("Warning: could not notify %s of %s: %s, retrying in %s.", n.sink, notif.Device, err, delay)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > n.maxRetryDelay {
+			delay = n.maxRetryDelay
+		}
+	}
+}
+
+// webhookSink POSTs the notifications to a URL.
+type webhookSink struct {
+	url      string
+	slack    bool
+	template *template.Template
+	client   *http.Client
+}
+
+func (s *webhookSink) String() string {
+	return "webhook " + s.url
+}
+
+func (s *webhookSink) send(n notification) error {
+	var body interface{} = n
+	if s.slack {
+		text, err := render(s.template, n)
+		if err != nil {
+			return err
+		}
+		body = map[string]string{"text": text}
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// syslogSink logs the notifications to syslog, as warnings unless the GPU
+// recovered.
+type syslogSink struct {
+	network  string
+	address  string
+	tag      string
+	template *template.Template
+
+	// w is nil until connected.
+	w *syslog.Writer
+}
+
+func (s *syslogSink) String() string {
+	if s.network == "" {
+		return "syslog"
+	}
+	return fmt.Sprintf("syslog %s://%s", s.network, s.address)
+}
+
+func (s *syslogSink) send(n notification) error {
+	text, err := render(s.template, n)
+	if err != nil {
+		return err
+	}
+
+	if s.w == nil {
+		s.w, err = syslog.Dial(s.network, s.address, syslog.LOG_WARNING|syslog.LOG_DAEMON, s.tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	if n.To == healthStateHealthy {
+		err = s.w.Info(text)
+	} else {
+		err = s.w.Warning(text)
+	}
+	if err != nil {
+		s.w.Close()
+		s.w = nil
+	}
+	return err
+}
+
+// fileSink appends the notifications to a file as JSON lines.
+type fileSink struct {
+	path string
+}
+
+func (s *fileSink) String() string {
+	return "file " + s.path
+}
+
+func (s *fileSink) send(n notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func render(tmpl *template.Template, n notification) (string, error) {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, n); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// notifiers delivers the notifications to all the configured sinks.
+type notifiers struct {
+	node      string
+	notifiers []*notifier
+}
+
+// newNotifiers returns the notifiers of the sinks, e.g. of a file or of a
+// webhook served by an httptest server in tests.
+func newNotifiers(sinks []sinkConfig, node string) (*notifiers, error) {
+	ns := &notifiers{node: node}
+	for _, c := range sinks {
+		n, err := newNotifier(c)
+		if err != nil {
+			return nil, err
+		}
+		ns.notifiers = append(ns.notifiers, n)
+	}
+	return ns, nil
+}
+
+// transition notifies the sinks of a health transition.
+func (ns *notifiers) transition(t healthTransition, now time.Time) {
+	notif := notification{
+		Time:   now,
+		Node:   ns.node,
+		Device: t.Device,
+		From:   t.From,
+		To:     t.To,
+		Reason: t.Reason,
+		XID:    t.XID,
+
+		RebootRequired: t.RebootRequired,
+	}
+	for _, n := range ns.notifiers {
+		n.notify(notif)
+	}
+}
+
+// run delivers the notifications until stop is closed.
+func (ns *notifiers) run(stop <-chan struct{}) {
+	for _, n := range ns.notifiers {
+		go n.run(stop)
+	}
+}
+
+// notificationNode returns the name of the node in the notifications, the
+// name of the Node or else the hostname.
+func notificationNode(config kubernetesConfig) string {
+	if name := config.nodeName(); name != "" {
+		return name
+	}
+	name, _ := os.Hostname()
+	return name
+}
@@ -0,0 +1,301 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhook records the requests it receives, answering with the listed
+// statuses and then with 200.
+type webhook struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	bodies   [][]byte
+	times    []time.Time
+}
+
+func newWebhook(statuses ...int) *webhook {
+	w := &webhook{statuses: statuses}
+	w.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			body = nil
+		}
+		w.bodies = append(w.bodies, body)
+		w.times = append(w.times, time.Now())
+
+		status := http.StatusOK
+		if len(w.statuses) > 0 {
+			status, w.statuses = w.statuses[0], w.statuses[1:]
+		}
+		rw.WriteHeader(status)
+	}))
+	return w
+}
+
+// wait waits for n requests and returns their bodies and times.
+func (w *webhook) wait(t *testing.T, n int) ([][]byte, []time.Time) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w.mu.Lock()
+		bodies, times := append([][]byte(nil), w.bodies...), append([]time.Time(nil), w.times...)
+		w.mu.Unlock()
+		if len(bodies) >= n || time.Now().After(deadline) {
+			return bodies, times
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+var testNotification = notification{
+	Time:   time.Date(2026, 3, 2, 10, 14, 7, 0, time.UTC),
+	Node:   "node1",
+	Device: "GPU-a",
+	From:   healthStateHealthy,
+	To:     healthStateUnhealthy,
+	Reason: "XID 79",
+	XID:    79,
+}
+
+func TestWebhookSink(t *testing.T) {
+	tests := []struct {
+		name   string
+		config sinkConfig
+		want   string
+	}{
+		{
+			name:   "json",
+			config: sinkConfig{Type: sinkWebhook},
+			want:   `{"time":"2026-03-02T10:14:07Z","node":"node1","device":"GPU-a","from":"Healthy","to":"Unhealthy","reason":"XID 79","xid":79}`,
+		},
+		{
+			name:   "slack",
+			config: sinkConfig{Type: sinkWebhook, Format: webhookSlack},
+			want:   `{"text":"node1: GPU GPU-a Healthy -> Unhealthy (XID 79)"}`,
+		},
+		{
+			name:   "slack template",
+			config: sinkConfig{Type: sinkWebhook, Format: webhookSlack, Template: `:warning: {{.Device}} on {{.Node}} is {{.To}}`},
+			want:   `{"text":":warning: GPU-a on node1 is Unhealthy"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		w := newWebhook()
+		tt.config.URL = w.URL
+		n, err := newNotifier(tt.config)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := n.sink.send(testNotification); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		w.Close()
+
+		if len(w.bodies) != 1 {
+			t.Errorf("%s: got %d requests, want 1", tt.name, len(w.bodies))
+			continue
+		}
+		var got, want interface{}
+		if err := json.Unmarshal(w.bodies[0], &got); err != nil {
+			t.Errorf("%s: invalid body %s: %v", tt.name, w.bodies[0], err)
+		}
+		json.Unmarshal([]byte(tt.want), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %s, want %s", tt.name, w.bodies[0], tt.want)
+		}
+	}
+}
+
+func TestWebhookSinkStatus(t *testing.T) {
+	w := newWebhook(http.StatusInternalServerError, http.StatusNoContent)
+	defer w.Close()
+
+	n, err := newNotifier(sinkConfig{Type: sinkWebhook, URL: w.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.sink.send(testNotification); err == nil {
+		t.Errorf("got no error for status 500")
+	}
+	if err := n.sink.send(testNotification); err != nil {
+		t.Errorf("got %v for status 204", err)
+	}
+}
+
+func TestNotifierRetry(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	failed := http.StatusServiceUnavailable
+
+	tests := []struct {
+		name     string
+		retries  int
+		statuses []int
+		requests int
+		// intervals are the minimum delays between the requests.
+		intervals []time.Duration
+	}{
+		{name: "delivered", retries: 3, requests: 1},
+		{name: "backoff", retries: 3, statuses: []int{failed, failed, failed}, requests: 4, intervals: []time.Duration{delay, 2 * delay, 3 * delay}},
+		{name: "gave up", retries: 1, statuses: []int{failed, failed, failed}, requests: 2, intervals: []time.Duration{delay}},
+	}
+
+	for _, tt := range tests {
+		w := newWebhook(tt.statuses...)
+		n, err := newNotifier(sinkConfig{Type: sinkWebhook, URL: w.URL, Retries: &tt.retries})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.retryDelay, n.maxRetryDelay = delay, 3*delay
+
+		stop := make(chan struct{})
+		go n.run(stop)
+		n.notify(testNotification)
+		bodies, times := w.wait(t, tt.requests)
+		// No request after giving up.
+		time.Sleep(10 * delay)
+		close(stop)
+		w.Close()
+
+		if len(w.bodies) != tt.requests {
+			t.Errorf("%s: got %d requests, want %d", tt.name, len(w.bodies), tt.requests)
+			continue
+		}
+		for i := 1; i < len(bodies); i++ {
+			if string(bodies[i]) != string(bodies[0]) {
+				t.Errorf("%s: retried %s, want %s", tt.name, bodies[i], bodies[0])
+			}
+			if d := times[i].Sub(times[i-1]); d < tt.intervals[i-1] {
+				t.Errorf("%s: retry %d after %s, want at least %s", tt.name, i, d, tt.intervals[i-1])
+			}
+		}
+	}
+}
+
+// blockingSink blocks the deliveries until it is released.
+type blockingSink struct {
+	release chan struct{}
+
+	mu   sync.Mutex
+	sent []notification
+}
+
+func (s *blockingSink) String() string { return "blocking" }
+
+func (s *blockingSink) send(n notification) error {
+	<-s.release
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, n)
+	return nil
+}
+
+func TestNotifierQueueOverflow(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{})}
+	n := &notifier{sink: sink, queue: make(chan notification, 2), retryDelay: time.Millisecond, maxRetryDelay: time.Millisecond}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go n.run(stop)
+
+	// The first notification is being delivered, the next 2 are queued and
+	// the others dropped.
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		notif := testNotification
+		notif.XID = uint64(i)
+		n.notify(notif)
+		if i == 0 {
+			for len(n.queue) != 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("notify blocked for %s", d)
+	}
+
+	close(sink.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sink.mu.Lock()
+		var xids []uint64
+		for _, notif := range sink.sent {
+			xids = append(xids, notif.XID)
+		}
+		sink.mu.Unlock()
+
+		if len(xids) >= 3 || time.Now().After(deadline) {
+			// Give a dropped notification the time to show up.
+			time.Sleep(50 * time.Millisecond)
+			sink.mu.Lock()
+			sent := len(sink.sent)
+			sink.mu.Unlock()
+			if want := []uint64{0, 1, 2}; !reflect.DeepEqual(xids, want) || sent != 3 {
+				t.Errorf("got %v delivered, want %v", xids, want)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "health.jsonl")
+	ns, err := newNotifiers([]sinkConfig{{Type: sinkFile, Path: path}}, "node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	ns.run(stop)
+
+	now := time.Date(2026, 3, 2, 10, 14, 7, 0, time.UTC)
+	ns.transition(healthTransition{Device: "GPU-a", From: healthStateHealthy, To: healthStateUnhealthy, Reason: "XID 79", XID: 79}, now)
+	ns.transition(healthTransition{Device: "GPU-a", From: healthStateUnhealthy, To: healthStateHealthy}, now.Add(time.Minute))
+
+	want := []string{
+		`{"time":"2026-03-02T10:14:07Z","node":"node1","device":"GPU-a","from":"Healthy","to":"Unhealthy","reason":"XID 79","xid":79}`,
+		`{"time":"2026-03-02T10:15:07Z","node":"node1","device":"GPU-a","from":"Unhealthy","to":"Healthy"}`,
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var lines []string
+		if f, err := os.Open(path); err == nil {
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				var notif notification
+				if err := json.Unmarshal(scanner.Bytes(), &notif); err != nil {
+					t.Errorf("invalid line %s: %v", scanner.Text(), err)
+				}
+				lines = append(lines, scanner.Text())
+			}
+			f.Close()
+		}
+
+		if len(lines) >= len(want) || time.Now().After(deadline) {
+			if !reflect.DeepEqual(lines, want) {
+				t.Errorf("got %q, want %q", lines, want)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const sysfsPCIDevicesDir = "sys/bus/pci/devices"
+
+// numaNode returns the NUMA node of the PCI device with the given bus ID as
+// reported by sysfs under root, or -1 if it cannot be determined (unknown
+// device, kernel without NUMA support).
+func numaNode(root, busID string) int64 {
+	if busID == "" {
+		return -1
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(root, sysfsPCIDevicesDir, normalizeBusID(busID), "numa_node"))
+	if err != nil {
+		return -1
+	}
+
+	node, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil || node < 0 {
+		return -1
+	}
+	return node
+}
+
+// numaTopology returns the topology advertised for a device on the given
+// NUMA node, nil when the node is unknown so that the Topology Manager
+// considers the device usable from any node.
+func numaTopology(node int64) *pluginapi.TopologyInfo {
+	if node < 0 {
+		return nil
+	}
+	return &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: node}}}
+}
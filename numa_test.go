@@ -0,0 +1,75 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestNUMANode(t *testing.T) {
+	root := t.TempDir()
+	// numa_node of the PCI devices by sysfs bus ID, a device without the
+	// file is not listed.
+	nodes := map[string]string{
+		"0000:06:00.0": "0\n",
+		"0000:3b:00.0": "1\n",
+		"0000:5e:00.0": "-1\n",
+		"0000:86:00.0": "invalid\n",
+		"0000:af:00.0": "",
+	}
+	for busID, node := range nodes {
+		dir := filepath.Join(root, sysfsPCIDevicesDir, busID)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "numa_node"), []byte(node), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(root, sysfsPCIDevicesDir, "0000:d8:00.0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		busID string
+		want  int64
+	}{
+		{busID: "0000:06:00.0", want: 0},
+		{busID: "00000000:3B:00.0", want: 1},
+		{busID: "0000:5e:00.0", want: -1},
+		{busID: "0000:86:00.0", want: -1},
+		{busID: "0000:af:00.0", want: -1},
+		{busID: "0000:d8:00.0", want: -1}, // missing numa_node
+		{busID: "0000:00:00.0", want: -1}, // unknown device
+		{busID: "", want: -1},
+	}
+
+	for _, tt := range tests {
+		if got := numaNode(root, tt.busID); got != tt.want {
+			t.Errorf("%q: got NUMA node %d, want %d", tt.busID, got, tt.want)
+		}
+	}
+}
+
+func TestNUMATopology(t *testing.T) {
+	tests := []struct {
+		node int64
+		want *pluginapi.TopologyInfo
+	}{
+		{node: -1, want: nil},
+		{node: 0, want: &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: 0}}}},
+		{node: 3, want: &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: 3}}}},
+	}
+
+	for _, tt := range tests {
+		if got := numaTopology(tt.node); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d: got %v, want %v", tt.node, got, tt.want)
+		}
+	}
+}
@@ -3,13 +3,15 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
 
 	"golang.org/x/net/context"
-	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 func check(err error) {
@@ -18,81 +20,480 @@ func check(err error) {
 	}
 }
 
-func getDevices() []*pluginapi.Device {
-	n, err := nvml.GetDeviceCount()
-	check(err)
+// nvmlBackend discovers devices and watches their health through NVML. All
+// the NVML calls go through the watchdog.
+type nvmlBackend struct {
+	xids     *xidTracker
+	watchdog *nvmlWatchdog
+	journal  *journal
+}
+
+func (b *nvmlBackend) Name() string {
+	return nvmlBackendName
+}
+
+func (b *nvmlBackend) Init() error {
+	return b.watchdog.call("Init", 0, nvml.Init)
+}
+
+func (b *nvmlBackend) Shutdown() error {
+	return b.watchdog.call("Shutdown", 0, nvml.Shutdown)
+}
+
+// Devices discovers the devices, each NVML call of the discovery running with
+// its own deadline so that the discovery of many GPUs does not time out.
+func (b *nvmlBackend) Devices() ([]*Device, error) {
+	var n uint
+	err := b.watchdog.call("GetDeviceCount", 0, func() (err error) {
+		n, err = nvml.GetDeviceCount()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	var devs []*pluginapi.Device
+	var devs []*Device
+	var nvmlDevs []*nvml.Device
 	for i := uint(0); i < n; i++ {
-		d, err := nvml.NewDeviceLite(i)
-		check(err)
-		devs = append(devs, &pluginapi.Device{
-			ID:     d.UUID,
-			Health: pluginapi.Healthy,
+		var d *nvml.Device
+		err := b.watchdog.call("NewDevice", 0, func() (err error) {
+			d, err = nvml.NewDevice(i)
+			return err
+		})
+		if err != nil && strings.HasSuffix(err.Error(), "GPU is lost") {
+			log.Printf("Warning: device %d has fallen off the bus: %s", i, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		dev := &Device{
+			Device: pluginapi.Device{
+				ID:       d.UUID,
+				Health:   pluginapi.Healthy,
+				Topology: numaTopology(numaNode("/", d.PCI.BusID)),
+			},
+			Index: i,
+			Path:  d.Path,
+			BusID: d.PCI.BusID,
+		}
+		if d.Model != nil {
+			dev.Model = *d.Model
+		}
+		err = b.watchdog.call("memoryTotal", 0, func() error {
+			h, err := nvmlDeviceByUUID(d.UUID)
+			if err != nil {
+				return nil
+			}
+			dev.Memory, err = h.memoryTotal()
+			return err
 		})
+		if isWatchdogError(err) {
+			return nil, err
+		}
+		if err != nil {
+			log.Printf("Warning: could not get the memory of %s: %s", d.UUID, err)
+		}
+		devs = append(devs, dev)
+		nvmlDevs = append(nvmlDevs, d)
+	}
+
+	for i := range nvmlDevs {
+		for j := range nvmlDevs {
+			if i == j {
+				continue
+			}
+
+			var link nvml.P2PLinkType
+			err := b.watchdog.call("getP2PLink", 0, func() (err error) {
+				link, err = getP2PLink(nvmlDevs[i], nvmlDevs[j])
+				return err
+			})
+			if isWatchdogError(err) {
+				return nil, err
+			}
+			if err != nil {
+				log.Printf("Warning: could not get the topology between %s and %s: %s", devs[i].ID, devs[j].ID, err)
+				continue
+			}
+			if link != nvml.P2PLinkUnknown {
+				devs[i].Topology = append(devs[i].Topology, p2pLink{Peer: devs[j].ID, Link: link})
+			}
+		}
 	}
 
-	return devs
+	return devs, nil
 }
 
-func deviceExists(devs []*pluginapi.Device, id string) bool {
-	for _, d := range devs {
-		if d.ID == id {
-			return true
+// WatchHealth watches the NVML events. When NVML stops responding, it
+// returns the error of the watchdog and the devices are reported unhealthy by
+// the health check loop until NVML is re-initialized.
+func (b *nvmlBackend) WatchHealth(ctx context.Context, devs []*Device, unhealthy chan<- healthEvent) error {
+	return b.watchEvents(ctx, devs, unhealthy)
+}
+
+// Probe checks that NVML can still query the status of the device.
+func (b *nvmlBackend) Probe(d *Device) error {
+	return b.watchdog.call("Probe", 0, func() error {
+		return probeDevice(d)
+	})
+}
+
+func probeDevice(d *Device) error {
+	dev, err := nvml.NewDeviceLite(d.Index)
+	if err != nil {
+		return err
+	}
+	if dev.UUID != d.ID {
+		return fmt.Errorf("device %d is now %s", d.Index, dev.UUID)
+	}
+
+	_, err = dev.Status()
+	return err
+}
+
+// Telemetry queries the metrics of each group with its own NVML calls, the
+// groups which could be queried are returned even if others failed.
+func (b *nvmlBackend) Telemetry(d *Device, groups telemetryGroups) (map[string]float64, error) {
+	var m map[string]float64
+	var sampleErr error
+	err := b.watchdog.call("Telemetry", 0, func() error {
+		m, sampleErr = deviceTelemetry(d, groups)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, sampleErr
+}
+
+// nvmlTelemetry lists the functions setting the metrics of each group.
+var nvmlTelemetry = []struct {
+	group  telemetryGroups
+	sample func(m map[string]float64, d *Device) error
+}{
+	{telemetryStatus, statusTelemetry},
+	{telemetryPCIe, pcieTelemetry},
+	{telemetryRetiredPages, retiredPagesTelemetry},
+	{telemetryNVLink, nvlinkTelemetry},
+}
+
+func deviceTelemetry(d *Device, groups telemetryGroups) (map[string]float64, error) {
+	m := make(map[string]float64)
+	var errs []string
+	for _, t := range nvmlTelemetry {
+		if groups&t.group == 0 {
+			continue
+		}
+		if err := t.sample(m, d); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", t.group, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return m, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return m, nil
+}
+
+func statusTelemetry(m map[string]float64, d *Device) error {
+	dev, err := nvml.NewDeviceLite(d.Index)
+	if err != nil {
+		return err
+	}
+	if dev.UUID != d.ID {
+		return fmt.Errorf("device %d is now %s", d.Index, dev.UUID)
+	}
+
+	status, err := dev.Status()
+	if err != nil {
+		return err
+	}
+	for k, v := range statusMetrics(status) {
+		m[k] = v
+	}
+	return nil
+}
+
+func pcieTelemetry(m map[string]float64, d *Device) error {
+	h, err := nvmlDeviceByUUID(d.ID)
+	if err != nil {
+		return err
+	}
+	link, err := h.pcieLink()
+	if err != nil {
+		return err
+	}
+
+	setUint(m, "pcie.generation", link.Generation)
+	setUint(m, "pcie.width", link.Width)
+	setUint(m, "pcie.maxGeneration", link.MaxGeneration)
+	setUint(m, "pcie.maxWidth", link.MaxWidth)
+	return nil
+}
+
+func retiredPagesTelemetry(m map[string]float64, d *Device) error {
+	h, err := nvmlDeviceByUUID(d.ID)
+	if err != nil {
+		return err
+	}
+	pages, err := h.retiredPages()
+	if err != nil {
+		return err
+	}
+
+	if pages.Pending != nil {
+		m["retiredPages.singleBitEcc"] = float64(len(pages.SingleBitECC))
+		m["retiredPages.doubleBitEcc"] = float64(len(pages.DoubleBitECC))
+		m["retiredPages.pending"] = 0
+		if *pages.Pending {
+			m["retiredPages.pending"] = 1
 		}
 	}
-	return false
+	return nil
+}
+
+func nvlinkTelemetry(m map[string]float64, d *Device) error {
+	h, err := nvmlDeviceByUUID(d.ID)
+	if err != nil {
+		return err
+	}
+	links, err := h.nvlinks()
+	if err != nil {
+		return err
+	}
+
+	nvlinkMetrics(m, links)
+	return nil
 }
 
-func watchXIDs(ctx context.Context, devs []*pluginapi.Device, xids chan<- *pluginapi.Device) {
-	eventSet := nvml.NewEventSet()
-	defer nvml.DeleteEventSet(eventSet)
+// statusMetrics returns the telemetry metrics of a device status, metrics the
+// device does not support are omitted.
+func statusMetrics(s *nvml.DeviceStatus) map[string]float64 {
+	m := make(map[string]float64)
+	setUint(m, "temperature", s.Temperature)
+	setUint(m, "power", s.Power)
+	setUint(m, "gpuUtilization", s.Utilization.GPU)
+	setUint(m, "memoryUtilization", s.Utilization.Memory)
+	setUint64(m, "memoryUsed", s.Memory.Global.Used)
+	setUint64(m, "eccL1", s.Memory.ECCErrors.L1Cache)
+	setUint64(m, "eccL2", s.Memory.ECCErrors.L2Cache)
+	setUint64(m, "eccGlobal", s.Memory.ECCErrors.Device)
+
+	if s.Throttle != nvml.ThrottleReasonUnknown {
+		throttles := map[string]nvml.ThrottleReason{
+			"throttle.swPowerCap":           nvml.ThrottleReasonSwPowerCap,
+			"throttle.hwSlowdown":           nvml.ThrottleReasonHwSlowdown,
+			"throttle.swThermalSlowdown":    nvml.ThrottleReasonSwThermalSlowdown,
+			"throttle.hwThermalSlowdown":    nvml.ThrottleReasonHwThermalSlowdown,
+			"throttle.hwPowerBrakeSlowdown": nvml.ThrottleReasonHwPowerBrakeSlowdown,
+		}
+		for name, reason := range throttles {
+			m[name] = 0
+			if s.Throttle == reason {
+				m[name] = 1
+			}
+		}
+	}
+
+	return m
+}
+
+// nvlinkMetrics sets the telemetry metrics of the NVLinks of a device.
+func nvlinkMetrics(m map[string]float64, links []nvlinkStatus) {
+	for _, l := range links {
+		i := int(l.Link)
+		m[nvlinkMetric(i, "active")] = 0
+		if l.Active {
+			m[nvlinkMetric(i, "active")] = 1
+		}
+		setUint64(m, nvlinkMetric(i, "replay"), l.Errors.Replay)
+		setUint64(m, nvlinkMetric(i, "recovery"), l.Errors.Recovery)
+		setUint64(m, nvlinkMetric(i, "crcFlit"), l.Errors.CRCFlit)
+		setUint64(m, nvlinkMetric(i, "crcData"), l.Errors.CRCData)
+	}
+}
+
+// setUint sets a metric if the device supports it.
+func setUint(m map[string]float64, name string, v *uint) {
+	if v != nil {
+		m[name] = float64(*v)
+	}
+}
+
+func setUint64(m map[string]float64, name string, v *uint64) {
+	if v != nil {
+		m[name] = float64(*v)
+	}
+}
+
+// getP2PLink returns the NVLinks between two devices if they have any, their
+// PCI topology otherwise.
+func getP2PLink(d1, d2 *nvml.Device) (nvml.P2PLinkType, error) {
+	h, err := nvmlDeviceByUUID(d1.UUID)
+	if err != nil {
+		return nvml.P2PLinkUnknown, err
+	}
+	link, err := h.nvlinkTo(d2.PCI.BusID)
+	if err != nil || link != nvml.P2PLinkUnknown {
+		return link, err
+	}
+	return nvml.GetP2PLink(d1, d2)
+}
+
+// watchEvents reports the devices hit by an XID or another NVML event
+// according to the policy. It returns when the context is cancelled or when
+// NVML fails, the latter usually meaning that the set of devices changed, or
+// does not respond.
+func (b *nvmlBackend) watchEvents(ctx context.Context, devs []*Device, xids chan<- healthEvent) error {
+	var eventSet nvml.EventSet
+	err := b.watchdog.call("NewEventSet", 0, func() error {
+		eventSet = nvml.NewEventSet()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	defer b.watchdog.call("DeleteEventSet", 0, func() error {
+		nvml.DeleteEventSet(eventSet)
+		return nil
+	})
 
 	for _, d := range devs {
-		err := nvml.RegisterEventForDevice(eventSet, nvml.XidCriticalError, d.ID)
+		events := nvml.XidCriticalError | b.supportedEvents(d, b.xids.policy.eventMask())
+		err := b.watchdog.call("RegisterEventForDevice", 0, func() error {
+			return nvml.RegisterEventForDevice(eventSet, int(events), d.ID)
+		})
+		if isWatchdogError(err) {
+			return err
+		}
 		if err != nil && strings.HasSuffix(err.Error(), "Not Supported") {
 			log.Printf("Warning: %s is too old to support healthchecking: %s. Marking it unhealthy.", d.ID, err)
 
-			xids <- d
+			sendUnhealthy(ctx, xids, d, "health checks are not supported")
 			continue
 		}
 
 		if err != nil {
-			log.Panicln("Fatal:", err)
+			return fmt.Errorf("could not register events for %s: %v", d.ID, err)
 		}
 	}
 
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return nil
 		default:
 		}
 
-		e, err := nvml.WaitForEvent(eventSet, 5000)
+		// The wait is short so that the other NVML calls, which the
+		// watchdog runs one at a time, are not delayed.
+		var e nvml.Event
+		err := b.watchdog.call("WaitForEvent", time.Second, func() (err error) {
+			e, err = nvml.WaitForEvent(eventSet, 1000)
+			return err
+		})
+		if err == errNVMLTimeout || err == errNVMLHung {
+			return err
+		}
+		if err == errNVMLBusy || (err != nil && strings.HasSuffix(err.Error(), "Timeout")) {
+			continue
+		}
+
 		if err != nil && e.Etype != nvml.XidCriticalError {
+			return fmt.Errorf("could not wait for events: %v", err)
+		}
+
+		if e.Etype != nvml.XidCriticalError {
+			b.handleEvent(ctx, devs, e, xids)
 			continue
 		}
 
-		// FIXME: formalize the full list and document it.
-		// http://docs.nvidia.com/deploy/xid-errors/index.html#topic_4
-		// Application errors: the GPU should still be healthy
-		if e.Edata == 31 || e.Edata == 43 || e.Edata == 45 {
+		b.handleXID(ctx, devs, e, xids)
+	}
+}
+
+// handleXID applies the policy to an XID. An XID without a UUID is reported
+// for all the devices, the policy is applied to each of them.
+func (b *nvmlBackend) handleXID(ctx context.Context, devs []*Device, e nvml.Event, unhealthy chan<- healthEvent) {
+	all := e.UUID == nil || len(*e.UUID) == 0
+	if all {
+		log.Printf("XID %d reported for all devices.", e.Edata)
+	}
+
+	for _, d := range devs {
+		if !all && d.ID != *e.UUID {
 			continue
 		}
 
-		if e.UUID == nil || len(*e.UUID) == 0 {
-			// All devices are unhealthy
-			for _, d := range devs {
-				xids <- d
-			}
+		action := b.xids.action(d.ID, e.Edata, time.Now())
+		log.Printf("XID %d reported by %s, action: %s.", e.Edata, d.ID, action)
+		b.journal.record(journalEntry{Kind: journalXID, Device: d.ID, XID: e.Edata, Action: string(action)})
+		applyAction(ctx, devs, d, action, fmt.Sprintf("XID %d", e.Edata), e.Edata, unhealthy)
+		if action == xidAllUnhealthy {
+			// All the devices are already reported.
+			return
+		}
+	}
+}
+
+// supportedEvents returns the events of the mask which the device supports.
+func (b *nvmlBackend) supportedEvents(d *Device, mask uint64) uint64 {
+	if mask == 0 {
+		return 0
+	}
+
+	var supported uint64
+	err := b.watchdog.call("GetSupportedEventTypesForDevice", 0, func() (err error) {
+		h, err := nvmlDeviceByUUID(d.ID)
+		if err != nil {
+			return err
+		}
+		supported, err = h.supportedEvents()
+		return err
+	})
+	if err != nil {
+		log.Printf("Warning: could not get the events supported by %s: %s", d.ID, err)
+		return 0
+	}
+
+	for t, name := range eventTypes {
+		if mask&t != 0 && supported&t == 0 {
+			log.Printf("Warning: %s does not support %s events.", d.ID, name)
+		}
+	}
+	return mask & supported
+}
+
+// handleEvent applies the policy to an event other than an XID.
+func (b *nvmlBackend) handleEvent(ctx context.Context, devs []*Device, e nvml.Event, unhealthy chan<- healthEvent) {
+	name, ok := eventTypes[e.Etype]
+	if !ok || e.UUID == nil {
+		return
+	}
+
+	for _, d := range devs {
+		if d.ID != *e.UUID {
 			continue
 		}
 
-		for _, d := range devs {
-			if d.ID == *e.UUID {
-				xids <- d
-			}
+		action := b.xids.eventAction(d.ID, name, time.Now())
+		log.Printf("Event %s (data %d) reported by %s, action: %s.", name, e.Edata, d.ID, action)
+		b.journal.record(journalEntry{Kind: journalNVMLEvent, Device: d.ID, Event: name, Action: string(action)})
+		applyAction(ctx, devs, d, action, name+" event", 0, unhealthy)
+	}
+}
+
+// applyAction reports the devices affected by the action taken on an event
+// of the device d. xid is 0 for the events other than XIDs.
+func applyAction(ctx context.Context, devs []*Device, d *Device, action xidAction, reason string, xid uint64, unhealthy chan<- healthEvent) {
+	switch action {
+	case xidUnhealthy:
+		sendHealthEvent(ctx, unhealthy, healthEvent{Device: d, Reason: reason, XID: xid})
+	case xidAllUnhealthy:
+		for _, dev := range devs {
+			sendHealthEvent(ctx, unhealthy, healthEvent{Device: dev, Reason: fmt.Sprintf("%s on %s", reason, d.ID), XID: xid})
 		}
 	}
 }
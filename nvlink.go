@@ -0,0 +1,170 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const maxNVLinks = 6
+
+// nvlinkCounters are the NVLink error counters, as named in the configuration
+// and in the telemetry metrics.
+var nvlinkCounters = map[string]string{
+	"replay":   "data link transmit replays",
+	"recovery": "data link transmit recoveries",
+	"crcFlit":  "flow control digit CRC errors",
+	"crcData":  "data CRC errors",
+}
+
+// defaultNVLinkThresholds are the error rates, per second, above which a link
+// is faulty. Recoveries mean the link was retrained, any of them is a fault.
+var defaultNVLinkThresholds = map[string]float64{
+	"replay":   100,
+	"recovery": 0,
+	"crcFlit":  100,
+	"crcData":  100,
+}
+
+func init() {
+	for i := 0; i < maxNVLinks; i++ {
+		telemetryMetrics[nvlinkMetric(i, "active")] = fmt.Sprintf("NVLink %d is active", i)
+		for name, desc := range nvlinkCounters {
+			telemetryMetrics[nvlinkMetric(i, name)] = fmt.Sprintf("NVLink %d %s", i, desc)
+		}
+	}
+}
+
+func nvlinkMetric(link int, name string) string {
+	return fmt.Sprintf("nvlink.%d.%s", link, name)
+}
+
+// nvlinkConfig configures the check of the NVLinks, which reports the GPUs
+// whose links went down or whose error counters rise faster than Thresholds.
+type nvlinkConfig struct {
+	// Thresholds overrides the default error rates, per second, by counter.
+	Thresholds map[string]float64 `yaml:"thresholds"`
+}
+
+func (c nvlinkConfig) validate() error {
+	for name, v := range c.Thresholds {
+		if _, ok := nvlinkCounters[name]; !ok {
+			return fmt.Errorf("health.nvlink: unknown counter %q", name)
+		}
+		if v < 0 {
+			return fmt.Errorf("health.nvlink: negative threshold for %s", name)
+		}
+	}
+	return nil
+}
+
+func (c nvlinkConfig) thresholds() map[string]float64 {
+	t := make(map[string]float64)
+	for name, v := range defaultNVLinkThresholds {
+		t[name] = v
+	}
+	for name, v := range c.Thresholds {
+		t[name] = v
+	}
+	return t
+}
+
+// nvlinkSample is the previous sample of the links of a device.
+type nvlinkSample struct {
+	at     time.Time
+	sample map[string]float64
+}
+
+// nvlinkChecker compares the NVLink metrics of each device to its previous
+// sample.
+type nvlinkChecker struct {
+	thresholds map[string]float64
+
+	mu   sync.Mutex
+	last map[string]nvlinkSample
+	// up records the links of each device which were seen active.
+	up map[string]map[int]bool
+}
+
+func newNVLinkChecker(config nvlinkConfig) *nvlinkChecker {
+	return &nvlinkChecker{
+		thresholds: config.thresholds(),
+		last:       make(map[string]nvlinkSample),
+		up:         make(map[string]map[int]bool),
+	}
+}
+
+// evaluate returns the faults of the links of a device: links which were
+// active and went down, and error counters rising faster than the
+// thresholds since the previous sample.
+func (c *nvlinkChecker) evaluate(id string, sample map[string]float64, now time.Time) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.up[id] == nil {
+		c.up[id] = make(map[int]bool)
+	}
+	prev, hasPrev := c.last[id]
+	c.last[id] = nvlinkSample{at: now, sample: sample}
+	elapsed := now.Sub(prev.at).Seconds()
+
+	var faults []string
+	for i := 0; i < maxNVLinks; i++ {
+		active, ok := sample[nvlinkMetric(i, "active")]
+		if !ok {
+			continue
+		}
+		if active == 0 {
+			if c.up[id][i] {
+				faults = append(faults, fmt.Sprintf("NVLink %d is down", i))
+			}
+			continue
+		}
+		c.up[id][i] = true
+
+		if !hasPrev || elapsed <= 0 {
+			continue
+		}
+		var errs []string
+		for _, name := range sortedKeys(c.thresholds) {
+			v, ok := sample[nvlinkMetric(i, name)]
+			p, okPrev := prev.sample[nvlinkMetric(i, name)]
+			// The counters decrease when they are reset.
+			if !ok || !okPrev || v <= p {
+				continue
+			}
+			if rate := (v - p) / elapsed; rate > c.thresholds[name] {
+				errs = append(errs, fmt.Sprintf("%s errors at %.1f/s", name, rate))
+			}
+		}
+		if len(errs) > 0 {
+			faults = append(faults, fmt.Sprintf("NVLink %d: %s", i, strings.Join(errs, ", ")))
+		}
+	}
+	return faults
+}
+
+func sortedKeys(m map[string]float64) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// watchNVLinks samples the NVLinks of the devices every interval and reports
+// the devices with faulty links until the context is cancelled.
+func watchNVLinks(ctx context.Context, backend deviceBackend, devs []*Device, interval time.Duration, checker *nvlinkChecker, events chan<- healthEvent) {
+	sampleTelemetry(ctx, backend, devs, interval, telemetryNVLink, func(d *Device, sample map[string]float64, now time.Time) {
+		if faults := checker.evaluate(d.ID, sample, now); len(faults) > 0 {
+			sendUnhealthy(ctx, events, d, strings.Join(faults, "; "))
+		}
+	})
+}
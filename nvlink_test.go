@@ -0,0 +1,83 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nvlinkTestSample returns the metrics of a device whose NVLink 0 is active
+// or not with the given counters, and whose NVLink 1 was never active.
+func nvlinkTestSample(active bool, replay, recovery float64) map[string]float64 {
+	s := map[string]float64{
+		"nvlink.0.active":   0,
+		"nvlink.0.replay":   replay,
+		"nvlink.0.recovery": recovery,
+		"nvlink.0.crcFlit":  0,
+		"nvlink.0.crcData":  0,
+		"nvlink.1.active":   0,
+	}
+	if active {
+		s["nvlink.0.active"] = 1
+	}
+	return s
+}
+
+func TestNVLinkCheckerEvaluate(t *testing.T) {
+	c := newNVLinkChecker(nvlinkConfig{})
+	start := time.Now()
+
+	steps := []struct {
+		name   string
+		device string
+		at     time.Duration
+		sample map[string]float64
+		want   []string
+	}{
+		{name: "first sample", device: "GPU-a", sample: nvlinkTestSample(true, 0, 0)},
+		{name: "below the threshold", device: "GPU-a", at: 10 * time.Second, sample: nvlinkTestSample(true, 500, 0)},
+		{name: "above the threshold", device: "GPU-a", at: 20 * time.Second, sample: nvlinkTestSample(true, 2000, 0), want: []string{"NVLink 0: replay errors at 150.0/s"}},
+		{name: "any recovery", device: "GPU-a", at: 30 * time.Second, sample: nvlinkTestSample(true, 2000, 1), want: []string{"NVLink 0: recovery errors at 0.1/s"}},
+		{name: "same time", device: "GPU-a", at: 30 * time.Second, sample: nvlinkTestSample(true, 5000, 2)},
+		// The counters wrapped or were reset.
+		{name: "reset", device: "GPU-a", at: 40 * time.Second, sample: nvlinkTestSample(true, 10, 0)},
+		{name: "after the reset", device: "GPU-a", at: 50 * time.Second, sample: nvlinkTestSample(true, 20, 0)},
+		// The first sample of another device has no previous one.
+		{name: "other device", device: "GPU-b", at: 50 * time.Second, sample: nvlinkTestSample(true, 1e6, 10)},
+		{name: "link down", device: "GPU-a", at: 60 * time.Second, sample: nvlinkTestSample(false, 20, 0), want: []string{"NVLink 0 is down"}},
+		{name: "link still down", device: "GPU-a", at: 70 * time.Second, sample: nvlinkTestSample(false, 20, 0), want: []string{"NVLink 0 is down"}},
+		{name: "link up again", device: "GPU-a", at: 80 * time.Second, sample: nvlinkTestSample(true, 20, 0)},
+		{name: "never active", device: "GPU-c", at: 80 * time.Second, sample: nvlinkTestSample(false, 0, 0)},
+		{name: "no NVLink", device: "GPU-d", at: 80 * time.Second, sample: map[string]float64{"temperature": 50}},
+	}
+
+	for _, step := range steps {
+		got := c.evaluate(step.device, step.sample, start.Add(step.at))
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: got %q, want %q", step.name, got, step.want)
+		}
+	}
+}
+
+func TestNVLinkCheckerThresholds(t *testing.T) {
+	c := newNVLinkChecker(nvlinkConfig{Thresholds: map[string]float64{"replay": 10, "recovery": 1}})
+	start := time.Now()
+
+	c.evaluate("GPU-a", nvlinkTestSample(true, 0, 0), start)
+	got := c.evaluate("GPU-a", nvlinkTestSample(true, 200, 5), start.Add(10*time.Second))
+	if want := []string{"NVLink 0: replay errors at 20.0/s"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	err := nvlinkConfig{Thresholds: map[string]float64{"replays": 10}}.validate()
+	if err == nil || !strings.Contains(err.Error(), `unknown counter "replays"`) {
+		t.Errorf("got error %v for an unknown counter", err)
+	}
+	err = nvlinkConfig{Thresholds: map[string]float64{"replay": -1}}.validate()
+	if err == nil || !strings.Contains(err.Error(), "negative threshold") {
+		t.Errorf("got error %v for a negative threshold", err)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+// The NVML calls which the vendored bindings do not wrap. The library is
+// loaded by nvml.Init, its symbols are resolved when first called.
+
+// #cgo CFLAGS: -I${SRCDIR}/vendor/github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml
+// #cgo LDFLAGS: -ldl -Wl,--unresolved-symbols=ignore-in-object-files
+// #include <stdlib.h>
+// #include "nvml.h"
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+// NVML events other than XIDs.
+const (
+	nvmlEventSingleBitECC = C.nvmlEventTypeSingleBitEccError
+	nvmlEventDoubleBitECC = C.nvmlEventTypeDoubleBitEccError
+	nvmlEventPState       = C.nvmlEventTypePState
+	nvmlEventClock        = C.nvmlEventTypeClock
+)
+
+// Links between devices connected through NVLink, by number of links. They
+// extend the PCI topology levels of nvml.P2PLinkType.
+const (
+	p2pLinkSingleNVLink nvml.P2PLinkType = nvml.P2PLinkSameBoard + 1 + iota
+	p2pLinkTwoNVLinks
+	p2pLinkThreeNVLinks
+	p2pLinkFourNVLinks
+	p2pLinkFiveNVLinks
+	p2pLinkSixNVLinks
+)
+
+// pcieLinkInfo is the current and maximum generation and width of the PCIe
+// link of a device. The current link may be downgraded at idle to save power.
+type pcieLinkInfo struct {
+	Generation    *uint
+	Width         *uint
+	MaxGeneration *uint
+	MaxWidth      *uint
+}
+
+// retiredPagesInfo lists the addresses of the pages retired because of
+// multiple single bit ECC errors or a double bit ECC error, and whether pages
+// are pending retirement until the next reboot. Pending is nil when the
+// device does not support page retirement.
+type retiredPagesInfo struct {
+	SingleBitECC []uint64
+	DoubleBitECC []uint64
+	Pending      *bool
+}
+
+// nvlinkErrorCounters are the error counters of an NVLink, nil when the
+// device does not support them.
+type nvlinkErrorCounters struct {
+	Replay   *uint64 // data link transmit replays
+	Recovery *uint64 // data link transmit recoveries
+	CRCFlit  *uint64 // flow control digit CRC errors
+	CRCData  *uint64 // data CRC errors
+}
+
+// nvlinkStatus is the state and the error counters of an NVLink of a device.
+type nvlinkStatus struct {
+	Link   uint
+	Active bool
+	Errors nvlinkErrorCounters
+}
+
+// nvmlDevice is the NVML handle of a device.
+type nvmlDevice struct{ dev C.nvmlDevice_t }
+
+func nvmlError(r C.nvmlReturn_t) error {
+	if r == C.NVML_SUCCESS {
+		return nil
+	}
+	return fmt.Errorf("nvml: %v", C.GoString(C.nvmlErrorString(r)))
+}
+
+func nvmlDeviceByUUID(uuid string) (nvmlDevice, error) {
+	s := C.CString(uuid)
+	defer C.free(unsafe.Pointer(s))
+
+	var dev C.nvmlDevice_t
+	r := C.nvmlDeviceGetHandleByUUID(s, &dev)
+	return nvmlDevice{dev}, nvmlError(r)
+}
+
+// supportedEvents returns the mask of the events the device supports.
+func (d nvmlDevice) supportedEvents() (uint64, error) {
+	var types C.ulonglong
+	r := C.nvmlDeviceGetSupportedEventTypes(d.dev, &types)
+	return uint64(types), nvmlError(r)
+}
+
+// memoryTotal returns the memory of the device in MiB, 0 if unknown.
+func (d nvmlDevice) memoryTotal() (uint64, error) {
+	var mem C.nvmlMemory_t
+	r := C.nvmlDeviceGetMemoryInfo(d.dev, &mem)
+	if r == C.NVML_ERROR_NOT_SUPPORTED {
+		return 0, nil
+	}
+	return uint64(mem.total) / (1024 * 1024), nvmlError(r)
+}
+
+func (d nvmlDevice) pcieLink() (*pcieLinkInfo, error) {
+	var gen, width, maxGen, maxWidth C.uint
+	link := &pcieLinkInfo{}
+	var err error
+
+	if link.Generation, err = nvmlUint(C.nvmlDeviceGetCurrPcieLinkGeneration(d.dev, &gen), gen); err != nil {
+		return nil, err
+	}
+	if link.Width, err = nvmlUint(C.nvmlDeviceGetCurrPcieLinkWidth(d.dev, &width), width); err != nil {
+		return nil, err
+	}
+	if link.MaxGeneration, err = nvmlUint(C.nvmlDeviceGetMaxPcieLinkGeneration(d.dev, &maxGen), maxGen); err != nil {
+		return nil, err
+	}
+	if link.MaxWidth, err = nvmlUint(C.nvmlDeviceGetMaxPcieLinkWidth(d.dev, &maxWidth), maxWidth); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// nvmlUint returns the value returned by an NVML call, nil if the device does
+// not support it.
+func nvmlUint(r C.nvmlReturn_t, v C.uint) (*uint, error) {
+	if r == C.NVML_ERROR_NOT_SUPPORTED {
+		return nil, nil
+	}
+	if err := nvmlError(r); err != nil {
+		return nil, err
+	}
+	u := uint(v)
+	return &u, nil
+}
+
+func (d nvmlDevice) retiredPages() (*retiredPagesInfo, error) {
+	var state C.nvmlEnableState_t
+	r := C.nvmlDeviceGetRetiredPagesPendingStatus(d.dev, &state)
+	if r == C.NVML_ERROR_NOT_SUPPORTED {
+		return &retiredPagesInfo{}, nil
+	}
+	if err := nvmlError(r); err != nil {
+		return nil, err
+	}
+	pending := state == C.NVML_FEATURE_ENABLED
+
+	sbe, err := d.retiredPagesFor(C.NVML_PAGE_RETIREMENT_CAUSE_MULTIPLE_SINGLE_BIT_ECC_ERRORS)
+	if err != nil {
+		return nil, err
+	}
+	dbe, err := d.retiredPagesFor(C.NVML_PAGE_RETIREMENT_CAUSE_DOUBLE_BIT_ECC_ERROR)
+	if err != nil {
+		return nil, err
+	}
+	return &retiredPagesInfo{SingleBitECC: sbe, DoubleBitECC: dbe, Pending: &pending}, nil
+}
+
+func (d nvmlDevice) retiredPagesFor(cause C.nvmlPageRetirementCause_t) ([]uint64, error) {
+	var count C.uint
+	r := C.nvmlDeviceGetRetiredPages(d.dev, cause, &count, nil)
+	for r == C.NVML_ERROR_INSUFFICIENT_SIZE {
+		addrs := make([]C.ulonglong, count)
+		r = C.nvmlDeviceGetRetiredPages(d.dev, cause, &count, &addrs[0])
+		if r == C.NVML_SUCCESS {
+			pages := make([]uint64, count)
+			for i := range pages {
+				pages[i] = uint64(addrs[i])
+			}
+			return pages, nil
+		}
+	}
+	if r == C.NVML_ERROR_NOT_SUPPORTED {
+		return nil, nil
+	}
+	return nil, nvmlError(r)
+}
+
+// nvlinkActive returns whether a link of the device is active, nil if the
+// device does not have this link.
+func (d nvmlDevice) nvlinkActive(link uint) (*bool, error) {
+	var state C.nvmlEnableState_t
+	r := C.nvmlDeviceGetNvLinkState(d.dev, C.uint(link), &state)
+	if r == C.NVML_ERROR_NOT_SUPPORTED || r == C.NVML_ERROR_INVALID_ARGUMENT {
+		return nil, nil
+	}
+	active := state == C.NVML_FEATURE_ENABLED
+	return &active, nvmlError(r)
+}
+
+func (d nvmlDevice) nvlinkErrorCounter(link uint, counter C.nvmlNvLinkErrorCounter_t) (*uint64, error) {
+	var value C.ulonglong
+	r := C.nvmlDeviceGetNvLinkErrorCounter(d.dev, C.uint(link), counter, &value)
+	if r == C.NVML_ERROR_NOT_SUPPORTED {
+		return nil, nil
+	}
+	v := uint64(value)
+	return &v, nvmlError(r)
+}
+
+// nvlinks returns the status of the NVLinks of the device, the error
+// counters are only read for the active links.
+func (d nvmlDevice) nvlinks() ([]nvlinkStatus, error) {
+	var links []nvlinkStatus
+	for i := uint(0); i < C.NVML_NVLINK_MAX_LINKS; i++ {
+		active, err := d.nvlinkActive(i)
+		if err != nil {
+			return nil, err
+		}
+		if active == nil {
+			continue
+		}
+
+		link := nvlinkStatus{Link: i, Active: *active}
+		if link.Active {
+			counters := []struct {
+				counter C.nvmlNvLinkErrorCounter_t
+				v       **uint64
+			}{
+				{C.NVML_NVLINK_ERROR_DL_REPLAY, &link.Errors.Replay},
+				{C.NVML_NVLINK_ERROR_DL_RECOVERY, &link.Errors.Recovery},
+				{C.NVML_NVLINK_ERROR_DL_CRC_FLIT, &link.Errors.CRCFlit},
+				{C.NVML_NVLINK_ERROR_DL_CRC_DATA, &link.Errors.CRCData},
+			}
+			for _, c := range counters {
+				if *c.v, err = d.nvlinkErrorCounter(i, c.counter); err != nil {
+					return nil, err
+				}
+			}
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// nvlinkTo returns the number of active NVLinks from the device to the peer
+// with the given PCI bus ID as a link type, or nvml.P2PLinkUnknown if they
+// are not connected through NVLink.
+func (d nvmlDevice) nvlinkTo(peerBusID string) (nvml.P2PLinkType, error) {
+	count := 0
+	for i := uint(0); i < C.NVML_NVLINK_MAX_LINKS; i++ {
+		active, err := d.nvlinkActive(i)
+		if err != nil {
+			return nvml.P2PLinkUnknown, err
+		}
+		if active == nil || !*active {
+			continue
+		}
+
+		var pci C.nvmlPciInfo_t
+		r := C.nvmlDeviceGetNvLinkRemotePciInfo(d.dev, C.uint(i), &pci)
+		if r == C.NVML_ERROR_NOT_SUPPORTED {
+			continue
+		}
+		if err := nvmlError(r); err != nil {
+			return nvml.P2PLinkUnknown, err
+		}
+		if C.GoString(&pci.busId[0]) == peerBusID {
+			count++
+		}
+	}
+
+	if count == 0 {
+		return nvml.P2PLinkUnknown, nil
+	}
+	if count > 6 {
+		count = 6
+	}
+	return p2pLinkSingleNVLink + nvml.P2PLinkType(count-1), nil
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// pendingRetirement returns why a device must be rebooted, or false if it
+// has no page pending retirement or does not support page retirement.
+func pendingRetirement(sample map[string]float64) (string, bool) {
+	if sample["retiredPages.pending"] != 1 {
+		return "", false
+	}
+	return fmt.Sprintf("pages pending retirement (%s retired after double bit ECC errors, %s after single bit ECC errors), reboot required",
+		formatMetric(sample["retiredPages.doubleBitEcc"]), formatMetric(sample["retiredPages.singleBitEcc"])), true
+}
+
+// watchRetiredPages samples the retired pages of the devices every interval
+// and reports the devices with pages pending retirement until the context
+// is cancelled. The pages are only retired, and the devices safe to use
+// again, after the node reboots.
+func watchRetiredPages(ctx context.Context, backend deviceBackend, devs []*Device, interval time.Duration, events chan<- healthEvent) {
+	sampleTelemetry(ctx, backend, devs, interval, telemetryRetiredPages, func(d *Device, sample map[string]float64, now time.Time) {
+		if reason, ok := pendingRetirement(sample); ok {
+			sendHealthEvent(ctx, events, healthEvent{Device: d, Reason: reason, RebootRequired: true})
+		}
+	})
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestPendingRetirement(t *testing.T) {
+	tests := []struct {
+		name   string
+		sample map[string]float64
+		want   string // empty if no reboot is required
+	}{
+		{name: "no sample"},
+		{name: "nothing pending", sample: map[string]float64{"retiredPages.pending": 0, "retiredPages.doubleBitEcc": 2, "retiredPages.singleBitEcc": 5}},
+		{name: "not supported", sample: map[string]float64{"retiredPages.doubleBitEcc": 2}},
+		{
+			name:   "pending",
+			sample: map[string]float64{"retiredPages.pending": 1, "retiredPages.doubleBitEcc": 2, "retiredPages.singleBitEcc": 5},
+			want:   "pages pending retirement (2 retired after double bit ECC errors, 5 after single bit ECC errors), reboot required",
+		},
+		{
+			name:   "pending without counts",
+			sample: map[string]float64{"retiredPages.pending": 1},
+			want:   "pages pending retirement (0 retired after double bit ECC errors, 0 after single bit ECC errors), reboot required",
+		},
+	}
+
+	for _, tt := range tests {
+		reason, ok := pendingRetirement(tt.sample)
+		if ok != (tt.want != "") || reason != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, reason, ok, tt.want)
+		}
+	}
+}
+
+func TestWatchRetiredPages(t *testing.T) {
+	b := &telemetryBackend{
+		fakeBackend: newFakeBackend("GPU-a"),
+		metrics:     map[string]float64{"retiredPages.pending": 1, "retiredPages.doubleBitEcc": 1},
+	}
+	m := newTestPlugin(t, b)
+	present := m.presentDevices(m.devs)
+
+	events := make(chan healthEvent)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchRetiredPages(ctx, b, present, 10*time.Millisecond, events)
+
+	var e healthEvent
+	select {
+	case e = <-events:
+	case <-time.After(time.Second):
+		t.Fatalf("no health event")
+	}
+	if e.Device.ID != "GPU-a" || !e.RebootRequired || e.Degraded {
+		t.Errorf("got event %+v, want GPU-a unhealthy and requiring a reboot", e)
+	}
+
+	// The device is unhealthy and the node requires a reboot, once.
+	if !m.handleHealthEvent(e) || m.handleHealthEvent(e) {
+		t.Errorf("the advertised health changed more than once")
+	}
+	if h := m.deviceHealthOf("GPU-a"); h != pluginapi.Unhealthy {
+		t.Errorf("GPU-a is %s, want %s", h, pluginapi.Unhealthy)
+	}
+	m.node.mu.Lock()
+	reason, ok := m.node.reboot["GPU-a"]
+	m.node.mu.Unlock()
+	if !ok || reason != e.Reason {
+		t.Errorf("got reboot reason %q, %v, want %q", reason, ok, e.Reason)
+	}
+}
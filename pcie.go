@@ -0,0 +1,56 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// pcieConfig configures the check of the PCIe links, which reports the GPUs
+// whose link runs below its maximum width, or below its maximum generation if
+// Generation is set. GPUs lower their link generation at idle to save power,
+// so it is only worth checking on nodes under a steady load.
+type pcieConfig struct {
+	Generation bool `yaml:"generation"`
+}
+
+// pcieDowngrade returns how the link of a device is downgraded, or false if it
+// is not. Devices which do not report their link are never downgraded.
+func pcieDowngrade(sample map[string]float64, generation bool) (string, bool) {
+	var downgrades []string
+	if w, max, ok := pcieLink(sample, "pcie.width", "pcie.maxWidth"); ok {
+		downgrades = append(downgrades, fmt.Sprintf("x%s instead of x%s", formatMetric(w), formatMetric(max)))
+	}
+	if generation {
+		if g, max, ok := pcieLink(sample, "pcie.generation", "pcie.maxGeneration"); ok {
+			downgrades = append(downgrades, fmt.Sprintf("gen%s instead of gen%s", formatMetric(g), formatMetric(max)))
+		}
+	}
+
+	if len(downgrades) == 0 {
+		return "", false
+	}
+	return fmt.Sprintf("PCIe link running at %s", strings.Join(downgrades, ", ")), true
+}
+
+// pcieLink returns the current and maximum value of a link property when the
+// former is below the latter.
+func pcieLink(sample map[string]float64, current, max string) (float64, float64, bool) {
+	v, ok := sample[current]
+	m, okMax := sample[max]
+	return v, m, ok && okMax && v < m
+}
+
+// watchPCIe samples the PCIe link of the devices every interval and reports
+// the devices whose link is downgraded until the context is cancelled.
+func watchPCIe(ctx context.Context, backend deviceBackend, devs []*Device, interval time.Duration, config pcieConfig, events chan<- healthEvent) {
+	sampleTelemetry(ctx, backend, devs, interval, telemetryPCIe, func(d *Device, sample map[string]float64, now time.Time) {
+		if reason, ok := pcieDowngrade(sample, config.Generation); ok {
+			sendUnhealthy(ctx, events, d, reason)
+		}
+	})
+}
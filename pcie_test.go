@@ -0,0 +1,39 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import "testing"
+
+func TestPCIeDowngrade(t *testing.T) {
+	link := func(width, maxWidth, gen, maxGen float64) map[string]float64 {
+		return map[string]float64{"pcie.width": width, "pcie.maxWidth": maxWidth, "pcie.generation": gen, "pcie.maxGeneration": maxGen}
+	}
+
+	tests := []struct {
+		name       string
+		sample     map[string]float64
+		generation bool
+		want       string // empty if the link is not downgraded
+	}{
+		{name: "full link", sample: link(16, 16, 3, 3)},
+		{name: "full link with the generation", sample: link(16, 16, 3, 3), generation: true},
+		{name: "narrow link", sample: link(8, 16, 3, 3), want: "PCIe link running at x8 instead of x16"},
+		{name: "narrow x1 link", sample: link(1, 16, 3, 3), generation: true, want: "PCIe link running at x1 instead of x16"},
+		// An idle GPU lowers the generation of its link to save power.
+		{name: "idle link", sample: link(16, 16, 1, 3)},
+		{name: "narrow idle link", sample: link(8, 16, 1, 3), want: "PCIe link running at x8 instead of x16"},
+		{name: "lower generation", sample: link(16, 16, 1, 3), generation: true, want: "PCIe link running at gen1 instead of gen3"},
+		{name: "both", sample: link(8, 16, 2, 4), generation: true, want: "PCIe link running at x8 instead of x16, gen2 instead of gen4"},
+		{name: "above the maximum", sample: link(16, 8, 4, 3), generation: true},
+		{name: "no link", sample: map[string]float64{}, generation: true},
+		{name: "no maximum", sample: map[string]float64{"pcie.width": 8, "pcie.generation": 1}, generation: true},
+		{name: "nil sample", generation: true},
+	}
+
+	for _, tt := range tests {
+		reason, downgraded := pcieDowngrade(tt.sample, tt.generation)
+		if downgraded != (tt.want != "") || reason != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, reason, downgraded, tt.want)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultProbeTimeout = time.Minute
+	// probeOutputSize is how much of the end of the output of a probe is
+	// kept.
+	probeOutputSize = 4096
+	// probeReasonSize bounds the output included in the health reasons.
+	probeReasonSize = 200
+)
+
+// execProbe is an external command, e.g. a diagnostic script, run on each
+// device every Interval, the interval of the probes check by default. The
+// device is passed through the DP_DEVICE_UUID, DP_DEVICE_INDEX,
+// DP_DEVICE_BUS_ID and DP_DEVICE_PATH environment variables and
+// NVIDIA_VISIBLE_DEVICES is set to its UUID.
+type execProbe struct {
+	Name     string        `yaml:"name"`
+	Command  []string      `yaml:"command"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// Healthy and Unhealthy are the exit codes meaning that the device is
+	// healthy, 0 by default, or unhealthy, 1 by default. Other exit codes
+	// and timeouts leave the health of the device unchanged.
+	Healthy   []int `yaml:"healthy"`
+	Unhealthy []int `yaml:"unhealthy"`
+	// Severity is either unhealthy, the default, or degraded.
+	Severity string `yaml:"severity"`
+}
+
+// probeResult is the outcome of a probe on a device.
+type probeResult string
+
+const (
+	probeHealthy   probeResult = "healthy"
+	probeUnhealthy probeResult = "unhealthy"
+	probeUnknown   probeResult = "unknown"
+)
+
+func validateProbes(probes []execProbe) error {
+	names := make(map[string]bool)
+	for i, p := range probes {
+		if p.Name == "" {
+			return fmt.Errorf("health.probes: probe %d has no name", i)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("health.probes: duplicate probe %q", p.Name)
+		}
+		names[p.Name] = true
+
+		if len(p.Command) == 0 {
+			return fmt.Errorf("health.probes: %s: no command", p.Name)
+		}
+		if p.Interval < 0 || p.Timeout < 0 {
+			return fmt.Errorf("health.probes: %s: negative duration", p.Name)
+		}
+		for _, c := range p.unhealthyCodes() {
+			if containsInt(p.healthyCodes(), c) {
+				return fmt.Errorf("health.probes: %s: exit code %d is both healthy and unhealthy", p.Name, c)
+			}
+		}
+		if p.Severity != "" && !validHealthAction(p.Severity) {
+			return fmt.Errorf("health.probes: %s: invalid severity %q", p.Name, p.Severity)
+		}
+	}
+	return nil
+}
+
+func (p execProbe) timeout() time.Duration {
+	if p.Timeout == 0 {
+		return defaultProbeTimeout
+	}
+	return p.Timeout
+}
+
+func (p execProbe) healthyCodes() []int {
+	if p.Healthy == nil {
+		return []int{0}
+	}
+	return p.Healthy
+}
+
+func (p execProbe) unhealthyCodes() []int {
+	if p.Unhealthy == nil {
+		return []int{1}
+	}
+	return p.Unhealthy
+}
+
+func containsInt(s []int, v int) bool {
+	for _, i := range s {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
+
+// run runs the probe on a device. It returns the result, a description of
+// how the probe exited and the end of its combined output.
+func (p execProbe) run(ctx context.Context, d *Device) (probeResult, string, string) {
+	cmd := exec.Command(p.Command[0], p.Command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"DP_DEVICE_UUID="+d.ID,
+		"DP_DEVICE_INDEX="+strconv.FormatUint(uint64(d.Index), 10),
+		"DP_DEVICE_BUS_ID="+d.BusID,
+		"DP_DEVICE_PATH="+d.Path,
+		"NVIDIA_VISIBLE_DEVICES="+d.ID,
+	)
+	out := &tailBuffer{size: probeOutputSize}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	// The probe runs in its own process group so that the processes it
+	// started are killed with it.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return probeUnknown, err.Error(), ""
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	timer := time.NewTimer(p.timeout())
+	defer timer.Stop()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-timer.C:
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return probeUnknown, fmt.Sprintf("timed out after %s", p.timeout()), out.String()
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return probeUnknown, "cancelled", out.String()
+	}
+
+	code := 0
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok || exitErr.ExitCode() < 0 {
+			return probeUnknown, err.Error(), out.String()
+		}
+		code = exitErr.ExitCode()
+	}
+
+	status := fmt.Sprintf("exit status %d", code)
+	switch {
+	case containsInt(p.healthyCodes(), code):
+		return probeHealthy, status, out.String()
+	case containsInt(p.unhealthyCodes(), code):
+		return probeUnhealthy, status, out.String()
+	}
+	return probeUnknown, status, out.String()
+}
+
+// tailBuffer keeps the last size bytes written to it.
+type tailBuffer struct {
+	size int
+	buf  []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.size {
+		b.buf = b.buf[len(b.buf)-b.size:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return string(b.buf)
+}
+
+// lastLine returns the last non-empty line of the output, truncated for the
+// health reasons.
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	line := strings.TrimSpace(lines[len(lines)-1])
+	if len(line) > probeReasonSize {
+		line = line[:probeReasonSize] + "..."
+	}
+	return line
+}
+
+// watchExecProbe runs the probe on each device every interval, unless the
+// probe has its own, and reports the devices it finds unhealthy until the
+// context is cancelled.
+func watchExecProbe(ctx context.Context, p execProbe, interval time.Duration, devs []*Device, events chan<- healthEvent) {
+	if p.Interval != 0 {
+		interval = p.Interval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, d := range devs {
+			result, status, output := p.run(ctx, d)
+			if ctx.Err() != nil {
+				return
+			}
+
+			if result == probeHealthy {
+				log.Printf("Probe %s on %s: %s.", p.Name, d.ID, status)
+				continue
+			}
+			log.Printf("Probe %s on %s: %s, result: %s. Output:\n%s", p.Name, d.ID, status, result, output)
+			if result == probeUnknown {
+				continue
+			}
+
+			reason := fmt.Sprintf("probe %s: %s", p.Name, status)
+			if line := lastLine(output); line != "" {
+				reason += ": " + line
+			}
+			sendHealthEvent(ctx, events, healthEvent{Device: d, Reason: reason, Degraded: p.Severity == healthActionDegraded, Probe: p.Name})
+		}
+	}
+}
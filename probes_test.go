@@ -0,0 +1,117 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// testScript writes a shell script to a temporary directory and returns its
+// path.
+func testScript(t *testing.T, script string) string {
+	path := filepath.Join(t.TempDir(), "probe.sh")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExecProbeRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		probe  execProbe
+		result probeResult
+		status string
+		output string
+	}{
+		{name: "healthy", script: "exit 0", result: probeHealthy, status: "exit status 0"},
+		{name: "unhealthy", script: "echo ECC errors >&2; exit 1", result: probeUnhealthy, status: "exit status 1", output: "ECC errors\n"},
+		{name: "unknown code", script: "exit 2", result: probeUnknown, status: "exit status 2"},
+		{
+			name:   "configured codes",
+			script: "exit 3",
+			probe:  execProbe{Healthy: []int{0, 2}, Unhealthy: []int{3}},
+			result: probeUnhealthy,
+			status: "exit status 3",
+		},
+		{
+			name:   "configured healthy code",
+			script: "exit 2",
+			probe:  execProbe{Healthy: []int{0, 2}, Unhealthy: []int{3}},
+			result: probeHealthy,
+			status: "exit status 2",
+		},
+		{
+			name:   "no longer unhealthy",
+			script: "exit 1",
+			probe:  execProbe{Unhealthy: []int{3}},
+			result: probeUnknown,
+			status: "exit status 1",
+		},
+		{
+			name:   "environment",
+			script: `echo "$DP_DEVICE_UUID $DP_DEVICE_INDEX $DP_DEVICE_BUS_ID $DP_DEVICE_PATH $NVIDIA_VISIBLE_DEVICES"`,
+			result: probeHealthy,
+			status: "exit status 0",
+			output: "GPU-a 1 0000:02:00.0 /dev/nvidia1 GPU-a\n",
+		},
+		{
+			name:   "timeout",
+			script: "echo started; sleep 10",
+			probe:  execProbe{Timeout: 100 * time.Millisecond},
+			result: probeUnknown,
+			status: "timed out after 100ms",
+			output: "started\n",
+		},
+		{name: "killed", script: "kill -9 $$", result: probeUnknown, status: "signal: killed"},
+	}
+
+	d := testDevice("GPU-a", 1, "")
+	for _, tt := range tests {
+		tt.probe.Name = tt.name
+		tt.probe.Command = []string{testScript(t, tt.script)}
+
+		start := time.Now()
+		result, status, output := tt.probe.run(context.Background(), d)
+		if result != tt.result || status != tt.status || output != tt.output {
+			t.Errorf("%s: got %s, %q, %q, want %s, %q, %q", tt.name, result, status, output, tt.result, tt.status, tt.output)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("%s: the probe ran for %s", tt.name, d)
+		}
+	}
+}
+
+func TestExecProbeOutput(t *testing.T) {
+	// The output is larger than what is kept of it.
+	probe := execProbe{Name: "output", Command: []string{testScript(t, `
+i=0
+while [ $i -lt 1000 ]; do
+	echo "line $i"
+	i=$((i + 1))
+done
+echo "$(printf 'x%.0s' $(seq 300))" >&2
+exit 1
+`)}}
+
+	result, _, output := probe.run(context.Background(), testDevice("GPU-a", 0, ""))
+	if result != probeUnhealthy {
+		t.Errorf("got %s, want %s", result, probeUnhealthy)
+	}
+	if len(output) != probeOutputSize {
+		t.Errorf("got %d bytes of output, want %d", len(output), probeOutputSize)
+	}
+	if !strings.Contains(output, "line 999\n") || strings.Contains(output, "line 0\n") {
+		t.Errorf("got output %q, want its end", output)
+	}
+	if want := strings.Repeat("x", probeReasonSize) + "..."; lastLine(output) != want {
+		t.Errorf("got last line %q, want %q", lastLine(output), want)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	procfsGPUsDir       = "proc/driver/nvidia/gpus"
+	procfsCheckInterval = 10 * time.Second
+)
+
+// procfsBackend discovers GPUs from the files exposed by the NVIDIA kernel
+// driver when NVML cannot be initialised. It runs in degraded mode: the only
+// health check available is that the device is still present on the node.
+type procfsBackend struct {
+	// root is the directory under which proc and dev are looked up.
+	root string
+}
+
+func (b *procfsBackend) Name() string {
+	return procfsBackendName
+}
+
+func (b *procfsBackend) Init() error {
+	if _, err := os.Stat(filepath.Join(b.root, procfsGPUsDir)); err != nil {
+		return err
+	}
+
+	log.Println("WARNING: running in degraded mode, GPUs are discovered from procfs and XIDs are not monitored.")
+	return nil
+}
+
+func (b *procfsBackend) Shutdown() error {
+	return nil
+}
+
+func (b *procfsBackend) Devices() ([]*Device, error) {
+	return getProcfsDevices(b.root)
+}
+
+// WatchHealth reports devices whose device node is missing.
+func (b *procfsBackend) WatchHealth(ctx context.Context, devs []*Device, unhealthy chan<- healthEvent) error {
+	ticker := time.NewTicker(procfsCheckInterval)
+	defer ticker.Stop()
+
+	reported := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		for _, d := range devs {
+			if err := b.Probe(d); err != nil {
+				if !reported[d.ID] {
+					log.Printf("%s. Marking it unhealthy.", err)
+				}
+				reported[d.ID] = true
+				sendUnhealthy(ctx, unhealthy, d, err.Error())
+				continue
+			}
+			delete(reported, d.ID)
+		}
+	}
+}
+
+// Probe checks that the device node of the device is accessible.
+func (b *procfsBackend) Probe(d *Device) error {
+	if _, err := os.Stat(filepath.Join(b.root, d.Path)); err != nil {
+		return fmt.Errorf("device node of %s is not accessible: %s", d.ID, err)
+	}
+	return nil
+}
+
+// Telemetry is not available in degraded mode.
+func (b *procfsBackend) Telemetry(d *Device, groups telemetryGroups) (map[string]float64, error) {
+	return nil, nil
+}
+
+// getProcfsDevices returns the GPUs listed in <root>/proc/driver/nvidia/gpus
+// which have a device node in <root>/dev.
+func getProcfsDevices(root string) ([]*Device, error) {
+	dirs, err := ioutil.ReadDir(filepath.Join(root, procfsGPUsDir))
+	if err != nil {
+		return nil, err
+	}
+
+	var devs []*Device
+	for _, dir := range dirs {
+		file := filepath.Join(root, procfsGPUsDir, dir.Name(), "information")
+		info, err := parseProcfsInformation(file)
+		if err != nil {
+			log.Printf("Warning: skipping GPU %s: %s", dir.Name(), err)
+			continue
+		}
+
+		minor, err := strconv.ParseUint(info["Device Minor"], 10, 32)
+		if err != nil {
+			log.Printf("Warning: skipping GPU %s: invalid device minor: %q", dir.Name(), info["Device Minor"])
+			continue
+		}
+
+		path := fmt.Sprintf("/dev/nvidia%d", minor)
+		if _, err := os.Stat(filepath.Join(root, path)); err != nil {
+			log.Printf("Warning: skipping GPU %s: %s", dir.Name(), err)
+			continue
+		}
+
+		// The UUID is only reported by recent drivers, the runtime also
+		// accepts device indexes which match the minor numbers.
+		id := info["GPU UUID"]
+		if !strings.HasPrefix(id, "GPU-") {
+			id = strconv.FormatUint(minor, 10)
+		}
+
+		devs = append(devs, &Device{
+			Device: pluginapi.Device{
+				ID:       id,
+				Health:   pluginapi.Healthy,
+				Topology: numaTopology(numaNode(root, info["Bus Location"])),
+			},
+			Index: uint(minor),
+			Path:  path,
+			Model: info["Model"],
+			BusID: info["Bus Location"],
+		})
+	}
+
+	sort.Slice(devs, func(i, j int) bool { return devs[i].Index < devs[j].Index })
+	return devs, nil
+}
+
+// parseProcfsInformation parses the "Key: value" lines of a GPU information
+// file.
+func parseProcfsInformation(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		info[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return info, s.Err()
+}
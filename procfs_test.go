@@ -0,0 +1,121 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// procfsDevice is the part of a discovered device checked by the procfs
+// tests.
+type procfsDevice struct {
+	id    string
+	index uint
+	path  string
+	model string
+	busID string
+	numa  int64
+}
+
+func TestGetProcfsDevices(t *testing.T) {
+	tests := []struct {
+		root string
+		want []procfsDevice
+	}{
+		{
+			root: "uuid",
+			want: []procfsDevice{
+				{"GPU-9a2c6e4e-0000-0000-0000-000000000000", 0, "/dev/nvidia0", "Tesla V100-SXM2-16GB", "0000:07:00.0", -1},
+				{"GPU-9a2c6e4e-0000-0000-0000-000000000001", 1, "/dev/nvidia1", "Tesla V100-SXM2-16GB", "0000:06:00.0", 1},
+			},
+		},
+		{
+			root: "no-uuid",
+			want: []procfsDevice{
+				{"0", 0, "/dev/nvidia0", "Tesla K80", "0000:02:00.0", -1},
+				{"1", 1, "/dev/nvidia1", "Tesla K80", "0000:03:00.0", -1},
+			},
+		},
+		{
+			root: "missing-dev",
+			want: []procfsDevice{
+				{"GPU-7f3b0000-0000-0000-0000-000000000000", 0, "/dev/nvidia0", "Tesla T4", "0000:06:00.0", -1},
+			},
+		},
+		{
+			root: "malformed",
+			want: []procfsDevice{
+				{"GPU-7f3b0000-0000-0000-0000-000000000005", 5, "/dev/nvidia5", "Tesla T4", "0000:05:00.0", -1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		devs, err := getProcfsDevices(filepath.Join("testdata", "procfs", tt.root))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.root, err)
+			continue
+		}
+
+		if len(devs) != len(tt.want) {
+			t.Errorf("%s: got %d devices, want %d", tt.root, len(devs), len(tt.want))
+			continue
+		}
+		for i, d := range devs {
+			numa := int64(-1)
+			if d.Device.Topology != nil {
+				numa = d.Device.Topology.Nodes[0].ID
+			}
+			got := procfsDevice{d.ID, d.Index, d.Path, d.Model, d.BusID, numa}
+			if got != tt.want[i] {
+				t.Errorf("%s: device %d is %+v, want %+v", tt.root, i, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestProcfsBackend(t *testing.T) {
+	b := &procfsBackend{root: filepath.Join("testdata", "procfs", "missing-dev")}
+	if err := b.Init(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := b.Probe(&Device{Path: "/dev/nvidia0"}); err != nil {
+		t.Errorf("unexpected probe error: %s", err)
+	}
+	if err := b.Probe(&Device{Path: "/dev/nvidia1"}); err == nil {
+		t.Errorf("expected a probe error for a missing device node")
+	}
+
+	b = &procfsBackend{root: filepath.Join("testdata", "procfs", "absent")}
+	if err := b.Init(); err == nil {
+		t.Errorf("expected an error without the procfs tree")
+	}
+	if _, err := b.Devices(); err == nil {
+		t.Errorf("expected a discovery error without the procfs tree")
+	}
+}
+
+func TestParseProcfsInformation(t *testing.T) {
+	info, err := parseProcfsInformation(filepath.Join("testdata", "procfs", "uuid", procfsGPUsDir, "0000:06:00.0", "information"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := map[string]string{
+		"Model":        "Tesla V100-SXM2-16GB",
+		"GPU UUID":     "GPU-9a2c6e4e-0000-0000-0000-000000000001",
+		"Bus Location": "0000:06:00.0",
+		"Device Minor": "1",
+		"Blacklisted":  "No",
+	}
+	for k, v := range want {
+		if info[k] != v {
+			t.Errorf("%s is %q, want %q", k, info[k], v)
+		}
+	}
+
+	if _, err := parseProcfsInformation(filepath.Join("testdata", "procfs", "malformed", procfsGPUsDir, "0000:04:00.0", "information")); err == nil {
+		t.Errorf("expected an error for a missing information file")
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// resourceClass advertises the devices selected by its filter under its own
+// resource name. A device belongs to the first class which selects it.
+type resourceClass struct {
+	Name    string        `yaml:"name"`
+	Devices deviceFilter  `yaml:"devices"`
+	Sharing sharingConfig `yaml:"sharing"`
+	Memory  memoryConfig  `yaml:"memory"`
+}
+
+// defaultResourceClasses advertises all the devices as nvidia.com/gpu.
+var defaultResourceClasses = []resourceClass{{Name: resourceName}}
+
+// socket returns the path of the socket serving the class. The default
+// resource keeps the historical socket name.
+func (c resourceClass) socket() string {
+	if c.Name == resourceName {
+		return serverSock
+	}
+	return pluginapi.DevicePluginPath + "nvidia-" + path.Base(c.Name) + ".sock"
+}
+
+func validateResourceClasses(classes []resourceClass) error {
+	names := make(map[string]bool)
+	sockets := make(map[string]bool)
+
+	for _, c := range classes {
+		parts := strings.Split(c.Name, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("resources: invalid resource name %q, expected <domain>/<name>", c.Name)
+		}
+		if names[c.Name] {
+			return fmt.Errorf("resources: duplicate resource name %q", c.Name)
+		}
+		if sockets[c.socket()] {
+			return fmt.Errorf("resources: resource name %q conflicts with another resource", c.Name)
+		}
+		if err := c.Devices.validate(); err != nil {
+			return fmt.Errorf("resources: %s: %v", c.Name, err)
+		}
+		if err := c.Memory.validate(); err != nil {
+			return fmt.Errorf("resources: %s: %v", c.Name, err)
+		}
+		if c.Memory.enabled() && c.Sharing.enabled() {
+			return fmt.Errorf("resources: %s: memory and sharing cannot be used together", c.Name)
+		}
+
+		names[c.Name] = true
+		sockets[c.socket()] = true
+	}
+
+	return nil
+}
+
+// classifyDevice returns the index of the class the device belongs to, or -1.
+func classifyDevice(classes []resourceClass, d *Device) int {
+	for i, c := range classes {
+		if c.Devices.reason(d) == "" {
+			return i
+		}
+	}
+	return -1
+}
+
+// classBackend only exposes the devices of a backend which belong to a
+// resource class. All the classes share the same underlying backend.
+type classBackend struct {
+	deviceBackend
+	classes []resourceClass
+	index   int
+}
+
+func newClassBackends(backend deviceBackend, classes []resourceClass) []*classBackend {
+	var backends []*classBackend
+	for i := range classes {
+		backends = append(backends, &classBackend{
+			deviceBackend: backend,
+			classes:       classes,
+			index:         i,
+		})
+	}
+	return backends
+}
+
+func (b *classBackend) class() resourceClass {
+	return b.classes[b.index]
+}
+
+func (b *classBackend) Devices() ([]*Device, error) {
+	all, err := b.deviceBackend.Devices()
+	if err != nil {
+		return nil, err
+	}
+
+	var devs []*Device
+	for _, d := range all {
+		if classifyDevice(b.classes, d) == b.index {
+			devs = append(devs, d)
+		}
+	}
+	return devs, nil
+}
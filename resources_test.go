@@ -0,0 +1,138 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestValidateResourceClasses(t *testing.T) {
+	tests := []struct {
+		name    string
+		classes []resourceClass
+		err     string
+	}{
+		{name: "default"},
+		{
+			name:    "valid",
+			classes: []resourceClass{{Name: "nvidia.com/v100", Devices: deviceFilter{Include: []deviceSelector{{Model: "Tesla V100*"}}}}, {Name: "nvidia.com/gpu"}},
+		},
+		// A device belongs to the first class which selects it.
+		{
+			name:    "overlapping classes",
+			classes: []resourceClass{{Name: "nvidia.com/gpu"}, {Name: "nvidia.com/t4", Devices: deviceFilter{Include: []deviceSelector{{Model: "Tesla T4"}}}}},
+		},
+		{name: "no domain", classes: []resourceClass{{Name: "gpu"}}, err: `invalid resource name "gpu"`},
+		{name: "empty name", classes: []resourceClass{{Name: "nvidia.com/"}}, err: `invalid resource name "nvidia.com/"`},
+		{name: "nested name", classes: []resourceClass{{Name: "nvidia.com/gpu/v100"}}, err: `invalid resource name "nvidia.com/gpu/v100"`},
+		{name: "duplicate name", classes: []resourceClass{{Name: "nvidia.com/gpu"}, {Name: "nvidia.com/gpu"}}, err: `duplicate resource name "nvidia.com/gpu"`},
+		{
+			name:    "socket collision",
+			classes: []resourceClass{{Name: "nvidia.com/v100"}, {Name: "example.com/v100"}},
+			err:     `resource name "example.com/v100" conflicts with another resource`,
+		},
+		{
+			name:    "invalid selector",
+			classes: []resourceClass{{Name: "nvidia.com/v100", Devices: deviceFilter{Include: []deviceSelector{{}}}}},
+			err:     "resources: nvidia.com/v100: devices.include: empty device selector",
+		},
+		{
+			name:    "memory and sharing",
+			classes: []resourceClass{{Name: "nvidia.com/gpu", Memory: memoryConfig{ChunkSize: 1024}, Sharing: sharingConfig{TimeSlicing: timeSlicingConfig{Replicas: 2}}}},
+			err:     "memory and sharing cannot be used together",
+		},
+	}
+
+	for _, tt := range tests {
+		err := validateResourceClasses(tt.classes)
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestResourceClassSocket(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: resourceName, want: serverSock},
+		{name: "nvidia.com/v100", want: pluginapi.DevicePluginPath + "nvidia-v100.sock"},
+		{name: "example.com/gpu", want: pluginapi.DevicePluginPath + "nvidia-gpu.sock"},
+	}
+
+	for _, tt := range tests {
+		if got := (resourceClass{Name: tt.name}).socket(); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyDevice(t *testing.T) {
+	v100 := testDevice("GPU-a", 0, pluginapi.Healthy)
+	v100.Model = "Tesla V100-SXM2-16GB"
+	t4 := testDevice("GPU-b", 1, pluginapi.Healthy)
+	t4.Model = "Tesla T4"
+	a100 := testDevice("GPU-c", 2, pluginapi.Healthy)
+	a100.Model = "A100-SXM4-40GB"
+
+	model := func(name, pattern string) resourceClass {
+		return resourceClass{Name: name, Devices: deviceFilter{Include: []deviceSelector{{Model: pattern}}}}
+	}
+	tests := []struct {
+		name    string
+		classes []resourceClass
+		want    []int // class of v100, t4 and a100
+	}{
+		{name: "default", classes: defaultResourceClasses, want: []int{0, 0, 0}},
+		{name: "by model", classes: []resourceClass{model("nvidia.com/v100", "Tesla V100*"), model("nvidia.com/t4", "Tesla T4")}, want: []int{0, 1, -1}},
+		{name: "catch-all last", classes: []resourceClass{model("nvidia.com/t4", "Tesla T4"), {Name: "nvidia.com/gpu"}}, want: []int{1, 0, 1}},
+		{name: "first class wins", classes: []resourceClass{{Name: "nvidia.com/gpu"}, model("nvidia.com/t4", "Tesla T4")}, want: []int{0, 0, 0}},
+		{
+			name:    "excluded",
+			classes: []resourceClass{{Name: "nvidia.com/gpu", Devices: deviceFilter{Exclude: []deviceSelector{{UUID: "GPU-c"}}}}},
+			want:    []int{0, 0, -1},
+		},
+	}
+
+	for _, tt := range tests {
+		var got []int
+		for _, d := range []*Device{v100, t4, a100} {
+			got = append(got, classifyDevice(tt.classes, d))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got classes %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClassBackends(t *testing.T) {
+	b := newFakeBackend("GPU-a", "GPU-b", "GPU-c")
+	classes := []resourceClass{
+		{Name: "nvidia.com/first", Devices: deviceFilter{Include: []deviceSelector{{UUID: "GPU-a"}, {UUID: "GPU-b"}}}},
+		{Name: "nvidia.com/second", Devices: deviceFilter{Include: []deviceSelector{{UUID: "GPU-b"}}}},
+		{Name: "nvidia.com/gpu"},
+	}
+	want := [][]string{{"GPU-a", "GPU-b"}, nil, {"GPU-c"}}
+
+	for i, cb := range newClassBackends(b, classes) {
+		devs, err := cb.Devices()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", cb.class().Name, err)
+		}
+		var got []string
+		for _, d := range devs {
+			got = append(got, d.ID)
+		}
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("%s: got %v, want %v", cb.class().Name, got, want[i])
+		}
+	}
+}
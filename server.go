@@ -9,44 +9,98 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
-	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 const (
 	resourceName           = "nvidia.com/gpu"
 	serverSock             = pluginapi.DevicePluginPath + "nvidia.sock"
 	envDisableHealthChecks = "DP_DISABLE_HEALTHCHECKS"
-	allHealthChecks        = "xids"
+
+	envDiscoveryInterval     = "DP_DISCOVERY_INTERVAL"
+	defaultDiscoveryInterval = 30 * time.Second
+	watchRetryDelay          = 5 * time.Second
 )
 
 // NvidiaDevicePlugin implements the Kubernetes device plugin API
 type NvidiaDevicePlugin struct {
-	devs   []*pluginapi.Device
-	socket string
+	pluginapi.UnimplementedDevicePluginServer
+
+	backend      deviceBackend
+	resourceName string
+	sharing      sharingConfig
+	memory       memoryConfig
+	healthConfig healthConfig
+	node         *nodeState
+	store        *healthStore
+	devs         []*Device
+	socket       string
+
+	// mu protects devs, their health and states.
+	mu     sync.RWMutex
+	states map[string]*deviceHealth
 
-	stop   chan interface{}
-	health chan *pluginapi.Device
+	stop    chan interface{}
+	changed chan struct{}
 
 	server *grpc.Server
 }
 
 // NewNvidiaDevicePlugin returns an initialized NvidiaDevicePlugin
-func NewNvidiaDevicePlugin() *NvidiaDevicePlugin {
-	return &NvidiaDevicePlugin{
-		devs:   getDevices(),
-		socket: serverSock,
+func NewNvidiaDevicePlugin(class resourceClass, health healthConfig, node *nodeState, store *healthStore, backend deviceBackend) (*NvidiaDevicePlugin, error) {
+	devs, err := backend.Devices()
+	if err != nil {
+		return nil, err
+	}
 
-		stop:   make(chan interface{}),
-		health: make(chan *pluginapi.Device),
+	m := &NvidiaDevicePlugin{
+		backend:      backend,
+		resourceName: class.Name,
+		sharing:      class.Sharing,
+		memory:       class.Memory,
+		healthConfig: health,
+		node:         node,
+		store:        store,
+		devs:         devs,
+		socket:       class.socket(),
+		states:       make(map[string]*deviceHealth),
+
+		stop:    make(chan interface{}),
+		changed: make(chan struct{}, 1),
+	}
+	m.restoreHealth(m.devs)
+	m.reportHealth()
+	return m, nil
+}
+
+// restoreHealth restores the persisted health of the devices, m.mu must be
+// held.
+func (m *NvidiaDevicePlugin) restoreHealth(devs []*Device) {
+	for _, d := range devs {
+		r, ok := m.store.restore(d.ID)
+		if !ok {
+			continue
+		}
+
+		h := &deviceHealth{state: r.State, reason: r.Reason, lastEvent: r.LastEvent}
+		m.states[d.ID] = h
+		m.setHealth(d, h)
+		log.Printf("Device %s: restored %s (%s).", d.ID, h.state, h.reason)
+		m.node.transition(healthTransition{Device: d.ID, From: healthStateHealthy, To: h.state, Reason: h.reason, Restored: true})
+
+		if r.RebootRequired {
+			m.node.requireReboot(healthTransition{Device: d.ID, From: h.state, To: h.state, Reason: r.Reason, Restored: true})
+		}
 	}
 }
 
 func (m *NvidiaDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
-	return &pluginapi.DevicePluginOptions{}, nil
+	return &pluginapi.DevicePluginOptions{GetPreferredAllocationAvailable: true}, nil
 }
 
 // dial establishes the gRPC communication with the registered device plugin.
@@ -107,62 +161,269 @@ func (m *NvidiaDevicePlugin) Stop() error {
 	return m.cleanup()
 }
 
-// Register registers the device plugin for the given resourceName with Kubelet.
-func (m *NvidiaDevicePlugin) Register(kubeletEndpoint, resourceName string) error {
+// Register registers the device plugin for the given resourceName with Kubelet,
+// using the first supported API version the kubelet accepts. It returns that
+// version.
+func (m *NvidiaDevicePlugin) Register(kubeletEndpoint, resourceName string) (string, error) {
 	conn, err := dial(kubeletEndpoint, 5*time.Second)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer conn.Close()
 
-	client := pluginapi.NewRegistrationClient(conn)
-	reqt := &pluginapi.RegisterRequest{
-		Version:      pluginapi.Version,
-		Endpoint:     path.Base(m.socket),
-		ResourceName: resourceName,
+	options, err := m.GetDevicePluginOptions(context.Background(), &pluginapi.Empty{})
+	if err != nil {
+		return "", err
 	}
 
-	_, err = client.Register(context.Background(), reqt)
-	if err != nil {
-		return err
+	client := pluginapi.NewRegistrationClient(conn)
+	for _, v := range pluginapi.SupportedVersions {
+		reqt := &pluginapi.RegisterRequest{
+			Version:      v,
+			Endpoint:     path.Base(m.socket),
+			ResourceName: resourceName,
+			Options:      options,
+		}
+
+		_, err = client.Register(context.Background(), reqt)
+		if err == nil {
+			return v, nil
+		}
+		log.Printf("Kubelet did not accept device plugin API %s: %s", v, err)
 	}
-	return nil
+	return "", err
 }
 
 // ListAndWatch lists devices and update that list according to the health status
 func (m *NvidiaDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	s.Send(&pluginapi.ListAndWatchResponse{Devices: m.devs})
+	s.Send(m.listAndWatchResponse())
 
 	for {
 		select {
 		case <-m.stop:
 			return nil
-		case d := <-m.health:
-			// FIXME: there is no way to recover from the Unhealthy state.
-			d.Health = pluginapi.Unhealthy
-			s.Send(&pluginapi.ListAndWatchResponse{Devices: m.devs})
+		case <-m.changed:
+			s.Send(m.listAndWatchResponse())
+		}
+	}
+}
+
+func (m *NvidiaDevicePlugin) listAndWatchResponse() *pluginapi.ListAndWatchResponse {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.memory.enabled() {
+		return &pluginapi.ListAndWatchResponse{Devices: memoryChunks(m.devs, m.memory)}
+	}
+
+	var devs []*pluginapi.Device
+	for _, d := range apiDevices(m.devs) {
+		devs = append(devs, &pluginapi.Device{ID: d.ID, Health: d.Health, Topology: d.Topology})
+	}
+
+	if m.sharing.enabled() {
+		devs = replicateDevices(devs, m.sharing.TimeSlicing.Replicas)
+	}
+	return &pluginapi.ListAndWatchResponse{Devices: devs}
+}
+
+// deviceHealth returns the health state machine of a device, m.mu must be
+// held.
+func (m *NvidiaDevicePlugin) deviceHealth(d *Device) *deviceHealth {
+	h, ok := m.states[d.ID]
+	if !ok {
+		h = newDeviceHealth()
+		m.states[d.ID] = h
+	}
+	return h
+}
+
+// handleHealthEvent updates the health of a device. It returns whether the
+// health advertised to the Kubelet changed.
+func (m *NvidiaDevicePlugin) handleHealthEvent(e healthEvent) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// The event refers to the copy of the device held by the health check.
+	d := findDevice(m.devs, e.Device.ID)
+	if d == nil {
+		return false
+	}
+	h := m.deviceHealth(d)
+	from := h.state
+	m.node.healthEvent(e)
+	if h.event(time.Now(), e.Reason, e.Degraded) {
+		log.Printf("Device %s: %s -> %s (%s).", d.ID, from, h.state, h.reason)
+		m.node.transition(healthTransition{Device: d.ID, From: from, To: h.state, Reason: h.reason, XID: e.XID})
+	}
+	if e.RebootRequired {
+		m.node.requireReboot(healthTransition{Device: d.ID, From: h.state, To: h.state, Reason: e.Reason, XID: e.XID})
+	}
+	m.store.save(d.ID, h, e.RebootRequired)
+	if !m.setHealth(d, h) {
+		return false
+	}
+	m.reportHealth()
+	return true
+}
+
+// reportHealth reports the health advertised for the devices to the node,
+// m.mu must be held.
+func (m *NvidiaDevicePlugin) reportHealth() {
+	gpus := make(map[string]string)
+	for _, d := range m.devs {
+		reason := ""
+		if d.Health != pluginapi.Healthy {
+			reason = "device is missing"
+			if h, ok := m.states[d.ID]; ok && h.reason != "" {
+				reason = h.reason
+			}
 		}
+		gpus[d.ID] = reason
 	}
+	m.node.report(gpus)
 }
 
-func (m *NvidiaDevicePlugin) unhealthy(dev *pluginapi.Device) {
-	m.health <- dev
+// setHealth advertises the health of the device according to its state, m.mu
+// must be held. It returns whether the advertised health changed.
+func (m *NvidiaDevicePlugin) setHealth(d *Device, h *deviceHealth) bool {
+	health := pluginapi.Unhealthy
+	if h.healthy() {
+		health = pluginapi.Healthy
+	}
+
+	if d.Health == health {
+		return false
+	}
+	d.Health = health
+	return true
+}
+
+// recoverDevices lets the unhealthy devices which are present on the node
+// recover. It returns whether the health of a device changed.
+func (m *NvidiaDevicePlugin) recoverDevices(present []*Device) bool {
+	candidates, probed := m.recoveryCandidates(present, time.Now())
+	if len(candidates) == 0 {
+		return false
+	}
+
+	// The probes go through the NVML watchdog and can take up to its
+	// timeout, they run without holding the lock.
+	probes := make(map[string]error)
+	for _, d := range probed {
+		err := m.backend.Probe(d)
+		if err != nil {
+			log.Printf("Device %s failed its recovery probe: %s", d.ID, err)
+		}
+		probes[d.ID] = err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	changed := false
+	for _, c := range candidates {
+		d := findDevice(m.devs, c.ID)
+		if d == nil {
+			continue
+		}
+		h := m.deviceHealth(d)
+		from := h.state
+		// An event reported during the probe starts a new quiet period.
+		if !h.recover(now, m.healthConfig.Recovery, probes[d.ID]) {
+			continue
+		}
+		log.Printf("Device %s: %s -> %s.", d.ID, from, h.state)
+		m.node.transition(healthTransition{Device: d.ID, From: from, To: h.state, Reason: h.reason})
+		m.store.save(d.ID, h, false)
+
+		if m.setHealth(d, h) {
+			changed = true
+		}
+	}
+	if changed {
+		m.reportHealth()
+	}
+	return changed
+}
+
+// recoveryCandidates returns the present devices which were quiet for the
+// recovery period, and the ones among them which must be probed first. The
+// quiet period of the devices which were unhealthy when discovered or
+// disappeared for a while starts now.
+func (m *NvidiaDevicePlugin) recoveryCandidates(present []*Device, now time.Time) ([]*Device, []*Device) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var candidates, probed []*Device
+	for _, p := range present {
+		d := findDevice(m.devs, p.ID)
+		if d == nil {
+			continue
+		}
+		h := m.deviceHealth(d)
+		if d.Health == pluginapi.Healthy && h.state == healthStateHealthy {
+			continue
+		}
+
+		if d.Health != pluginapi.Healthy && h.healthy() {
+			from := h.state
+			if h.event(now, "device was missing or unhealthy when discovered", false) {
+				m.node.transition(healthTransition{Device: d.ID, From: from, To: h.state, Reason: h.reason})
+			}
+		}
+
+		if !h.quiet(now, m.healthConfig.Recovery) {
+			continue
+		}
+		candidates = append(candidates, p)
+		if m.healthConfig.Recovery.Probe && h.state != healthStateDegraded {
+			probed = append(probed, p)
+		}
+	}
+	return candidates, probed
 }
 
 // Allocate which return list of devices.
 func (m *NvidiaDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
-	devs := m.devs
+	m.mu.RLock()
+	devs := copyDevices(m.devs)
+	m.mu.RUnlock()
+
 	responses := pluginapi.AllocateResponse{}
 	for _, req := range reqs.ContainerRequests {
+		if m.memory.enabled() {
+			envs, err := allocateMemory(devs, m.memory, req.DevicesIds)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allocation request: %v", err)
+			}
+
+			responses.ContainerResponses = append(responses.ContainerResponses, &pluginapi.ContainerAllocateResponse{Envs: envs})
+			continue
+		}
+
+		ids, err := m.physicalDeviceIDs(req.DevicesIds)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allocation request: %v", err)
+		}
+
+		for _, id := range ids {
+			if !deviceExists(devs, id) {
+				return nil, fmt.Errorf("invalid allocation request: unknown device: %s", id)
+			}
+		}
+
 		response := pluginapi.ContainerAllocateResponse{
 			Envs: map[string]string{
-				"NVIDIA_VISIBLE_DEVICES": strings.Join(req.DevicesIDs, ","),
+				"NVIDIA_VISIBLE_DEVICES": strings.Join(ids, ","),
 			},
 		}
 
-		for _, id := range req.DevicesIDs {
-			if !deviceExists(devs, id) {
-				return nil, fmt.Errorf("invalid allocation request: unknown device: %s", id)
+		if m.sharing.enabled() {
+			response.Envs[envGPUSharing] = timeSlicingStrategy
+			response.Annotations = map[string]string{
+				annotationGPUSharing: timeSlicingStrategy,
 			}
 		}
 
@@ -172,6 +433,65 @@ func (m *NvidiaDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.Alloc
 	return &responses, nil
 }
 
+// GetPreferredAllocation returns the best connected devices out of the
+// available ones, or the memory chunks of a single GPU.
+func (m *NvidiaDevicePlugin) GetPreferredAllocation(ctx context.Context, reqs *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	m.mu.RLock()
+	t := newTopology(m.devs)
+	m.mu.RUnlock()
+
+	responses := pluginapi.PreferredAllocationResponse{}
+	for _, req := range reqs.ContainerRequests {
+		var ids []string
+		var err error
+
+		switch {
+		case m.memory.enabled():
+			ids, err = preferredMemoryChunks(req.AvailableDeviceIDs, req.MustIncludeDeviceIDs, int(req.AllocationSize))
+		case m.sharing.enabled():
+			var rt topology
+			rt, err = replicaTopology(t, req.AvailableDeviceIDs)
+			if err == nil {
+				ids, err = preferredDevices(rt, req.AvailableDeviceIDs, req.MustIncludeDeviceIDs, int(req.AllocationSize))
+			}
+		default:
+			ids, err = preferredDevices(t, req.AvailableDeviceIDs, req.MustIncludeDeviceIDs, int(req.AllocationSize))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid preferred allocation request: %v", err)
+		}
+
+		responses.ContainerResponses = append(responses.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{DeviceIDs: ids})
+	}
+
+	return &responses, nil
+}
+
+// physicalDeviceIDs translates the allocated device IDs to the IDs of the
+// GPUs, in order and without duplicates.
+func (m *NvidiaDevicePlugin) physicalDeviceIDs(allocated []string) ([]string, error) {
+	if !m.sharing.enabled() {
+		return allocated, nil
+	}
+
+	var ids []string
+	seen := make(map[string]bool)
+	for _, r := range allocated {
+		id, i, err := parseReplicaID(r)
+		if err != nil {
+			return nil, err
+		}
+		if i >= m.sharing.TimeSlicing.Replicas {
+			return nil, fmt.Errorf("unknown device: %s", r)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
 func (m *NvidiaDevicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
 	return &pluginapi.PreStartContainerResponse{}, nil
 }
@@ -185,17 +505,90 @@ func (m *NvidiaDevicePlugin) cleanup() error {
 }
 
 func (m *NvidiaDevicePlugin) healthcheck() {
-	disableHealthChecks := strings.ToLower(os.Getenv(envDisableHealthChecks))
-	if disableHealthChecks == "all" {
-		disableHealthChecks = allHealthChecks
+	config := m.healthConfig
+	telemetry := newTelemetryChecker(config.Telemetry.Rules)
+	nvlinks := newNVLinkChecker(config.NVLink)
+	filter := newCheckFilter(config)
+
+	ticker := time.NewTicker(discoveryInterval())
+	defer ticker.Stop()
+
+	var events chan healthEvent
+	watchErrs := make(chan error, 1)
+	cancel := func() {}
+	watch := func(devs []*Device) {
+		cancel()
+
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		events = make(chan healthEvent)
+
+		// start runs a check if it is enabled, tagging its events with
+		// its name.
+		start := func(name string, run func(interval time.Duration, events chan<- healthEvent)) {
+			check := config.check(name)
+			if !check.enabled() {
+				return
+			}
+
+			c := make(chan healthEvent)
+			go run(check.Interval, c)
+			go func(events chan<- healthEvent) {
+				for {
+					select {
+					case e := <-c:
+						e.Check = name
+						sendHealthEvent(ctx, events, e)
+					case <-ctx.Done():
+						return
+					}
+				}
+			}(events)
+		}
+
+		start(checkXIDs, func(_ time.Duration, events chan<- healthEvent) {
+			if err := m.backend.WatchHealth(ctx, devs, events); err != nil {
+				watchErrs <- err
+			}
+		})
+		if config.Telemetry.enabled() {
+			start(checkTelemetry, func(interval time.Duration, events chan<- healthEvent) {
+				watchTelemetry(ctx, m.backend, devs, interval, telemetry, events)
+			})
+		}
+		start(checkPCIe, func(interval time.Duration, events chan<- healthEvent) {
+			watchPCIe(ctx, m.backend, devs, interval, config.PCIe, events)
+		})
+		start(checkRetiredPages, func(interval time.Duration, events chan<- healthEvent) {
+			watchRetiredPages(ctx, m.backend, devs, interval, events)
+		})
+		start(checkNVLink, func(interval time.Duration, events chan<- healthEvent) {
+			watchNVLinks(ctx, m.backend, devs, interval, nvlinks, events)
+		})
+		for _, p := range config.Probes {
+			p := p
+			start(checkProbes, func(interval time.Duration, events chan<- healthEvent) {
+				watchExecProbe(ctx, p, interval, devs, events)
+			})
+		}
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	var retry <-chan time.Time
+	present, _, err := m.rediscover()
+	if err == nil {
+		watch(present)
+	} else {
+		// The devices discovered when the plugin was created.
+		present = m.presentDevices(m.devs)
+		m.backendFailed(present, err)
+		retry = time.After(watchRetryDelay)
+	}
 
-	var xids chan *pluginapi.Device
-	if !strings.Contains(disableHealthChecks, "xids") {
-		xids = make(chan *pluginapi.Device)
-		go watchXIDs(ctx, m.devs, xids)
+	var recovery <-chan time.Time
+	if m.healthConfig.Recovery.enabled() {
+		recoveryTicker := time.NewTicker(recoveryCheckInterval)
+		defer recoveryTicker.Stop()
+		recovery = recoveryTicker.C
 	}
 
 	for {
@@ -203,12 +596,123 @@ func (m *NvidiaDevicePlugin) healthcheck() {
 		case <-m.stop:
 			cancel()
 			return
-		case dev := <-xids:
-			m.unhealthy(dev)
+		case e := <-events:
+			if e, ok := filter.filter(e, time.Now()); ok && m.handleHealthEvent(e) {
+				m.notifyChanged()
+			}
+		case err := <-watchErrs:
+			log.Printf("Health watcher failed: %s, rediscovering devices in %s.", err, watchRetryDelay)
+			m.backendFailed(present, err)
+			retry = time.After(watchRetryDelay)
+		case <-retry:
+			if discovered, _, err := m.rediscover(); err == nil {
+				present = discovered
+				retry = nil
+				watch(present)
+			} else {
+				m.backendFailed(present, err)
+				retry = time.After(watchRetryDelay)
+			}
+		case <-ticker.C:
+			if discovered, changed, err := m.rediscover(); err == nil {
+				present = discovered
+				if changed && retry == nil {
+					watch(present)
+				}
+			} else {
+				m.backendFailed(present, err)
+			}
+		case <-recovery:
+			if m.recoverDevices(present) {
+				m.notifyChanged()
+			}
 		}
 	}
 }
 
+// backendFailed reports the present devices unhealthy when the backend does
+// not respond anymore, whichever health checks are enabled. They are reported
+// again at every retry until the backend recovers.
+func (m *NvidiaDevicePlugin) backendFailed(present []*Device, err error) {
+	if err != errNVMLHung {
+		return
+	}
+
+	changed := false
+	for _, d := range present {
+		if m.handleHealthEvent(healthEvent{Device: d, Reason: err.Error()}) {
+			changed = true
+		}
+	}
+	if changed {
+		m.notifyChanged()
+	}
+}
+
+// rediscover refreshes the advertised devices and notifies ListAndWatch when
+// they changed. It returns the devices currently present on the node.
+func (m *NvidiaDevicePlugin) rediscover() ([]*Device, bool, error) {
+	discovered, err := m.backend.Devices()
+	if err != nil {
+		log.Printf("Could not rediscover devices: %s", err)
+		return nil, false, err
+	}
+
+	m.mu.Lock()
+	devs, changed := mergeDevices(m.devs, discovered)
+	// The hot-added devices are appended to the known ones.
+	m.restoreHealth(devs[len(m.devs):])
+	m.devs = devs
+	if changed {
+		m.reportHealth()
+	}
+	m.mu.Unlock()
+	m.store.expireUnknown(time.Now())
+
+	if changed {
+		m.notifyChanged()
+	}
+
+	return m.presentDevices(discovered), changed, nil
+}
+
+// notifyChanged makes ListAndWatch send the devices again.
+func (m *NvidiaDevicePlugin) notifyChanged() {
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+}
+
+// presentDevices returns copies of the advertised devices which were
+// discovered, for the health checks.
+func (m *NvidiaDevicePlugin) presentDevices(discovered []*Device) []*Device {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var devs []*Device
+	for _, d := range m.devs {
+		if deviceExists(discovered, d.ID) {
+			devs = append(devs, d)
+		}
+	}
+	return copyDevices(devs)
+}
+
+func discoveryInterval() time.Duration {
+	v := os.Getenv(envDiscoveryInterval)
+	if v == "" {
+		return defaultDiscoveryInterval
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Warning: invalid %s %q, using %s.", envDiscoveryInterval, v, defaultDiscoveryInterval)
+		return defaultDiscoveryInterval
+	}
+	return d
+}
+
 // Serve starts the gRPC server and register the device plugin to Kubelet
 func (m *NvidiaDevicePlugin) Serve() error {
 	err := m.Start()
@@ -218,13 +722,13 @@ func (m *NvidiaDevicePlugin) Serve() error {
 	}
 	log.Println("Starting to serve on", m.socket)
 
-	err = m.Register(pluginapi.KubeletSocket, resourceName)
+	version, err := m.Register(pluginapi.KubeletSocket, m.resourceName)
 	if err != nil {
 		log.Printf("Could not register device plugin: %s", err)
 		m.Stop()
 		return err
 	}
-	log.Println("Registered device plugin with Kubelet")
+	log.Printf("Registered device plugin for %s with Kubelet using API %s", m.resourceName, version)
 
 	return nil
 }
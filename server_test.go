@@ -0,0 +1,360 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// fakeKubelet is a kubelet registration server accepting the given API
+// versions.
+type fakeKubelet struct {
+	pluginapi.UnimplementedRegistrationServer
+
+	versions []string
+
+	mu       sync.Mutex
+	requests []*pluginapi.RegisterRequest
+}
+
+func (k *fakeKubelet) Register(ctx context.Context, r *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.requests = append(k.requests, r)
+	for _, v := range k.versions {
+		if r.Version == v {
+			return &pluginapi.Empty{}, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported API version %s", r.Version)
+}
+
+// serve starts the registration server on a socket of dir and returns the
+// socket path.
+func (k *fakeKubelet) serve(t *testing.T, dir string) string {
+	socket := filepath.Join(dir, "kubelet.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("could not listen on %s: %s", socket, err)
+	}
+
+	s := grpc.NewServer()
+	pluginapi.RegisterRegistrationServer(s, k)
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	return socket
+}
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []string
+		want     string
+		err      bool
+	}{
+		{name: "v1beta1", versions: []string{"v1beta1"}, want: "v1beta1"},
+		{name: "newer kubelet", versions: []string{"v1", "v1beta1"}, want: "v1beta1"},
+		{name: "unsupported", versions: []string{"v1"}, err: true},
+	}
+
+	for _, tt := range tests {
+		dir := t.TempDir()
+		kubelet := &fakeKubelet{versions: tt.versions}
+		socket := kubelet.serve(t, dir)
+
+		m := &NvidiaDevicePlugin{socket: filepath.Join(dir, "nvidia.sock")}
+		version, err := m.Register(socket, resourceName)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, registered with %s", tt.name, version)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+		} else if version != tt.want {
+			t.Errorf("%s: registered with %s, want %s", tt.name, version, tt.want)
+		}
+
+		// Only the published versions are offered to the kubelet.
+		if len(kubelet.requests) != len(pluginapi.SupportedVersions) {
+			t.Errorf("%s: got %d registration requests, want %d", tt.name, len(kubelet.requests), len(pluginapi.SupportedVersions))
+			continue
+		}
+		for i, r := range kubelet.requests {
+			if r.Version != pluginapi.SupportedVersions[i] {
+				t.Errorf("%s: request %d has version %s, want %s", tt.name, i, r.Version, pluginapi.SupportedVersions[i])
+			}
+			if r.Endpoint != "nvidia.sock" || r.ResourceName != resourceName {
+				t.Errorf("%s: request %d is for %s on %s", tt.name, i, r.ResourceName, r.Endpoint)
+			}
+			if r.Options == nil || !r.Options.GetPreferredAllocationAvailable {
+				t.Errorf("%s: request %d does not advertise GetPreferredAllocation", tt.name, i)
+			}
+		}
+	}
+}
+
+func TestRegisterWithoutKubelet(t *testing.T) {
+	dir := t.TempDir()
+	m := &NvidiaDevicePlugin{socket: filepath.Join(dir, "nvidia.sock")}
+	if _, err := m.Register(filepath.Join(dir, "kubelet.sock"), resourceName); err == nil {
+		t.Errorf("expected an error without a kubelet")
+	}
+}
+
+// fakeBackend discovers the given devices, or fails with err, and reports the
+// health events sent to events. The devices are probed with probe, if set.
+type fakeBackend struct {
+	events chan healthEvent
+	probe  func(d *Device) error
+
+	mu   sync.Mutex
+	devs []string
+	err  error
+}
+
+func newFakeBackend(devs ...string) *fakeBackend {
+	return &fakeBackend{events: make(chan healthEvent), devs: devs}
+}
+
+func (b *fakeBackend) Name() string    { return "fake" }
+func (b *fakeBackend) Init() error     { return nil }
+func (b *fakeBackend) Shutdown() error { return nil }
+
+func (b *fakeBackend) Devices() ([]*Device, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return nil, b.err
+	}
+	var devs []*Device
+	for i, id := range b.devs {
+		devs = append(devs, &Device{Device: pluginapi.Device{ID: id, Health: pluginapi.Healthy}, Index: uint(i)})
+	}
+	return devs, nil
+}
+
+func (b *fakeBackend) fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.err = err
+}
+
+func (b *fakeBackend) WatchHealth(ctx context.Context, devs []*Device, events chan<- healthEvent) error {
+	for {
+		select {
+		case e := <-b.events:
+			for _, d := range devs {
+				if d.ID == e.Device.ID {
+					e.Device = d
+					sendHealthEvent(ctx, events, e)
+				}
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (b *fakeBackend) Probe(d *Device) error {
+	if b.probe == nil {
+		return nil
+	}
+	return b.probe(d)
+}
+
+func (b *fakeBackend) Telemetry(d *Device, groups telemetryGroups) (map[string]float64, error) {
+	return nil, nil
+}
+
+func newTestPlugin(t *testing.T, b deviceBackend) *NvidiaDevicePlugin {
+	j := newJournal(journalConfig{Enabled: new(bool)})
+	node := newNodeState(healthConfig{}, j, nil, nil, nil)
+	store := &healthStore{devices: make(map[string]healthRecord)}
+	m, err := NewNvidiaDevicePlugin(resourceClass{Name: resourceName}, healthConfig{}, node, store, b)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return m
+}
+
+// waitChanged waits for the plugin to notify ListAndWatch of a change.
+func waitChanged(t *testing.T, m *NvidiaDevicePlugin, timeout time.Duration) {
+	select {
+	case <-m.changed:
+	case <-time.After(timeout):
+		t.Fatalf("the change was not notified")
+	}
+}
+
+// deviceHealthOf returns the health advertised for a device.
+func (m *NvidiaDevicePlugin) deviceHealthOf(id string) string {
+	for _, d := range m.listAndWatchResponse().Devices {
+		if d.ID == id {
+			return d.Health
+		}
+	}
+	return ""
+}
+
+func TestHealthcheckAppliesEvents(t *testing.T) {
+	b := newFakeBackend("GPU-a", "GPU-b")
+	m := newTestPlugin(t, b)
+	go m.healthcheck()
+	defer close(m.stop)
+
+	// No ListAndWatch stream consumes the events, they are applied anyway.
+	for _, id := range []string{"GPU-a", "GPU-b"} {
+		b.events <- healthEvent{Device: &Device{Device: pluginapi.Device{ID: id}}, Reason: "XID 48", XID: 48}
+		waitChanged(t, m, 5*time.Second)
+		if h := m.deviceHealthOf(id); h != pluginapi.Unhealthy {
+			t.Errorf("%s is %s, want %s", id, h, pluginapi.Unhealthy)
+		}
+	}
+}
+
+func TestNewNvidiaDevicePluginError(t *testing.T) {
+	b := newFakeBackend("GPU-a")
+	b.fail(errNVMLTimeout)
+
+	j := newJournal(journalConfig{Enabled: new(bool)})
+	node := newNodeState(healthConfig{}, j, nil, nil, nil)
+	store := &healthStore{devices: make(map[string]healthRecord)}
+	if _, err := NewNvidiaDevicePlugin(resourceClass{Name: resourceName}, healthConfig{}, node, store, b); err != errNVMLTimeout {
+		t.Errorf("got error %v, want %v", err, errNVMLTimeout)
+	}
+}
+
+func TestHealthcheckBackendHung(t *testing.T) {
+	t.Setenv(envDiscoveryInterval, "50ms")
+
+	b := newFakeBackend("GPU-a", "GPU-b")
+	m := newTestPlugin(t, b)
+	go m.healthcheck()
+	defer close(m.stop)
+
+	// The devices are reported unhealthy by the discovery, without any
+	// event of the health checks.
+	b.fail(errNVMLHung)
+	waitChanged(t, m, 5*time.Second)
+	for _, id := range []string{"GPU-a", "GPU-b"} {
+		if h := m.deviceHealthOf(id); h != pluginapi.Unhealthy {
+			t.Errorf("%s is %s, want %s", id, h, pluginapi.Unhealthy)
+		}
+	}
+}
+
+func TestHealthcheckRetriesDiscovery(t *testing.T) {
+	t.Setenv(envDiscoveryInterval, "50ms")
+
+	b := newFakeBackend("GPU-a")
+	m := newTestPlugin(t, b)
+
+	// The health checks start once the devices could be discovered again.
+	b.fail(errNVMLTimeout)
+	go m.healthcheck()
+	defer close(m.stop)
+	time.Sleep(100 * time.Millisecond)
+	b.fail(nil)
+
+	b.events <- healthEvent{Device: &Device{Device: pluginapi.Device{ID: "GPU-a"}}, Reason: "XID 48", XID: 48}
+	waitChanged(t, m, 2*watchRetryDelay)
+	if h := m.deviceHealthOf("GPU-a"); h != pluginapi.Unhealthy {
+		t.Errorf("GPU-a is %s, want %s", h, pluginapi.Unhealthy)
+	}
+}
+
+func TestRediscoverRestoresHotAddedDevices(t *testing.T) {
+	b := newFakeBackend("GPU-a")
+	m := newTestPlugin(t, b)
+	m.store.devices["GPU-b"] = healthRecord{State: healthStateUnhealthy, Reason: "XID 79", LastEvent: time.Now()}
+	m.store.unknown = map[string]time.Time{"GPU-b": time.Now().Add(unknownStateTTL)}
+
+	b.devs = append(b.devs, "GPU-b")
+	if _, changed, err := m.rediscover(); err != nil || !changed {
+		t.Fatalf("got changed %v, error %v, want GPU-b added", changed, err)
+	}
+	if h := m.deviceHealthOf("GPU-b"); h != pluginapi.Unhealthy || m.states["GPU-b"].reason != "XID 79" {
+		t.Errorf("GPU-b is %s, want its persisted health restored", h)
+	}
+	if _, ok := m.store.unknown["GPU-b"]; ok {
+		t.Errorf("GPU-b is still unknown to the store")
+	}
+}
+
+func TestRecoverDevices(t *testing.T) {
+	b := newFakeBackend("GPU-a", "GPU-b")
+	m := newTestPlugin(t, b)
+	m.healthConfig.Recovery = recoveryConfig{QuietPeriod: time.Minute, Probe: true}
+	present := m.presentDevices(m.devs)
+
+	var probed []string
+	var probeErr error
+	b.probe = func(d *Device) error {
+		// The plugin can be used while the devices are probed.
+		if !m.mu.TryLock() {
+			t.Errorf("%s was probed with the lock held", d.ID)
+		} else {
+			m.mu.Unlock()
+		}
+		probed = append(probed, d.ID)
+		return probeErr
+	}
+	quiet := func(id string) {
+		m.states[id].lastEvent = time.Now().Add(-2 * time.Minute)
+	}
+
+	m.handleHealthEvent(healthEvent{Device: present[0], Reason: "XID 48", XID: 48})
+	m.handleHealthEvent(healthEvent{Device: present[1], Reason: "pcie: width x8", Degraded: true})
+
+	// GPU-b is degraded, still advertised healthy, and recovers without
+	// being probed.
+	quiet("GPU-b")
+	if m.recoverDevices(present) {
+		t.Errorf("got a change of the advertised health of a degraded device")
+	}
+	if m.states["GPU-a"].state != healthStateUnhealthy || m.states["GPU-b"].state != healthStateHealthy || len(probed) != 0 {
+		t.Errorf("got GPU-a %s, GPU-b %s, probed %v, want GPU-a in its quiet period and GPU-b recovered", m.states["GPU-a"].state, m.states["GPU-b"].state, probed)
+	}
+
+	// GPU-a fails its probe.
+	quiet("GPU-a")
+	probeErr = errNVMLTimeout
+	if m.recoverDevices(present) {
+		t.Errorf("got a change of the advertised health after a failed probe")
+	}
+	if h := m.states["GPU-a"]; h.state != healthStateRecovering || m.deviceHealthOf("GPU-a") != pluginapi.Unhealthy {
+		t.Errorf("got GPU-a %s and advertised %s, want %s and %s", h.state, m.deviceHealthOf("GPU-a"), healthStateRecovering, pluginapi.Unhealthy)
+	}
+
+	// An event reported during the probe starts a new quiet period.
+	probeErr = nil
+	b.probe = func(d *Device) error {
+		m.handleHealthEvent(healthEvent{Device: d, Reason: "XID 48", XID: 48})
+		return nil
+	}
+	if m.recoverDevices(present) || m.states["GPU-a"].state != healthStateUnhealthy {
+		t.Errorf("got GPU-a %s, want it unhealthy after an event during its probe", m.states["GPU-a"].state)
+	}
+
+	b.probe = nil
+	quiet("GPU-a")
+	if !m.recoverDevices(present) {
+		t.Errorf("the recovery of GPU-a was not reported")
+	}
+	if h := m.deviceHealthOf("GPU-a"); m.states["GPU-a"].state != healthStateHealthy || h != pluginapi.Healthy {
+		t.Errorf("got GPU-a %s and advertised %s, want it healthy", m.states["GPU-a"].state, h)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	// replicaSeparator separates the UUID of a GPU from the replica index in
+	// the IDs of shared devices, e.g. "GPU-8c4b1a2e-...::3".
+	replicaSeparator = "::"
+
+	envGPUSharing        = "NVIDIA_GPU_SHARING"
+	annotationGPUSharing = "nvidia.com/gpu-sharing"
+	timeSlicingStrategy  = "time-slicing"
+)
+
+// sharingConfig describes how the GPUs of a resource are shared between
+// containers.
+type sharingConfig struct {
+	TimeSlicing timeSlicingConfig `yaml:"timeSlicing"`
+}
+
+// timeSlicingConfig advertises each GPU as Replicas devices, the containers
+// allocated to the replicas of a GPU are time-sliced by the driver.
+type timeSlicingConfig struct {
+	Replicas uint `yaml:"replicas"`
+}
+
+func (c sharingConfig) enabled() bool {
+	return c.TimeSlicing.Replicas > 1
+}
+
+func replicaID(id string, i uint) string {
+	return fmt.Sprintf("%s%s%d", id, replicaSeparator, i)
+}
+
+// parseReplicaID returns the ID of the GPU a replica belongs to and the
+// index of the replica.
+func parseReplicaID(id string) (string, uint, error) {
+	i := strings.LastIndex(id, replicaSeparator)
+	if i == -1 {
+		return "", 0, fmt.Errorf("not a replica: %s", id)
+	}
+
+	n, err := strconv.ParseUint(id[i+len(replicaSeparator):], 10, 32)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid replica: %s", id)
+	}
+
+	return id[:i], uint(n), nil
+}
+
+// replicateDevices returns the replicas of the given devices, each replica
+// having the health and NUMA node of its GPU.
+func replicateDevices(devs []*pluginapi.Device, replicas uint) []*pluginapi.Device {
+	var res []*pluginapi.Device
+	for _, d := range devs {
+		for i := uint(0); i < replicas; i++ {
+			res = append(res, &pluginapi.Device{
+				ID:       replicaID(d.ID, i),
+				Health:   d.Health,
+				Topology: d.Topology,
+			})
+		}
+	}
+	return res
+}
+
+// replicaTopology returns the topology of the replicas of the given devices.
+// Replicas of the same GPU are not linked so that allocations spread over
+// well connected GPUs.
+func replicaTopology(t topology, replicas []string) (topology, error) {
+	gpus := make(map[string]string)
+	for _, r := range replicas {
+		id, _, err := parseReplicaID(r)
+		if err != nil {
+			return nil, err
+		}
+		gpus[r] = id
+	}
+
+	res := make(topology)
+	for _, r1 := range replicas {
+		for _, r2 := range replicas {
+			if link, ok := t[gpus[r1]][gpus[r2]]; ok && gpus[r1] != gpus[r2] {
+				res.add(r1, r2, link)
+			}
+		}
+	}
+	return res, nil
+}
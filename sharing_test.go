@@ -0,0 +1,160 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestParseReplicaID(t *testing.T) {
+	tests := []struct {
+		id      string
+		gpu     string
+		replica uint
+		err     string
+	}{
+		{id: "GPU-a::0", gpu: "GPU-a"},
+		{id: "GPU-a::12", gpu: "GPU-a", replica: 12},
+		{id: "MIG-GPU-a/1/0::3", gpu: "MIG-GPU-a/1/0", replica: 3},
+		// The index follows the last separator.
+		{id: "GPU::a::1", gpu: "GPU::a", replica: 1},
+		{id: "GPU-a", err: "not a replica: GPU-a"},
+		{id: "GPU-a:1", err: "not a replica: GPU-a:1"},
+		{id: "GPU-a::", err: "invalid replica: GPU-a::"},
+		{id: "GPU-a::-1", err: "invalid replica: GPU-a::-1"},
+		{id: "GPU-a::x", err: "invalid replica: GPU-a::x"},
+		{id: "GPU-a::4294967296", err: "invalid replica: GPU-a::4294967296"},
+	}
+
+	for _, tt := range tests {
+		gpu, replica, err := parseReplicaID(tt.id)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: got error %v, want %q", tt.id, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || gpu != tt.gpu || replica != tt.replica {
+			t.Errorf("%s: got %s, %d, %v, want %s, %d", tt.id, gpu, replica, err, tt.gpu, tt.replica)
+		}
+	}
+}
+
+func TestReplicateDevices(t *testing.T) {
+	devs := []*pluginapi.Device{
+		{ID: "GPU-a", Health: pluginapi.Healthy, Topology: &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: 1}}}},
+		{ID: "GPU-b", Health: pluginapi.Unhealthy},
+	}
+
+	replicas := replicateDevices(devs, 3)
+	var ids []string
+	for _, r := range replicas {
+		ids = append(ids, r.ID)
+
+		// Every replica maps back to its GPU.
+		id, i, err := parseReplicaID(r.ID)
+		if err != nil || i >= 3 {
+			t.Errorf("%s: got replica %d, error %v", r.ID, i, err)
+			continue
+		}
+		gpu := devs[0]
+		if id == "GPU-b" {
+			gpu = devs[1]
+		}
+		if id != gpu.ID || r.Health != gpu.Health || !reflect.DeepEqual(r.Topology, gpu.Topology) {
+			t.Errorf("%s: got %+v, want the health and topology of %+v", r.ID, r, gpu)
+		}
+	}
+	if want := "GPU-a::0 GPU-a::1 GPU-a::2 GPU-b::0 GPU-b::1 GPU-b::2"; strings.Join(ids, " ") != want {
+		t.Errorf("got replicas %v, want %s", ids, want)
+	}
+}
+
+func TestReplicaTopology(t *testing.T) {
+	gpus := make(topology)
+	gpus.add("GPU-a", "GPU-b", p2pLinkTwoNVLinks)
+	gpus.add("GPU-a", "GPU-c", nvml.P2PLinkCrossCPU)
+
+	tests := []struct {
+		name     string
+		replicas []string
+		want     topology
+		err      string
+	}{
+		{name: "no replicas", want: topology{}},
+		{name: "same GPU", replicas: []string{"GPU-a::0", "GPU-a::1"}, want: topology{}},
+		{
+			name:     "linked GPUs",
+			replicas: []string{"GPU-a::0", "GPU-a::1", "GPU-b::0"},
+			want: topology{
+				"GPU-a::0": {"GPU-b::0": p2pLinkTwoNVLinks},
+				"GPU-a::1": {"GPU-b::0": p2pLinkTwoNVLinks},
+				"GPU-b::0": {"GPU-a::0": p2pLinkTwoNVLinks, "GPU-a::1": p2pLinkTwoNVLinks},
+			},
+		},
+		{
+			name:     "unlinked GPUs",
+			replicas: []string{"GPU-b::0", "GPU-c::0", "GPU-d::0"},
+			want:     topology{},
+		},
+		{name: "malformed ID", replicas: []string{"GPU-a::0", "GPU-b"}, err: "not a replica: GPU-b"},
+	}
+
+	for _, tt := range tests {
+		got, err := replicaTopology(gpus, tt.replicas)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPhysicalDeviceIDs(t *testing.T) {
+	tests := []struct {
+		name      string
+		replicas  uint
+		allocated []string
+		want      []string
+		err       string
+	}{
+		{name: "not shared", allocated: []string{"GPU-b", "GPU-a"}, want: []string{"GPU-b", "GPU-a"}},
+		{name: "shared", replicas: 4, allocated: []string{"GPU-b::3", "GPU-a::0"}, want: []string{"GPU-b", "GPU-a"}},
+		{name: "replicas of one GPU", replicas: 4, allocated: []string{"GPU-a::1", "GPU-b::0", "GPU-a::2"}, want: []string{"GPU-a", "GPU-b"}},
+		{name: "round trip", replicas: 2, allocated: []string{replicaID("GPU-a", 1)}, want: []string{"GPU-a"}},
+		{name: "unknown replica", replicas: 4, allocated: []string{"GPU-a::4"}, err: "unknown device: GPU-a::4"},
+		{name: "malformed ID", replicas: 4, allocated: []string{"GPU-a"}, err: "not a replica: GPU-a"},
+		{name: "malformed index", replicas: 4, allocated: []string{"GPU-a::one"}, err: "invalid replica: GPU-a::one"},
+	}
+
+	for _, tt := range tests {
+		m := &NvidiaDevicePlugin{sharing: sharingConfig{TimeSlicing: timeSlicingConfig{Replicas: tt.replicas}}}
+		got, err := m.physicalDeviceIDs(tt.allocated)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
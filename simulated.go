@@ -0,0 +1,240 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	"gopkg.in/yaml.v2"
+
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const simulatedCheckInterval = 5 * time.Second
+
+// simulatedBackend advertises fake GPUs described in a JSON or YAML file.
+// It lets the plugin run end to end on nodes without a GPU or a driver.
+// The file is read again on every discovery and health check so that editing
+// it simulates GPUs being added, removed or becoming unhealthy.
+type simulatedBackend struct {
+	file string
+}
+
+// simulatedConfig is the content of the simulated devices file, e.g.:
+//
+//	devices:
+//	- uuid: GPU-9a2c6e4e-0000-0000-0000-000000000000
+//	  model: Tesla V100-SXM2-16GB
+//	  memory: 16160
+//	  busID: "00000000:06:00.0"
+//	  numaNode: 0
+//	  unhealthy: false
+//	  telemetry:
+//	    temperature: 45
+//	  topology:
+//	  - peer: GPU-9a2c6e4e-0000-0000-0000-000000000001
+//	    link: single-switch
+type simulatedConfig struct {
+	Devices []simulatedDevice `yaml:"devices"`
+}
+
+type simulatedDevice struct {
+	UUID      string             `yaml:"uuid"`
+	Model     string             `yaml:"model"`
+	Memory    uint64             `yaml:"memory"` // MiB
+	BusID     string             `yaml:"busID"`
+	Path      string             `yaml:"path"`
+	NUMANode  *int64             `yaml:"numaNode"`
+	Unhealthy bool               `yaml:"unhealthy"` // reported by the health checks
+	Telemetry map[string]float64 `yaml:"telemetry"`
+	Topology  []simulatedLink    `yaml:"topology"`
+}
+
+type simulatedLink struct {
+	Peer string `yaml:"peer"`
+	Link string `yaml:"link"`
+}
+
+var simulatedLinkTypes = map[string]nvml.P2PLinkType{
+	"cross-cpu":     nvml.P2PLinkCrossCPU,
+	"same-cpu":      nvml.P2PLinkSameCPU,
+	"host-bridge":   nvml.P2PLinkHostBridge,
+	"multi-switch":  nvml.P2PLinkMultiSwitch,
+	"single-switch": nvml.P2PLinkSingleSwitch,
+	"same-board":    nvml.P2PLinkSameBoard,
+	"nvlink-1":      p2pLinkSingleNVLink,
+	"nvlink-2":      p2pLinkTwoNVLinks,
+	"nvlink-3":      p2pLinkThreeNVLinks,
+	"nvlink-4":      p2pLinkFourNVLinks,
+	"nvlink-5":      p2pLinkFiveNVLinks,
+	"nvlink-6":      p2pLinkSixNVLinks,
+}
+
+func (b *simulatedBackend) Name() string {
+	return simulatedBackendName
+}
+
+func (b *simulatedBackend) Init() error {
+	devs, err := loadSimulatedDevices(b.file)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Simulating %d devices from %s", len(devs), b.file)
+
+	return nil
+}
+
+func (b *simulatedBackend) Shutdown() error {
+	return nil
+}
+
+func (b *simulatedBackend) Devices() ([]*Device, error) {
+	return loadSimulatedDevices(b.file)
+}
+
+// WatchHealth reports the devices marked unhealthy in the file.
+func (b *simulatedBackend) WatchHealth(ctx context.Context, devs []*Device, unhealthy chan<- healthEvent) error {
+	ticker := time.NewTicker(simulatedCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		current, err := loadSimulatedDevices(b.file)
+		if err != nil {
+			return err
+		}
+
+		for _, d := range devs {
+			for _, c := range current {
+				if c.ID == d.ID && c.Health != pluginapi.Healthy {
+					sendUnhealthy(ctx, unhealthy, d, "marked unhealthy in "+b.file)
+				}
+			}
+		}
+	}
+}
+
+// Probe fails for the devices which are missing or marked unhealthy in the
+// file.
+func (b *simulatedBackend) Probe(d *Device) error {
+	devs, err := loadSimulatedDevices(b.file)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range devs {
+		if c.ID == d.ID && c.Health == pluginapi.Healthy {
+			return nil
+		}
+	}
+	return fmt.Errorf("simulated device %s is missing or unhealthy", d.ID)
+}
+
+// Telemetry returns the metrics of the given groups set for the device in the
+// file.
+func (b *simulatedBackend) Telemetry(d *Device, groups telemetryGroups) (map[string]float64, error) {
+	config, err := readSimulatedConfig(b.file)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range config.Devices {
+		if c.UUID != d.ID {
+			continue
+		}
+		m := make(map[string]float64)
+		for k, v := range c.Telemetry {
+			if groups&metricGroup(k) != 0 {
+				m[k] = v
+			}
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("simulated device %s is missing", d.ID)
+}
+
+func loadSimulatedDevices(file string) ([]*Device, error) {
+	config, err := readSimulatedConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseSimulatedDevices(config)
+}
+
+func readSimulatedConfig(file string) (simulatedConfig, error) {
+	var config simulatedConfig
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return config, err
+	}
+
+	// JSON being a subset of YAML, both formats are parsed the same way.
+	if err := yaml.UnmarshalStrict(b, &config); err != nil {
+		return config, fmt.Errorf("invalid simulated devices file %s: %v", file, err)
+	}
+	return config, nil
+}
+
+func parseSimulatedDevices(config simulatedConfig) ([]*Device, error) {
+	uuids := make(map[string]bool)
+	for i, d := range config.Devices {
+		if d.UUID == "" {
+			return nil, fmt.Errorf("simulated device %d has no uuid", i)
+		}
+		if uuids[d.UUID] {
+			return nil, fmt.Errorf("duplicate simulated device: %s", d.UUID)
+		}
+		uuids[d.UUID] = true
+	}
+
+	var devs []*Device
+	for i, d := range config.Devices {
+		dev := &Device{
+			Device: pluginapi.Device{
+				ID:     d.UUID,
+				Health: pluginapi.Healthy,
+			},
+			Index:  uint(i),
+			Path:   d.Path,
+			Model:  d.Model,
+			BusID:  d.BusID,
+			Memory: d.Memory,
+		}
+		if dev.Path == "" {
+			dev.Path = fmt.Sprintf("/dev/nvidia%d", i)
+		}
+		if d.NUMANode != nil {
+			dev.Device.Topology = numaTopology(*d.NUMANode)
+		}
+		if d.Unhealthy {
+			dev.Health = pluginapi.Unhealthy
+		}
+
+		for _, l := range d.Topology {
+			if !uuids[l.Peer] || l.Peer == d.UUID {
+				return nil, fmt.Errorf("simulated device %s: invalid topology peer: %q", d.UUID, l.Peer)
+			}
+			link, ok := simulatedLinkTypes[l.Link]
+			if !ok {
+				return nil, fmt.Errorf("simulated device %s: unknown link type: %q", d.UUID, l.Link)
+			}
+			dev.Topology = append(dev.Topology, p2pLink{Peer: l.Peer, Link: link})
+		}
+
+		devs = append(devs, dev)
+	}
+
+	return devs, nil
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestLoadSimulatedDevices(t *testing.T) {
+	gpu := func(id string, index uint, path string) *Device {
+		d := testDevice(id, index, pluginapi.Healthy)
+		d.Path = path
+		d.BusID = ""
+		d.Memory = 0
+		return d
+	}
+	full := gpu("GPU-a", 0, "/dev/nvidia7")
+	full.Model = "Tesla V100-SXM2-16GB"
+	full.Memory = 16160
+	full.BusID = "00000000:06:00.0"
+	full.Device.Topology = numaTopology(1)
+	full.Topology = []p2pLink{{Peer: "GPU-b", Link: p2pLinkTwoNVLinks}}
+	unhealthy := gpu("GPU-b", 1, "/dev/nvidia1")
+	unhealthy.Health = pluginapi.Unhealthy
+
+	tests := []struct {
+		name    string
+		content string
+		want    []*Device
+		err     string
+	}{
+		{name: "empty file", content: ""},
+		{name: "no devices", content: "devices: []"},
+		{
+			name: "yaml",
+			content: `
+devices:
+- uuid: GPU-a
+  model: Tesla V100-SXM2-16GB
+  memory: 16160
+  busID: "00000000:06:00.0"
+  path: /dev/nvidia7
+  numaNode: 1
+  topology:
+  - peer: GPU-b
+    link: nvlink-2
+- uuid: GPU-b
+  unhealthy: true
+`,
+			want: []*Device{full, unhealthy},
+		},
+		{
+			name:    "json",
+			content: `{"devices": [{"uuid": "GPU-a"}, {"uuid": "GPU-b"}]}`,
+			want:    []*Device{gpu("GPU-a", 0, "/dev/nvidia0"), gpu("GPU-b", 1, "/dev/nvidia1")},
+		},
+		{name: "invalid yaml", content: "devices: [", err: "invalid simulated devices file"},
+		{name: "unknown field", content: "devices:\n- uuid: GPU-a\n  cores: 5120", err: "field cores not found"},
+		{name: "invalid type", content: "devices:\n- uuid: GPU-a\n  memory: 16GB", err: "invalid simulated devices file"},
+		{name: "no uuid", content: "devices:\n- model: Tesla V100", err: "simulated device 0 has no uuid"},
+		{name: "duplicate uuid", content: "devices:\n- uuid: GPU-a\n- uuid: GPU-a", err: "duplicate simulated device: GPU-a"},
+		{name: "unknown peer", content: "devices:\n- uuid: GPU-a\n  topology:\n  - {peer: GPU-z, link: same-cpu}", err: `invalid topology peer: "GPU-z"`},
+		{name: "self peer", content: "devices:\n- uuid: GPU-a\n  topology:\n  - {peer: GPU-a, link: same-cpu}", err: `invalid topology peer: "GPU-a"`},
+		{name: "unknown link", content: "devices:\n- uuid: GPU-a\n- uuid: GPU-b\n  topology:\n  - {peer: GPU-a, link: nvlink-7}", err: `unknown link type: "nvlink-7"`},
+	}
+
+	for _, tt := range tests {
+		file := filepath.Join(t.TempDir(), "devices.yaml")
+		if err := ioutil.WriteFile(file, []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		devs, err := loadSimulatedDevices(file)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(devs, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, devs, tt.want)
+		}
+	}
+
+	if _, err := loadSimulatedDevices(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Errorf("got no error for a missing file")
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	defaultStateFile   = pluginapi.DevicePluginPath + "nvidia-health-state.json"
+	defaultStateExpiry = 24 * time.Hour
+	// unknownStateTTL is how long the records of the devices which were not
+	// discovered at startup are kept, e.g. for the GPUs hot-added later or
+	// back on the bus.
+	unknownStateTTL = time.Hour
+)
+
+// bootIDFile identifies the current boot of the node.
+var bootIDFile = "/proc/sys/kernel/random/boot_id"
+
+// stateConfig configures how the health of the devices is persisted across
+// the restarts of the plugin and of the Kubelet.
+type stateConfig struct {
+	Enabled *bool `yaml:"enabled"`
+	// File defaults to a file of the device plugin directory.
+	File string `yaml:"file"`
+	// Expiry is how long after their last health event the devices are
+	// still restored unhealthy.
+	Expiry time.Duration `yaml:"expiry"`
+}
+
+func (c stateConfig) validate() error {
+	if c.Expiry < 0 {
+		return fmt.Errorf("health.state: negative expiry")
+	}
+	return nil
+}
+
+func (c stateConfig) enabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+func (c stateConfig) file() string {
+	if c.File == "" {
+		return defaultStateFile
+	}
+	return c.File
+}
+
+func (c stateConfig) expiry() time.Duration {
+	if c.Expiry == 0 {
+		return defaultStateExpiry
+	}
+	return c.Expiry
+}
+
+// healthRecord is the persisted health of a device.
+type healthRecord struct {
+	State     healthState `json:"state"`
+	Reason    string      `json:"reason"`
+	LastEvent time.Time   `json:"lastEvent"`
+	// RebootRequired records are kept until the node reboots, whatever
+	// their age.
+	RebootRequired bool `json:"rebootRequired,omitempty"`
+}
+
+// healthStateFile is the content of the state file.
+type healthStateFile struct {
+	// BootID identifies the boot of the node which wrote the file.
+	BootID  string                  `json:"bootID"`
+	Devices map[string]healthRecord `json:"devices"`
+}
+
+// healthStore persists the health of the devices of all the resources. Only
+// the devices which are not Healthy are recorded.
+type healthStore struct {
+	// file is empty when the health is not persisted.
+	file   string
+	bootID string
+
+	mu      sync.Mutex
+	devices map[string]healthRecord
+	// unknown are when the records of the devices not discovered yet are
+	// dropped.
+	unknown map[string]time.Time
+}
+
+// loadHealthStore reads the state file unless reset is set. The records which
+// expired and the records requiring a reboot when the node rebooted since are
+// dropped. The records of the devices which are not present are kept for
+// unknownStateTTL.
+func loadHealthStore(config stateConfig, devs []*Device, reset bool, now time.Time) *healthStore {
+	s := &healthStore{devices: make(map[string]healthRecord), unknown: make(map[string]time.Time)}
+	if !config.enabled() {
+		return s
+	}
+	s.file = config.file()
+	s.bootID = readBootID()
+
+	if reset {
+		log.Printf("Discarding the persisted health of the devices.")
+		s.write()
+		return s
+	}
+
+	b, err := ioutil.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return s
+	}
+	var content healthStateFile
+	if err == nil {
+		err = json.Unmarshal(b, &content)
+	}
+	if err != nil {
+		log.Printf("Warning: could not read the health state file %s: %s", s.file, err)
+		return s
+	}
+
+	rebooted := content.BootID != "" && s.bootID != "" && content.BootID != s.bootID
+	for id, r := range content.Devices {
+		switch {
+		case r.RebootRequired && rebooted:
+			log.Printf("Dropping the persisted health of device %s: the node rebooted.", id)
+		case !r.RebootRequired && now.Sub(r.LastEvent) > config.expiry():
+			log.Printf("Dropping the persisted health of device %s: no health event since %s.", id, r.LastEvent.Format(time.RFC3339))
+		case !deviceExists(devs, id):
+			log.Printf("Keeping the persisted health of device %s for %s: the device is not present.", id, unknownStateTTL)
+			s.devices[id] = r
+			s.unknown[id] = now.Add(unknownStateTTL)
+		default:
+			s.devices[id] = r
+		}
+	}
+
+	if len(s.devices) != len(content.Devices) || rebooted {
+		s.write()
+	}
+	return s
+}
+
+func readBootID() string {
+	b, err := ioutil.ReadFile(bootIDFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// restore returns the persisted health of a device.
+func (s *healthStore) restore(id string) (healthRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.devices[id]
+	delete(s.unknown, id)
+	return r, ok
+}
+
+// expireUnknown drops the records of the devices which were still not
+// discovered after unknownStateTTL.
+func (s *healthStore) expireUnknown(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := false
+	for id, t := range s.unknown {
+		if now.Before(t) {
+			continue
+		}
+		log.Printf("Dropping the persisted health of device %s: the device is not present anymore.", id)
+		delete(s.devices, id)
+		delete(s.unknown, id)
+		expired = true
+	}
+	if expired && s.file != "" {
+		s.write()
+	}
+}
+
+// save persists the health of a device. A device which required a reboot
+// keeps requiring it.
+func (s *healthStore) save(id string, h *deviceHealth, rebootRequired bool) {
+	if s.file == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, ok := s.devices[id]
+	if h.state == healthStateHealthy && !prev.RebootRequired {
+		if !ok {
+			return
+		}
+		delete(s.devices, id)
+	} else {
+		r := healthRecord{
+			State:          h.state,
+			Reason:         h.reason,
+			LastEvent:      h.lastEvent,
+			RebootRequired: rebootRequired || prev.RebootRequired,
+		}
+		if ok && r == prev {
+			return
+		}
+		s.devices[id] = r
+	}
+	s.write()
+}
+
+// write replaces the state file, s.mu must be held.
+func (s *healthStore) write() {
+	b, err := json.MarshalIndent(healthStateFile{BootID: s.bootID, Devices: s.devices}, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(s.file, b)
+	}
+	if err != nil {
+		log.Printf("Warning: could not write the health state file %s: %s", s.file, err)
+	}
+}
+
+// writeFileAtomic writes a file through a temporary file so that readers never
+// see a partial file.
+func writeFileAtomic(file string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
@@ -0,0 +1,308 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// withBootID sets the boot ID of the node during a test.
+func withBootID(t *testing.T, bootID string) {
+	file := filepath.Join(t.TempDir(), "boot_id")
+	if err := ioutil.WriteFile(file, []byte(bootID+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	prev := bootIDFile
+	bootIDFile = file
+	t.Cleanup(func() { bootIDFile = prev })
+}
+
+func testDevices(ids ...string) []*Device {
+	var devs []*Device
+	for _, id := range ids {
+		devs = append(devs, &Device{Device: pluginapi.Device{ID: id, Health: pluginapi.Healthy}})
+	}
+	return devs
+}
+
+func readStateFile(t *testing.T, file string) healthStateFile {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var content healthStateFile
+	if err := json.Unmarshal(b, &content); err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func storedDevices(s *healthStore) []string {
+	ids := []string{}
+	for id := range s.devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestLoadHealthStore(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	unhealthy := func(age time.Duration) healthRecord {
+		return healthRecord{State: healthStateUnhealthy, Reason: "XID 79", LastEvent: now.Add(-age)}
+	}
+	rebootRequired := func(age time.Duration) healthRecord {
+		return healthRecord{State: healthStateUnhealthy, Reason: "pages pending retirement", LastEvent: now.Add(-age), RebootRequired: true}
+	}
+
+	tests := []struct {
+		name    string
+		config  stateConfig
+		reset   bool
+		content string // state file, missing if empty
+		bootID  string // of the state file
+		devices map[string]healthRecord
+		want    []string
+		written bool // whether the state file is rewritten
+	}{
+		{
+			name: "missing file",
+			want: []string{},
+		},
+		{
+			name:    "invalid file",
+			content: "{",
+			want:    []string{},
+		},
+		{
+			name:    "recent events",
+			bootID:  "boot-2",
+			devices: map[string]healthRecord{"GPU-a": unhealthy(time.Hour), "GPU-b": rebootRequired(time.Minute)},
+			want:    []string{"GPU-a", "GPU-b"},
+		},
+		{
+			name:    "expired",
+			bootID:  "boot-2",
+			devices: map[string]healthRecord{"GPU-a": unhealthy(25 * time.Hour), "GPU-b": unhealthy(23 * time.Hour)},
+			want:    []string{"GPU-b"},
+			written: true,
+		},
+		{
+			name:    "configured expiry",
+			config:  stateConfig{Expiry: time.Hour},
+			bootID:  "boot-2",
+			devices: map[string]healthRecord{"GPU-a": unhealthy(2 * time.Hour), "GPU-b": unhealthy(30 * time.Minute)},
+			want:    []string{"GPU-b"},
+			written: true,
+		},
+		{
+			name:    "reboot required does not expire",
+			bootID:  "boot-2",
+			devices: map[string]healthRecord{"GPU-a": rebootRequired(48 * time.Hour)},
+			want:    []string{"GPU-a"},
+		},
+		{
+			name:    "rebooted",
+			bootID:  "boot-1",
+			devices: map[string]healthRecord{"GPU-a": rebootRequired(time.Minute), "GPU-b": unhealthy(time.Minute)},
+			want:    []string{"GPU-b"},
+			written: true,
+		},
+		{
+			name:    "unknown boot",
+			devices: map[string]healthRecord{"GPU-a": rebootRequired(time.Minute)},
+			want:    []string{"GPU-a"},
+		},
+		{
+			name:    "device not present",
+			bootID:  "boot-2",
+			devices: map[string]healthRecord{"GPU-a": unhealthy(time.Minute), "GPU-z": unhealthy(time.Minute)},
+			want:    []string{"GPU-a", "GPU-z"},
+		},
+		{
+			name:    "device not present expired",
+			bootID:  "boot-2",
+			devices: map[string]healthRecord{"GPU-a": unhealthy(time.Minute), "GPU-z": unhealthy(25 * time.Hour)},
+			want:    []string{"GPU-a"},
+			written: true,
+		},
+		{
+			name:    "reset",
+			reset:   true,
+			bootID:  "boot-2",
+			devices: map[string]healthRecord{"GPU-a": rebootRequired(time.Minute)},
+			want:    []string{},
+			written: true,
+		},
+		{
+			name:    "disabled",
+			config:  stateConfig{Enabled: new(bool)},
+			bootID:  "boot-2",
+			devices: map[string]healthRecord{"GPU-a": unhealthy(time.Minute)},
+			want:    []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		withBootID(t, "boot-2")
+		file := filepath.Join(t.TempDir(), "state.json")
+		content := tt.content
+		if tt.devices != nil {
+			b, err := json.Marshal(healthStateFile{BootID: tt.bootID, Devices: tt.devices})
+			if err != nil {
+				t.Fatal(err)
+			}
+			content = string(b)
+		}
+		if content != "" {
+			if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		config := tt.config
+		config.File = file
+		s := loadHealthStore(config, testDevices("GPU-a", "GPU-b", "GPU-c"), tt.reset, now)
+
+		if got := storedDevices(s); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		for id, r := range s.devices {
+			if want := tt.devices[id]; r.State != want.State || r.Reason != want.Reason || !r.LastEvent.Equal(want.LastEvent) || r.RebootRequired != want.RebootRequired {
+				t.Errorf("%s: got %s %+v, want %+v", tt.name, id, r, want)
+			}
+		}
+
+		if !tt.written {
+			b, _ := ioutil.ReadFile(file)
+			if string(b) != content {
+				t.Errorf("%s: state file rewritten", tt.name)
+			}
+			continue
+		}
+		written := readStateFile(t, file)
+		if written.BootID != "boot-2" || len(written.Devices) != len(tt.want) {
+			t.Errorf("%s: got state file %+v, want boot-2 and %v", tt.name, written, tt.want)
+		}
+	}
+}
+
+func TestHealthStoreSave(t *testing.T) {
+	withBootID(t, "boot-1")
+	file := filepath.Join(t.TempDir(), "state.json")
+	s := loadHealthStore(stateConfig{File: file}, nil, true, time.Now())
+
+	now := time.Now().UTC().Truncate(time.Second)
+	healthy := &deviceHealth{state: healthStateHealthy, lastEvent: now}
+	unhealthy := &deviceHealth{state: healthStateUnhealthy, reason: "XID 48", lastEvent: now}
+
+	steps := []struct {
+		name           string
+		device         string
+		health         *deviceHealth
+		rebootRequired bool
+		want           map[string]healthRecord
+	}{
+		{
+			name:   "healthy devices are not recorded",
+			device: "GPU-a",
+			health: healthy,
+			want:   map[string]healthRecord{},
+		},
+		{
+			name:   "unhealthy",
+			device: "GPU-a",
+			health: unhealthy,
+			want:   map[string]healthRecord{"GPU-a": {State: healthStateUnhealthy, Reason: "XID 48", LastEvent: now}},
+		},
+		{
+			name:   "recovered",
+			device: "GPU-a",
+			health: healthy,
+			want:   map[string]healthRecord{},
+		},
+		{
+			name:           "reboot required",
+			device:         "GPU-b",
+			health:         unhealthy,
+			rebootRequired: true,
+			want:           map[string]healthRecord{"GPU-b": {State: healthStateUnhealthy, Reason: "XID 48", LastEvent: now, RebootRequired: true}},
+		},
+		{
+			name:   "reboot still required after recovering",
+			device: "GPU-b",
+			health: healthy,
+			want:   map[string]healthRecord{"GPU-b": {State: healthStateHealthy, LastEvent: now, RebootRequired: true}},
+		},
+	}
+
+	for _, step := range steps {
+		s.save(step.device, step.health, step.rebootRequired)
+
+		written := readStateFile(t, file)
+		if written.BootID != "boot-1" {
+			t.Errorf("%s: got boot ID %q, want boot-1", step.name, written.BootID)
+		}
+		for _, devices := range []map[string]healthRecord{s.devices, written.Devices} {
+			if len(devices) != len(step.want) {
+				t.Errorf("%s: got %v, want %v", step.name, devices, step.want)
+			}
+			for id, r := range devices {
+				if want := step.want[id]; r.State != want.State || r.Reason != want.Reason || !r.LastEvent.Equal(want.LastEvent) || r.RebootRequired != want.RebootRequired {
+					t.Errorf("%s: got %s %+v, want %+v", step.name, id, r, want)
+				}
+			}
+		}
+	}
+
+	restored := loadHealthStore(stateConfig{File: file}, testDevices("GPU-a", "GPU-b"), false, now.Add(48*time.Hour))
+	if r, ok := restored.restore("GPU-b"); !ok || !r.RebootRequired {
+		t.Errorf("got %+v, %v, want GPU-b to require a reboot", r, ok)
+	}
+	if _, ok := restored.restore("GPU-a"); ok {
+		t.Errorf("GPU-a restored")
+	}
+}
+
+func TestHealthStoreExpireUnknown(t *testing.T) {
+	withBootID(t, "boot-1")
+	file := filepath.Join(t.TempDir(), "state.json")
+	now := time.Now().UTC().Truncate(time.Second)
+	unhealthy := healthRecord{State: healthStateUnhealthy, Reason: "XID 79", LastEvent: now}
+	b, err := json.Marshal(healthStateFile{BootID: "boot-1", Devices: map[string]healthRecord{"GPU-a": unhealthy, "GPU-b": unhealthy, "GPU-c": unhealthy}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// No GPU was discovered at startup, GPU-b is hot-added later.
+	s := loadHealthStore(stateConfig{File: file}, nil, false, now)
+	s.expireUnknown(now.Add(unknownStateTTL - time.Second))
+	if got, want := storedDevices(s), []string{"GPU-a", "GPU-b", "GPU-c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v before the TTL, want %v", got, want)
+	}
+	if _, ok := s.restore("GPU-b"); !ok {
+		t.Errorf("hot-added GPU-b not restored")
+	}
+
+	s.expireUnknown(now.Add(unknownStateTTL))
+	want := []string{"GPU-b"}
+	if got := storedDevices(s); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v after the TTL, want %v", got, want)
+	}
+	written := readStateFile(t, file)
+	if len(written.Devices) != 1 || written.Devices["GPU-b"].State != healthStateUnhealthy {
+		t.Errorf("got state file %+v, want %v", written, want)
+	}
+}
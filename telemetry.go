@@ -0,0 +1,292 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Metrics sampled by the telemetry health checks. The throttle metrics are 1
+// while the GPU clocks are throttled for that reason, 0 otherwise.
+var telemetryMetrics = map[string]string{
+	"temperature":                   "GPU temperature (C)",
+	"power":                         "power draw (W)",
+	"gpuUtilization":                "GPU utilization (%)",
+	"memoryUtilization":             "memory utilization (%)",
+	"memoryUsed":                    "memory used (MiB)",
+	"eccL1":                         "uncorrected L1 cache ECC errors",
+	"eccL2":                         "uncorrected L2 cache ECC errors",
+	"eccGlobal":                     "uncorrected device memory ECC errors",
+	"throttle.swPowerCap":           "clocks throttled by the power cap",
+	"throttle.hwSlowdown":           "clocks throttled by the hardware",
+	"throttle.swThermalSlowdown":    "clocks throttled by the driver to cool down",
+	"throttle.hwThermalSlowdown":    "clocks throttled by the hardware to cool down",
+	"throttle.hwPowerBrakeSlowdown": "clocks throttled by the power brake",
+	"pcie.generation":               "current PCIe link generation",
+	"pcie.width":                    "current PCIe link width",
+	"pcie.maxGeneration":            "maximum PCIe link generation",
+	"pcie.maxWidth":                 "maximum PCIe link width",
+	"retiredPages.singleBitEcc":     "pages retired after multiple single bit ECC errors",
+	"retiredPages.doubleBitEcc":     "pages retired after a double bit ECC error",
+	"retiredPages.pending":          "pages are pending retirement until the next reboot",
+}
+
+// telemetryGroups selects groups of telemetry metrics, each group being
+// queried separately so that the health checks only query the metrics they
+// use and a group which fails does not hide the others.
+type telemetryGroups uint
+
+const (
+	// telemetryStatus are the metrics of the device status: temperature,
+	// power, utilization, memory, ECC errors and throttling.
+	telemetryStatus telemetryGroups = 1 << iota
+	telemetryPCIe
+	telemetryRetiredPages
+	telemetryNVLink
+)
+
+var telemetryGroupNames = map[telemetryGroups]string{
+	telemetryStatus:       "status",
+	telemetryPCIe:         "pcie",
+	telemetryRetiredPages: "retiredPages",
+	telemetryNVLink:       "nvlink",
+}
+
+func (g telemetryGroups) String() string {
+	var names []string
+	for group := telemetryStatus; group <= telemetryNVLink; group <<= 1 {
+		if g&group != 0 {
+			names = append(names, telemetryGroupNames[group])
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// metricGroup returns the group of a metric.
+func metricGroup(metric string) telemetryGroups {
+	for group, name := range telemetryGroupNames {
+		if group != telemetryStatus && strings.HasPrefix(metric, name+".") {
+			return group
+		}
+	}
+	return telemetryStatus
+}
+
+// telemetryConfig configures the health checks on the GPU telemetry.
+type telemetryConfig struct {
+	Rules []telemetryRule `yaml:"rules"`
+}
+
+// telemetryRule matches when Metric compares to Value with Op for at least
+// For. Once matched it keeps matching until the metric no longer compares to
+// Clear, or Value if Clear is not set. The "increased" operator matches when
+// the metric increased since the previous sample.
+type telemetryRule struct {
+	Name   string        `yaml:"name"`
+	Metric string        `yaml:"metric"`
+	Op     string        `yaml:"op"`
+	Value  float64       `yaml:"value"`
+	For    time.Duration `yaml:"for"`
+	Clear  *float64      `yaml:"clear"`
+	// Action is either unhealthy or degraded, degraded devices are still
+	// advertised as healthy.
+	Action string `yaml:"action"`
+}
+
+const opIncreased = "increased"
+
+func (c telemetryConfig) validate() error {
+	names := make(map[string]bool)
+	for i, r := range c.Rules {
+		if r.Name == "" {
+			return fmt.Errorf("health.telemetry: rule %d has no name", i)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("health.telemetry: duplicate rule %q", r.Name)
+		}
+		names[r.Name] = true
+
+		if _, ok := telemetryMetrics[r.Metric]; !ok {
+			return fmt.Errorf("health.telemetry: %s: unknown metric %q", r.Name, r.Metric)
+		}
+		if _, ok := compareOps[r.Op]; !ok && r.Op != opIncreased {
+			return fmt.Errorf("health.telemetry: %s: invalid op %q", r.Name, r.Op)
+		}
+		if !validHealthAction(r.Action) {
+			return fmt.Errorf("health.telemetry: %s: invalid action %q", r.Name, r.Action)
+		}
+		if r.For < 0 {
+			return fmt.Errorf("health.telemetry: %s: negative duration", r.Name)
+		}
+	}
+	return nil
+}
+
+func (c telemetryConfig) enabled() bool {
+	return len(c.Rules) > 0
+}
+
+var compareOps = map[string]func(a, b float64) bool{
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// telemetryMatch is a rule matching the samples of a device.
+type telemetryMatch struct {
+	Rule   telemetryRule
+	Reason string
+}
+
+// ruleState is the state of a rule for a device.
+type ruleState struct {
+	since    time.Time // the condition holds since, zero if it does not
+	matching bool
+	last     *float64
+}
+
+// telemetryChecker evaluates the telemetry rules on the samples of the
+// devices.
+type telemetryChecker struct {
+	rules []telemetryRule
+
+	mu     sync.Mutex
+	states map[string]*ruleState
+}
+
+func newTelemetryChecker(rules []telemetryRule) *telemetryChecker {
+	return &telemetryChecker{rules: rules, states: make(map[string]*ruleState)}
+}
+
+// groups returns the groups of the metrics used by the rules.
+func (c *telemetryChecker) groups() telemetryGroups {
+	var groups telemetryGroups
+	for _, r := range c.rules {
+		groups |= metricGroup(r.Metric)
+	}
+	return groups
+}
+
+// evaluate returns the rules matching the sample taken at the given time on
+// a device. Rules whose metric is missing from the sample keep their state.
+func (c *telemetryChecker) evaluate(id string, sample map[string]float64, now time.Time) []telemetryMatch {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var matches []telemetryMatch
+	for _, r := range c.rules {
+		v, ok := sample[r.Metric]
+		if !ok {
+			continue
+		}
+
+		key := id + "/" + r.Name
+		st, ok := c.states[key]
+		if !ok {
+			st = &ruleState{}
+			c.states[key] = st
+		}
+
+		if r.Op == opIncreased {
+			st.matching = st.last != nil && v > *st.last
+			if st.matching {
+				matches = append(matches, telemetryMatch{
+					Rule:   r,
+					Reason: fmt.Sprintf("%s: %s increased from %s to %s", r.Name, r.Metric, formatMetric(*st.last), formatMetric(v)),
+				})
+			}
+			st.last = &v
+			continue
+		}
+
+		compare := compareOps[r.Op]
+		switch {
+		case st.matching:
+			threshold := r.Value
+			if r.Clear != nil {
+				threshold = *r.Clear
+			}
+			st.matching = compare(v, threshold)
+			if !st.matching {
+				st.since = time.Time{}
+			}
+		case compare(v, r.Value):
+			if st.since.IsZero() {
+				st.since = now
+			}
+			st.matching = now.Sub(st.since) >= r.For
+		default:
+			st.since = time.Time{}
+		}
+
+		if st.matching {
+			reason := fmt.Sprintf("%s: %s %s %s %s", r.Name, r.Metric, formatMetric(v), r.Op, formatMetric(r.Value))
+			if r.For > 0 {
+				reason += fmt.Sprintf(" for %s", now.Sub(st.since).Truncate(time.Second))
+			}
+			matches = append(matches, telemetryMatch{Rule: r, Reason: reason})
+		}
+	}
+	return matches
+}
+
+func formatMetric(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// watchTelemetry samples the telemetry of the devices every interval and
+// reports the devices matching a rule until the context is cancelled.
+func watchTelemetry(ctx context.Context, backend deviceBackend, devs []*Device, interval time.Duration, checker *telemetryChecker, events chan<- healthEvent) {
+	sampleTelemetry(ctx, backend, devs, interval, checker.groups(), func(d *Device, sample map[string]float64, now time.Time) {
+		for _, m := range checker.evaluate(d.ID, sample, now) {
+			sendHealthEvent(ctx, events, healthEvent{
+				Device:   d,
+				Reason:   m.Reason,
+				Degraded: m.Rule.Action == healthActionDegraded,
+			})
+		}
+	})
+}
+
+// sampleTelemetry calls check with the metrics of the given groups of each
+// device every interval until the context is cancelled. The metrics which
+// could be sampled are checked even if sampling others failed.
+func sampleTelemetry(ctx context.Context, backend deviceBackend, devs []*Device, interval time.Duration, groups telemetryGroups, check func(d *Device, sample map[string]float64, now time.Time)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failed := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, d := range devs {
+			sample, err := backend.Telemetry(d, groups)
+			if err != nil {
+				if !failed[d.ID] {
+					log.Printf("Warning: could not sample the telemetry of %s: %s", d.ID, err)
+				}
+				failed[d.ID] = true
+			} else {
+				delete(failed, d.ID)
+			}
+
+			if len(sample) > 0 {
+				check(d, sample, time.Now())
+			}
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestMetricGroup(t *testing.T) {
+	tests := []struct {
+		metric string
+		want   telemetryGroups
+	}{
+		{"temperature", telemetryStatus},
+		{"throttle.hwSlowdown", telemetryStatus},
+		{"pcie.width", telemetryPCIe},
+		{"retiredPages.pending", telemetryRetiredPages},
+		{nvlinkMetric(3, "crcFlit"), telemetryNVLink},
+		{"nvlinkCount", telemetryStatus},
+	}
+	for _, tt := range tests {
+		if got := metricGroup(tt.metric); got != tt.want {
+			t.Errorf("%s: got group %s, want %s", tt.metric, got, tt.want)
+		}
+	}
+
+	// Every documented metric belongs to a group.
+	for metric := range telemetryMetrics {
+		if metricGroup(metric).String() == "" {
+			t.Errorf("%s has no group", metric)
+		}
+	}
+
+	if got, want := (telemetryStatus | telemetryNVLink).String(), "status,nvlink"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTelemetryCheckerGroups(t *testing.T) {
+	checker := newTelemetryChecker([]telemetryRule{
+		{Name: "hot", Metric: "temperature"},
+		{Name: "downgraded", Metric: "pcie.width"},
+		{Name: "throttled", Metric: "throttle.swPowerCap"},
+	})
+	if got, want := checker.groups(), telemetryStatus|telemetryPCIe; got != want {
+		t.Errorf("got groups %s, want %s", got, want)
+	}
+}
+
+// telemetryBackend returns the metrics of the groups which do not fail.
+type telemetryBackend struct {
+	*fakeBackend
+	metrics map[string]float64
+	fail    telemetryGroups
+
+	mu     sync.Mutex
+	groups []telemetryGroups
+}
+
+func (b *telemetryBackend) Telemetry(d *Device, groups telemetryGroups) (map[string]float64, error) {
+	b.mu.Lock()
+	b.groups = append(b.groups, groups)
+	b.mu.Unlock()
+
+	m := make(map[string]float64)
+	for k, v := range b.metrics {
+		if groups&metricGroup(k)&^b.fail != 0 {
+			m[k] = v
+		}
+	}
+	if groups&b.fail != 0 {
+		return m, fmt.Errorf("%s: not responding", groups&b.fail)
+	}
+	return m, nil
+}
+
+func TestSampleTelemetry(t *testing.T) {
+	b := &telemetryBackend{
+		fakeBackend: newFakeBackend("GPU-a"),
+		metrics:     map[string]float64{"temperature": 90, "pcie.width": 8, "retiredPages.pending": 1},
+		fail:        telemetryRetiredPages,
+	}
+	devs, _ := b.Devices()
+
+	tests := []struct {
+		name   string
+		groups telemetryGroups
+		want   map[string]float64 // nil if check must not be called
+	}{
+		{name: "single group", groups: telemetryPCIe, want: map[string]float64{"pcie.width": 8}},
+		{name: "partial failure", groups: telemetryStatus | telemetryRetiredPages, want: map[string]float64{"temperature": 90}},
+		{name: "failure", groups: telemetryRetiredPages},
+	}
+
+	for _, tt := range tests {
+		samples := make(chan map[string]float64, 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			sampleTelemetry(ctx, b, devs, 10*time.Millisecond, tt.groups, func(d *Device, sample map[string]float64, now time.Time) {
+				select {
+				case samples <- sample:
+				default:
+				}
+			})
+		}()
+
+		select {
+		case got := <-samples:
+			if tt.want == nil {
+				t.Errorf("%s: unexpected sample %v", tt.name, got)
+			} else if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if tt.want != nil {
+				t.Errorf("%s: no sample", tt.name)
+			}
+		}
+		cancel()
+		<-done
+
+		b.mu.Lock()
+		for _, g := range b.groups {
+			if g != tt.groups {
+				t.Errorf("%s: sampled %s, want %s", tt.name, g, tt.groups)
+			}
+		}
+		b.groups = nil
+		b.mu.Unlock()
+	}
+}
+
+func TestTelemetryEvaluate(t *testing.T) {
+	clear := 85.0
+	rules := []telemetryRule{
+		{Name: "overheating", Metric: "temperature", Op: ">", Value: 90, For: 2 * time.Minute, Clear: &clear, Action: healthActionDegraded},
+		{Name: "hw-slowdown", Metric: "throttle.hwSlowdown", Op: "==", Value: 1, Action: healthActionUnhealthy},
+		{Name: "l2-ecc", Metric: "eccL2", Op: opIncreased, Action: healthActionUnhealthy},
+	}
+
+	start := time.Now()
+	tests := []struct {
+		name   string
+		at     time.Duration
+		device string
+		sample map[string]float64
+		want   []string // names of the matching rules
+	}{
+		{name: "below", at: 0, device: "GPU-a", sample: map[string]float64{"temperature": 80, "throttle.hwSlowdown": 0, "eccL2": 3}},
+		{name: "above, not for long", at: time.Minute, device: "GPU-a", sample: map[string]float64{"temperature": 95}},
+		{name: "back below", at: 2 * time.Minute, device: "GPU-a", sample: map[string]float64{"temperature": 88}},
+		{name: "above again", at: 3 * time.Minute, device: "GPU-a", sample: map[string]float64{"temperature": 92}},
+		{name: "missing metric", at: 4 * time.Minute, device: "GPU-a", sample: map[string]float64{"power": 300}},
+		{name: "above for 2m", at: 5 * time.Minute, device: "GPU-a", sample: map[string]float64{"temperature": 91}, want: []string{"overheating"}},
+		{name: "hysteresis", at: 6 * time.Minute, device: "GPU-a", sample: map[string]float64{"temperature": 87}, want: []string{"overheating"}},
+		{name: "cleared", at: 7 * time.Minute, device: "GPU-a", sample: map[string]float64{"temperature": 85}},
+		{name: "above after clearing", at: 8 * time.Minute, device: "GPU-a", sample: map[string]float64{"temperature": 95}},
+		{name: "other device", at: 8 * time.Minute, device: "GPU-b", sample: map[string]float64{"temperature": 95, "eccL2": 10}},
+
+		{name: "immediate", at: 9 * time.Minute, device: "GPU-a", sample: map[string]float64{"throttle.hwSlowdown": 1}, want: []string{"hw-slowdown"}},
+		{name: "immediate cleared", at: 10 * time.Minute, device: "GPU-a", sample: map[string]float64{"throttle.hwSlowdown": 0}},
+
+		{name: "unchanged counter", at: 11 * time.Minute, device: "GPU-a", sample: map[string]float64{"eccL2": 3}},
+		{name: "increased counter", at: 12 * time.Minute, device: "GPU-a", sample: map[string]float64{"eccL2": 5}, want: []string{"l2-ecc"}},
+		{name: "stable counter", at: 13 * time.Minute, device: "GPU-a", sample: map[string]float64{"eccL2": 5}},
+		{name: "reset counter", at: 14 * time.Minute, device: "GPU-a", sample: map[string]float64{"eccL2": 0}},
+		{name: "counter of the other device", at: 14 * time.Minute, device: "GPU-b", sample: map[string]float64{"eccL2": 11}, want: []string{"l2-ecc"}},
+	}
+
+	checker := newTelemetryChecker(rules)
+	for _, tt := range tests {
+		var got []string
+		for _, m := range checker.evaluate(tt.device, tt.sample, start.Add(tt.at)) {
+			got = append(got, m.Rule.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTelemetryEvaluateReason(t *testing.T) {
+	rules := []telemetryRule{
+		{Name: "overheating", Metric: "temperature", Op: ">=", Value: 90, For: time.Minute},
+		{Name: "l2-ecc", Metric: "eccL2", Op: opIncreased},
+	}
+	checker := newTelemetryChecker(rules)
+
+	start := time.Now()
+	checker.evaluate("GPU-a", map[string]float64{"temperature": 90, "eccL2": 1}, start)
+	matches := checker.evaluate("GPU-a", map[string]float64{"temperature": 92.5, "eccL2": 2}, start.Add(90*time.Second))
+
+	want := []string{
+		"overheating: temperature 92.5 >= 90 for 1m30s",
+		"l2-ecc: eccL2 increased from 1 to 2",
+	}
+	var got []string
+	for _, m := range matches {
+		got = append(got, m.Reason)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTelemetryConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		rule telemetryRule
+		err  bool
+	}{
+		{name: "valid", rule: telemetryRule{Name: "hot", Metric: "temperature", Op: ">", Action: healthActionDegraded}},
+		{name: "increased", rule: telemetryRule{Name: "ecc", Metric: "eccGlobal", Op: opIncreased, Action: healthActionUnhealthy}},
+		{name: "nvlink", rule: telemetryRule{Name: "link", Metric: nvlinkMetric(2, "active"), Op: "==", Action: healthActionUnhealthy}},
+		{name: "no name", rule: telemetryRule{Metric: "temperature", Op: ">", Action: healthActionUnhealthy}, err: true},
+		{name: "unknown metric", rule: telemetryRule{Name: "fan", Metric: "fanSpeed", Op: ">", Action: healthActionUnhealthy}, err: true},
+		{name: "invalid op", rule: telemetryRule{Name: "hot", Metric: "temperature", Op: "=>", Action: healthActionUnhealthy}, err: true},
+		{name: "invalid action", rule: telemetryRule{Name: "hot", Metric: "temperature", Op: ">", Action: "reboot"}, err: true},
+		{name: "negative for", rule: telemetryRule{Name: "hot", Metric: "temperature", Op: ">", For: -time.Second, Action: healthActionUnhealthy}, err: true},
+	}
+
+	for _, tt := range tests {
+		err := telemetryConfig{Rules: []telemetryRule{tt.rule}}.validate()
+		if tt.err != (err != nil) {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+	}
+
+	rule := telemetryRule{Name: "hot", Metric: "temperature", Op: ">", Action: healthActionUnhealthy}
+	if err := (telemetryConfig{Rules: []telemetryRule{rule, rule}}).validate(); err == nil {
+		t.Errorf("expected an error for duplicate rules")
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+// maxAllocationCandidates bounds the number of device sets scored
+// exhaustively, larger searches fall back to a greedy selection.
+const maxAllocationCandidates = 100000
+
+// linkScore rates how fast two devices can communicate, NVLinks first, then
+// the closer their common PCIe ancestor the better.
+func linkScore(link nvml.P2PLinkType) int {
+	switch link {
+	case p2pLinkSingleNVLink:
+		return 100
+	case p2pLinkTwoNVLinks:
+		return 200
+	case p2pLinkThreeNVLinks:
+		return 300
+	case p2pLinkFourNVLinks:
+		return 400
+	case p2pLinkFiveNVLinks:
+		return 500
+	case p2pLinkSixNVLinks:
+		return 600
+	case nvml.P2PLinkSameBoard:
+		return 60
+	case nvml.P2PLinkSingleSwitch:
+		return 50
+	case nvml.P2PLinkMultiSwitch:
+		return 40
+	case nvml.P2PLinkHostBridge:
+		return 30
+	case nvml.P2PLinkSameCPU:
+		return 20
+	case nvml.P2PLinkCrossCPU:
+		return 10
+	}
+	return 0
+}
+
+// topology maps each pair of device IDs to the link between them.
+type topology map[string]map[string]nvml.P2PLinkType
+
+func newTopology(devs []*Device) topology {
+	t := make(topology)
+	for _, d := range devs {
+		for _, l := range d.Topology {
+			t.add(d.ID, l.Peer, l.Link)
+		}
+	}
+	return t
+}
+
+// add records a link in both directions, keeping the best one if the two
+// devices disagree.
+func (t topology) add(id1, id2 string, link nvml.P2PLinkType) {
+	for _, p := range [][2]string{{id1, id2}, {id2, id1}} {
+		if t[p[0]] == nil {
+			t[p[0]] = make(map[string]nvml.P2PLinkType)
+		}
+		if linkScore(link) > linkScore(t[p[0]][p[1]]) {
+			t[p[0]][p[1]] = link
+		}
+	}
+}
+
+// score returns the sum of the link scores of all the pairs of the set.
+func (t topology) score(ids []string) int {
+	score := 0
+	for i := range ids {
+		for j := i + 1; j < len(ids); j++ {
+			score += linkScore(t[ids[i]][ids[j]])
+		}
+	}
+	return score
+}
+
+// preferredDevices returns the size devices out of available, including all of
+// required, whose links have the best total score. Ties are broken in favor
+// of the devices listed first in available.
+func preferredDevices(t topology, available, required []string, size int) ([]string, error) {
+	if size < len(required) {
+		return nil, fmt.Errorf("allocation size %d is smaller than the %d required devices", size, len(required))
+	}
+
+	isRequired := make(map[string]bool)
+	for _, id := range required {
+		isRequired[id] = true
+	}
+
+	var candidates []string
+	seen := make(map[string]bool)
+	for _, id := range available {
+		if !isRequired[id] && !seen[id] {
+			candidates = append(candidates, id)
+		}
+		seen[id] = true
+	}
+	for _, id := range required {
+		if !seen[id] {
+			return nil, fmt.Errorf("required device %s is not available", id)
+		}
+	}
+
+	n := size - len(required)
+	if n > len(candidates) {
+		return nil, fmt.Errorf("allocation size %d is larger than the %d available devices", size, len(available))
+	}
+
+	var best []string
+	if combinations(len(candidates), n) <= maxAllocationCandidates {
+		best = bestCombination(t, candidates, required, n)
+	} else {
+		best = greedyCombination(t, candidates, required, n)
+	}
+
+	return sortLike(append(append([]string{}, required...), best...), available), nil
+}
+
+// bestCombination exhaustively scores every set of n candidates.
+func bestCombination(t topology, candidates, required []string, n int) []string {
+	var best []string
+	bestScore := -1
+
+	set := append([]string{}, required...)
+	var walk func(start int)
+	walk = func(start int) {
+		if len(set) == len(required)+n {
+			if s := t.score(set); s > bestScore {
+				bestScore = s
+				best = append([]string{}, set[len(required):]...)
+			}
+			return
+		}
+		for i := start; i <= len(candidates)-(len(required)+n-len(set)); i++ {
+			set = append(set, candidates[i])
+			walk(i + 1)
+			set = set[:len(set)-1]
+		}
+	}
+	walk(0)
+
+	return best
+}
+
+// greedyCombination repeatedly adds the candidate which improves the score
+// of the set the most.
+func greedyCombination(t topology, candidates, required []string, n int) []string {
+	set := append([]string{}, required...)
+	used := make(map[string]bool)
+
+	for k := 0; k < n; k++ {
+		bestScore, best := -1, ""
+		for _, c := range candidates {
+			if used[c] {
+				continue
+			}
+			s := 0
+			for _, id := range set {
+				s += linkScore(t[c][id])
+			}
+			if s > bestScore {
+				bestScore, best = s, c
+			}
+		}
+		used[best] = true
+		set = append(set, best)
+	}
+
+	return set[len(required):]
+}
+
+// combinations returns n choose k, saturating at maxAllocationCandidates+1.
+func combinations(n, k int) int {
+	if k > n-k {
+		k = n - k
+	}
+	c := 1
+	for i := 1; i <= k; i++ {
+		c = c * (n - k + i) / i
+		if c > maxAllocationCandidates {
+			return maxAllocationCandidates + 1
+		}
+	}
+	return c
+}
+
+// sortLike sorts the IDs in the order they appear in ref.
+func sortLike(ids, ref []string) []string {
+	pos := make(map[string]int)
+	for i, id := range ref {
+		if _, ok := pos[id]; !ok {
+			pos[id] = i
+		}
+	}
+	sort.SliceStable(ids, func(i, j int) bool { return pos[ids[i]] < pos[ids[j]] })
+	return ids
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// syntheticTopology returns n devices in boards of four, the devices of a
+// board are connected through the given number of NVLinks and to the other
+// devices through their CPU.
+func syntheticTopology(n int, nvlinks nvml.P2PLinkType) ([]string, topology) {
+	var ids []string
+	for i := 0; i < n; i++ {
+		ids = append(ids, fmt.Sprintf("GPU-%02d", i))
+	}
+
+	var devs []*Device
+	for i, id := range ids {
+		d := &Device{Device: pluginapi.Device{ID: id}}
+		for j := i + 1; j < n; j++ {
+			link := nvml.P2PLinkSameCPU
+			if i/4 == j/4 {
+				link = p2pLinkSingleNVLink + nvlinks - 1
+			}
+			d.Topology = append(d.Topology, p2pLink{Peer: ids[j], Link: link})
+		}
+		devs = append(devs, d)
+	}
+	return ids, newTopology(devs)
+}
+
+func TestNewTopology(t *testing.T) {
+	devs := []*Device{
+		{Device: pluginapi.Device{ID: "GPU-a"}, Topology: []p2pLink{{Peer: "GPU-b", Link: nvml.P2PLinkSameCPU}}},
+		{Device: pluginapi.Device{ID: "GPU-b"}, Topology: []p2pLink{{Peer: "GPU-a", Link: p2pLinkTwoNVLinks}}},
+		{Device: pluginapi.Device{ID: "GPU-c"}, Topology: []p2pLink{{Peer: "GPU-a", Link: nvml.P2PLinkCrossCPU}}},
+	}
+	topo := newTopology(devs)
+
+	tests := []struct {
+		id1, id2 string
+		want     nvml.P2PLinkType
+	}{
+		{"GPU-a", "GPU-b", p2pLinkTwoNVLinks},
+		{"GPU-b", "GPU-a", p2pLinkTwoNVLinks},
+		{"GPU-a", "GPU-c", nvml.P2PLinkCrossCPU},
+		{"GPU-c", "GPU-a", nvml.P2PLinkCrossCPU},
+		{"GPU-b", "GPU-c", nvml.P2PLinkUnknown},
+	}
+	for _, tt := range tests {
+		if got := topo[tt.id1][tt.id2]; got != tt.want {
+			t.Errorf("link %s-%s is %v, want %v", tt.id1, tt.id2, got, tt.want)
+		}
+	}
+
+	if got, want := topo.score([]string{"GPU-a", "GPU-b", "GPU-c"}), 200+10; got != want {
+		t.Errorf("score is %d, want %d", got, want)
+	}
+}
+
+func TestLinkScore(t *testing.T) {
+	links := []nvml.P2PLinkType{
+		p2pLinkSixNVLinks,
+		p2pLinkFiveNVLinks,
+		p2pLinkFourNVLinks,
+		p2pLinkThreeNVLinks,
+		p2pLinkTwoNVLinks,
+		p2pLinkSingleNVLink,
+		nvml.P2PLinkSameBoard,
+		nvml.P2PLinkSingleSwitch,
+		nvml.P2PLinkMultiSwitch,
+		nvml.P2PLinkHostBridge,
+		nvml.P2PLinkSameCPU,
+		nvml.P2PLinkCrossCPU,
+		nvml.P2PLinkUnknown,
+	}
+	for i := 1; i < len(links); i++ {
+		if linkScore(links[i-1]) <= linkScore(links[i]) {
+			t.Errorf("link %v scores %d, not more than link %v scoring %d",
+				links[i-1], linkScore(links[i-1]), links[i], linkScore(links[i]))
+		}
+	}
+}
+
+func TestPreferredDevices(t *testing.T) {
+	ids, topo := syntheticTopology(8, 2)
+	// The boards listed last so that the ties are not all broken by the
+	// device IDs.
+	available := append(append([]string{}, ids[4:]...), ids[:4]...)
+
+	tests := []struct {
+		name      string
+		available []string
+		required  []string
+		size      int
+		want      []string
+		err       bool
+	}{
+		{name: "single device", available: available, size: 1, want: []string{"GPU-04"}},
+		{name: "same board", available: available, size: 2, want: []string{"GPU-04", "GPU-05"}},
+		{name: "whole board", available: available, size: 4, want: []string{"GPU-04", "GPU-05", "GPU-06", "GPU-07"}},
+		{name: "board of the required device", available: available, required: []string{"GPU-02"}, size: 3, want: []string{"GPU-00", "GPU-01", "GPU-02"}},
+		{name: "required devices across boards", available: available, required: []string{"GPU-03", "GPU-07"}, size: 4, want: []string{"GPU-04", "GPU-05", "GPU-07", "GPU-03"}},
+		{name: "required devices only", available: available, required: []string{"GPU-01", "GPU-06"}, size: 2, want: []string{"GPU-06", "GPU-01"}},
+		{name: "spill over to the other board", available: available, size: 5, want: []string{"GPU-04", "GPU-05", "GPU-06", "GPU-07", "GPU-00"}},
+		{name: "partial board", available: []string{"GPU-00", "GPU-04", "GPU-05", "GPU-01", "GPU-02"}, size: 3, want: []string{"GPU-00", "GPU-01", "GPU-02"}},
+		{name: "duplicate devices", available: []string{"GPU-00", "GPU-00", "GPU-01"}, size: 2, want: []string{"GPU-00", "GPU-01"}},
+		{name: "too large", available: available, size: 9, err: true},
+		{name: "smaller than required", available: available, required: []string{"GPU-00", "GPU-01"}, size: 1, err: true},
+		{name: "required device unavailable", available: ids[:4], required: []string{"GPU-04"}, size: 2, err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := preferredDevices(topo, tt.available, tt.required, tt.size)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPreferredDevicesGreedy(t *testing.T) {
+	ids, topo := syntheticTopology(32, 6)
+
+	tests := []struct {
+		name     string
+		required []string
+		size     int
+		want     []string
+	}{
+		{name: "first board", size: 6, want: []string{"GPU-00", "GPU-01", "GPU-02", "GPU-03", "GPU-04", "GPU-05"}},
+		{name: "board of the required device", required: []string{"GPU-09"}, size: 6, want: []string{"GPU-00", "GPU-01", "GPU-08", "GPU-09", "GPU-10", "GPU-11"}},
+		{name: "boards of the required devices", required: []string{"GPU-13", "GPU-30"}, size: 8, want: []string{"GPU-12", "GPU-13", "GPU-14", "GPU-15", "GPU-28", "GPU-29", "GPU-30", "GPU-31"}},
+	}
+
+	for _, tt := range tests {
+		if c := combinations(len(ids)-len(tt.required), tt.size-len(tt.required)); c <= maxAllocationCandidates {
+			t.Fatalf("%s: %d combinations are scored exhaustively", tt.name, c)
+		}
+
+		got, err := preferredDevices(topo, ids, tt.required, tt.size)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGreedyCombination(t *testing.T) {
+	ids, topo := syntheticTopology(12, 1)
+
+	// The greedy selection matches the exhaustive one when the best set is
+	// made of whole boards.
+	for _, tt := range []struct {
+		required []string
+		n        int
+	}{
+		{nil, 4},
+		{nil, 8},
+		{[]string{"GPU-05"}, 3},
+		{[]string{"GPU-05", "GPU-10"}, 6},
+	} {
+		var candidates []string
+		for _, id := range ids {
+			if !contains(tt.required, id) {
+				candidates = append(candidates, id)
+			}
+		}
+
+		greedy := greedyCombination(topo, candidates, tt.required, tt.n)
+		best := bestCombination(topo, candidates, tt.required, tt.n)
+		if !reflect.DeepEqual(sortLike(greedy, ids), sortLike(best, ids)) {
+			t.Errorf("required %v, %d devices: greedy %v, exhaustive %v", tt.required, tt.n, greedy, best)
+		}
+	}
+}
+
+func TestBestCombination(t *testing.T) {
+	// Two devices connected through more NVLinks than to the third one.
+	topo := make(topology)
+	topo.add("GPU-a", "GPU-b", p2pLinkSingleNVLink)
+	topo.add("GPU-a", "GPU-c", p2pLinkSingleNVLink)
+	topo.add("GPU-b", "GPU-c", p2pLinkFourNVLinks)
+	topo.add("GPU-c", "GPU-d", nvml.P2PLinkCrossCPU)
+
+	tests := []struct {
+		required []string
+		n        int
+		want     []string
+	}{
+		{nil, 2, []string{"GPU-b", "GPU-c"}},
+		{nil, 3, []string{"GPU-a", "GPU-b", "GPU-c"}},
+		{[]string{"GPU-d"}, 1, []string{"GPU-c"}},
+		{[]string{"GPU-a"}, 0, []string{}},
+	}
+	for _, tt := range tests {
+		var candidates []string
+		for _, id := range []string{"GPU-a", "GPU-b", "GPU-c", "GPU-d"} {
+			if !contains(tt.required, id) {
+				candidates = append(candidates, id)
+			}
+		}
+		got := bestCombination(topo, candidates, tt.required, tt.n)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("required %v, %d devices: got %v, want %v", tt.required, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestCombinations(t *testing.T) {
+	tests := []struct {
+		n, k, want int
+	}{
+		{4, 0, 1},
+		{4, 2, 6},
+		{8, 4, 70},
+		{32, 4, 35960},
+		{32, 5, maxAllocationCandidates + 1},
+		{64, 32, maxAllocationCandidates + 1},
+	}
+	for _, tt := range tests {
+		if got := combinations(tt.n, tt.k); got != tt.want {
+			t.Errorf("combinations(%d, %d) = %d, want %d", tt.n, tt.k, got, tt.want)
+		}
+	}
+}
+
+func contains(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+const (
+	envNVMLTimeout     = "DP_NVML_TIMEOUT"
+	defaultNVMLTimeout = 10 * time.Second
+	// maxNVMLTimeouts is the number of calls which must time out within
+	// nvmlTimeoutWindow for NVML to be considered hung.
+	maxNVMLTimeouts   = 3
+	nvmlTimeoutWindow = 5 * time.Minute
+	// nvmlQueueTimeout is how long a call waits for the worker to be free.
+	// A call which could not start is not counted as a timeout.
+	nvmlQueueTimeout = time.Minute
+	// nvmlReinitInterval is how often the re-initialization of a hung NVML
+	// is attempted.
+	nvmlReinitInterval = 30 * time.Second
+)
+
+var (
+	errNVMLTimeout = errors.New("NVML call timed out")
+	errNVMLHung    = errors.New("NVML is not responding")
+	errNVMLBusy    = errors.New("NVML is busy")
+)
+
+// nvmlCall is a call queued for the worker of the watchdog.
+type nvmlCall struct {
+	name string
+	f    func() error
+	done chan error
+}
+
+// nvmlWatchdog runs the NVML calls one at a time in a worker goroutine, each
+// with a deadline, so that a wedged driver cannot block the plugin. A worker
+// stuck in a call which timed out is replaced, the call cannot be cancelled
+// and its goroutine is leaked until the driver returns. NVML is considered
+// hung once several calls timed out recently, then calls fail immediately
+// and NVML is re-initialized periodically until it responds again.
+type nvmlWatchdog struct {
+	timeout      time.Duration
+	queueTimeout time.Duration
+	// reinit shuts NVML down and initializes it again.
+	reinit func() error
+	calls  chan *nvmlCall
+
+	mu       sync.Mutex
+	timeouts []time.Time
+	hung     bool
+	// worker is the generation of the current worker, a replaced worker
+	// exits once its call returns.
+	worker int
+	// reiniting is set while a re-initialization is running, including
+	// after it timed out.
+	reiniting bool
+}
+
+func newNVMLWatchdog() *nvmlWatchdog {
+	return startNVMLWatchdog(nvmlTimeout(), reinitNVML)
+}
+
+func startNVMLWatchdog(timeout time.Duration, reinit func() error) *nvmlWatchdog {
+	w := &nvmlWatchdog{timeout: timeout, queueTimeout: nvmlQueueTimeout, reinit: reinit, calls: make(chan *nvmlCall)}
+	go w.work(0)
+	return w
+}
+
+func nvmlTimeout() time.Duration {
+	v := os.Getenv(envNVMLTimeout)
+	if v == "" {
+		return defaultNVMLTimeout
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Warning: invalid %s %q, using %s.", envNVMLTimeout, v, defaultNVMLTimeout)
+		return defaultNVMLTimeout
+	}
+	return d
+}
+
+func reinitNVML() error {
+	if err := nvml.Shutdown(); err != nil {
+		log.Printf("Warning: could not shut NVML down: %s", err)
+	}
+	return nvml.Init()
+}
+
+// call runs f with the timeout of the watchdog, extended by extra for calls
+// which block on purpose.
+func (w *nvmlWatchdog) call(name string, extra time.Duration, f func() error) error {
+	if w.isHung() {
+		return errNVMLHung
+	}
+
+	return w.run(name, w.timeout+extra, f)
+}
+
+// work runs the queued calls until the worker is replaced.
+func (w *nvmlWatchdog) work(generation int) {
+	for c := range w.calls {
+		c.done <- c.f()
+
+		w.mu.Lock()
+		replaced := w.worker != generation
+		w.mu.Unlock()
+		if replaced {
+			log.Printf("NVML call %s returned after its deadline.", c.name)
+			return
+		}
+	}
+}
+
+// run hands f to the worker and waits for it with a deadline, counting the
+// timeouts. The worker only receives a call when it starts it, a call which
+// waited too long for a busy worker fails without being counted.
+func (w *nvmlWatchdog) run(name string, timeout time.Duration, f func() error) error {
+	c := &nvmlCall{name: name, f: f, done: make(chan error, 1)}
+
+	queued := time.NewTimer(w.queueTimeout)
+	select {
+	case w.calls <- c:
+		queued.Stop()
+	case <-queued.C:
+		log.Printf("Warning: NVML call %s did not start within %s.", name, w.queueTimeout)
+		return errNVMLBusy
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-c.done:
+		return err
+	case <-timer.C:
+	}
+
+	w.timedOut(name, timeout)
+	return errNVMLTimeout
+}
+
+// timedOut records a timeout and replaces the worker, which is stuck in a
+// call. NVML is re-initialized in the background once it is hung.
+func (w *nvmlWatchdog) timedOut(name string, timeout time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.worker++
+	go w.work(w.worker)
+
+	now := time.Now()
+	var timeouts []time.Time
+	for _, t := range w.timeouts {
+		if now.Sub(t) < nvmlTimeoutWindow {
+			timeouts = append(timeouts, t)
+		}
+	}
+	w.timeouts = append(timeouts, now)
+
+	log.Printf("Warning: NVML call %s did not return within %s (%d/%d).", name, timeout, len(w.timeouts), maxNVMLTimeouts)
+	if len(w.timeouts) >= maxNVMLTimeouts && !w.hung {
+		log.Printf("NVML is not responding.")
+		w.hung = true
+		go w.recover()
+	}
+}
+
+// isWatchdogError reports whether err is returned by the watchdog rather than
+// by NVML.
+func isWatchdogError(err error) bool {
+	return err == errNVMLTimeout || err == errNVMLHung || err == errNVMLBusy
+}
+
+func (w *nvmlWatchdog) isHung() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.hung
+}
+
+// recover re-initializes NVML until it responds again. A re-initialization
+// is only attempted once the previous one returned.
+func (w *nvmlWatchdog) recover() {
+	reinit := func() error {
+		w.setReiniting(true)
+		defer w.setReiniting(false)
+		return w.reinit()
+	}
+
+	for ; ; time.Sleep(nvmlReinitInterval) {
+		w.mu.Lock()
+		reiniting := w.reiniting
+		w.mu.Unlock()
+		if reiniting {
+			log.Printf("Could not re-initialize NVML: the previous re-initialization did not return yet")
+			continue
+		}
+
+		err := w.run("reinit", 2*w.timeout, reinit)
+		if err == nil {
+			break
+		}
+		log.Printf("Could not re-initialize NVML: %s", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	log.Printf("NVML was re-initialized.")
+	w.hung = false
+	w.timeouts = nil
+}
+
+func (w *nvmlWatchdog) setReiniting(reiniting bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.reiniting = reiniting
+}
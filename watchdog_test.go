@@ -0,0 +1,133 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNVMLWatchdogSerializesCalls(t *testing.T) {
+	w := startNVMLWatchdog(time.Second, func() error { return nil })
+
+	var running, overlaps int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := w.call("test", 0, func() error {
+				if atomic.AddInt32(&running, 1) > 1 {
+					atomic.AddInt32(&overlaps, 1)
+				}
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				return nil
+			})
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if overlaps != 0 {
+		t.Errorf("%d calls overlapped", overlaps)
+	}
+}
+
+func TestNVMLWatchdogTimeout(t *testing.T) {
+	w := startNVMLWatchdog(50*time.Millisecond, func() error { return nil })
+
+	errCall := errors.New("call failed")
+	if err := w.call("test", 0, func() error { return errCall }); err != errCall {
+		t.Errorf("got error %v, want %v", err, errCall)
+	}
+
+	wedged := make(chan struct{})
+	defer close(wedged)
+	if err := w.call("wedged", 0, func() error { <-wedged; return nil }); err != errNVMLTimeout {
+		t.Errorf("got error %v, want %v", err, errNVMLTimeout)
+	}
+
+	// The worker stuck in the wedged call was replaced.
+	if err := w.call("test", 0, func() error { return nil }); err != nil {
+		t.Errorf("unexpected error after a timeout: %s", err)
+	}
+	if w.isHung() {
+		t.Errorf("NVML is hung after a single timeout")
+	}
+}
+
+func TestNVMLWatchdogHung(t *testing.T) {
+	reinit := make(chan struct{}, 1)
+	w := startNVMLWatchdog(50*time.Millisecond, func() error {
+		reinit <- struct{}{}
+		return nil
+	})
+
+	wedged := make(chan struct{})
+	defer close(wedged)
+	for i := 0; i < maxNVMLTimeouts; i++ {
+		if err := w.call("wedged", 0, func() error { <-wedged; return nil }); err != errNVMLTimeout {
+			t.Fatalf("call %d: got error %v, want %v", i, err, errNVMLTimeout)
+		}
+	}
+
+	select {
+	case <-reinit:
+	case <-time.After(time.Second):
+		t.Fatalf("NVML was not re-initialized")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for w.isHung() {
+		if time.Now().After(deadline) {
+			t.Fatalf("NVML is still hung after its re-initialization")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := w.call("test", 0, func() error { return nil }); err != nil {
+		t.Errorf("unexpected error after the re-initialization: %s", err)
+	}
+}
+
+func TestNVMLWatchdogQueue(t *testing.T) {
+	w := startNVMLWatchdog(time.Second, func() error { return nil })
+	w.queueTimeout = 20 * time.Millisecond
+
+	// The slow call returns within its deadline, the calls queued behind it
+	// give up without being counted as timeouts.
+	slow := make(chan error, 1)
+	started := make(chan struct{})
+	go func() {
+		slow <- w.call("slow", 0, func() error {
+			close(started)
+			time.Sleep(200 * time.Millisecond)
+			return nil
+		})
+	}()
+	<-started
+
+	for i := 0; i < maxNVMLTimeouts; i++ {
+		if err := w.call("queued", 0, func() error { return nil }); err != errNVMLBusy {
+			t.Errorf("call %d: got error %v, want %v", i, err, errNVMLBusy)
+		}
+	}
+	if err := <-slow; err != nil {
+		t.Errorf("got error %v for the slow call", err)
+	}
+
+	w.mu.Lock()
+	timeouts, worker := len(w.timeouts), w.worker
+	w.mu.Unlock()
+	if timeouts != 0 || worker != 0 || w.isHung() {
+		t.Errorf("got %d timeouts and worker %d, want none replaced", timeouts, worker)
+	}
+	if err := w.call("test", 0, func() error { return nil }); err != nil {
+		t.Errorf("unexpected error after the slow call: %s", err)
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const envXIDPolicyFile = "DP_XID_POLICY_FILE"
+
+// xidAction is what the plugin does when a GPU reports an XID or an event.
+type xidAction string
+
+const (
+	// xidIgnore leaves the GPU healthy, e.g. for application errors.
+	xidIgnore xidAction = "ignore"
+	// xidUnhealthy marks the GPU which reported the XID unhealthy.
+	xidUnhealthy xidAction = "unhealthy"
+	// xidAllUnhealthy marks all the GPUs of the resource unhealthy.
+	xidAllUnhealthy xidAction = "all-unhealthy"
+	// xidThreshold marks the GPU unhealthy once it reported Count matching
+	// XIDs or events within Window.
+	xidThreshold xidAction = "threshold"
+)
+
+// NVML events other than XIDs, as named in the policy file.
+const (
+	eventSingleBitECC = "singleBitEcc"
+	eventDoubleBitECC = "doubleBitEcc"
+	eventPState       = "pstate"
+	eventClock        = "clock"
+)
+
+// eventTypes maps the NVML event types to their names in the policy file.
+var eventTypes = map[uint64]string{
+	nvmlEventSingleBitECC: eventSingleBitECC,
+	nvmlEventDoubleBitECC: eventDoubleBitECC,
+	nvmlEventPState:       eventPState,
+	nvmlEventClock:        eventClock,
+}
+
+// xidPolicy maps XIDs to actions. The first rule matching an XID applies,
+// XIDs matched by no rule get the Default action. Events lists the action
+// taken on the other NVML events, ignored events are not subscribed to.
+//
+// See http://docs.nvidia.com/deploy/xid-errors/index.html for the meaning of
+// each XID.
+type xidPolicy struct {
+	Rules   []xidRule            `yaml:"rules"`
+	Default xidAction            `yaml:"default"`
+	Events  map[string]eventRule `yaml:"events"`
+}
+
+type eventRule struct {
+	Action xidAction     `yaml:"action"`
+	Count  uint          `yaml:"count"`
+	Window time.Duration `yaml:"window"`
+}
+
+type xidRule struct {
+	// XIDs is a comma separated list of XIDs or ranges, e.g. "13,31,61-64".
+	XIDs      string `yaml:"xids"`
+	eventRule `yaml:",inline"`
+
+	ranges [][2]uint64
+}
+
+// defaultXIDPolicy ignores the XIDs caused by applications and marks the GPU
+// unhealthy on any other XID.
+var defaultXIDPolicy = xidPolicy{
+	Rules: []xidRule{
+		// 31: GPU memory page fault, 43: GPU stopped processing,
+		// 45: preemptive cleanup due to a previous error. All of them
+		// are usually caused by the application.
+		{XIDs: "31,43,45", eventRule: eventRule{Action: xidIgnore}},
+	},
+	Default: xidUnhealthy,
+	Events:  defaultEventRules,
+}
+
+// defaultEventRules marks the GPU unhealthy on uncorrectable memory errors,
+// and when correctable ones become frequent.
+var defaultEventRules = map[string]eventRule{
+	eventDoubleBitECC: {Action: xidUnhealthy},
+	eventSingleBitECC: {Action: xidThreshold, Count: 50, Window: time.Hour},
+	eventPState:       {Action: xidIgnore},
+	eventClock:        {Action: xidIgnore},
+}
+
+// loadXIDPolicy reads the XID policy file pointed to by DP_XID_POLICY_FILE,
+// or returns the default policy if the variable is not set.
+func loadXIDPolicy() (*xidPolicy, error) {
+	policy := defaultXIDPolicy
+
+	file := os.Getenv(envXIDPolicyFile)
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		policy = xidPolicy{}
+		if err := yaml.UnmarshalStrict(b, &policy); err != nil {
+			return nil, fmt.Errorf("invalid XID policy file %s: %v", file, err)
+		}
+	}
+
+	if err := policy.compile(); err != nil {
+		return nil, fmt.Errorf("invalid XID policy file %s: %v", file, err)
+	}
+	return &policy, nil
+}
+
+// compile validates the policy and parses the XIDs of its rules.
+func (p *xidPolicy) compile() error {
+	if p.Default == "" {
+		p.Default = xidUnhealthy
+	}
+	if p.Default != xidIgnore && p.Default != xidUnhealthy && p.Default != xidAllUnhealthy {
+		return fmt.Errorf("invalid default action %q", p.Default)
+	}
+
+	rules := make([]xidRule, len(p.Rules))
+	for i, r := range p.Rules {
+		ranges, err := parseXIDRanges(r.XIDs)
+		if err != nil {
+			return fmt.Errorf("rule %d: %v", i, err)
+		}
+		r.ranges = ranges
+
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("rule %d: %v", i, err)
+		}
+		rules[i] = r
+	}
+	p.Rules = rules
+
+	events := make(map[string]eventRule)
+	for name, r := range defaultEventRules {
+		events[name] = r
+	}
+	for name, r := range p.Events {
+		if _, ok := events[name]; !ok {
+			return fmt.Errorf("unknown event %q", name)
+		}
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("event %s: %v", name, err)
+		}
+		events[name] = r
+	}
+	p.Events = events
+
+	return nil
+}
+
+func (r eventRule) validate() error {
+	switch r.Action {
+	case xidIgnore, xidUnhealthy, xidAllUnhealthy:
+	case xidThreshold:
+		if r.Count == 0 || r.Window <= 0 {
+			return fmt.Errorf("threshold requires a count and a window")
+		}
+	default:
+		return fmt.Errorf("invalid action %q", r.Action)
+	}
+	return nil
+}
+
+// eventMask returns the NVML event types which are not ignored.
+func (p *xidPolicy) eventMask() uint64 {
+	var mask uint64
+	for t, name := range eventTypes {
+		if p.Events[name].Action != xidIgnore {
+			mask |= t
+		}
+	}
+	return mask
+}
+
+// parseXIDRanges parses a list of XIDs such as "13,31,61-64".
+func parseXIDRanges(s string) ([][2]uint64, error) {
+	var ranges [][2]uint64
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		bounds := strings.SplitN(f, "-", 2)
+
+		lo, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid XID %q", f)
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			hi, err = strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 64)
+			if err != nil || hi < lo {
+				return nil, fmt.Errorf("invalid XID range %q", f)
+			}
+		}
+		ranges = append(ranges, [2]uint64{lo, hi})
+	}
+	return ranges, nil
+}
+
+// rule returns the index of the first rule matching the XID, or -1.
+func (p *xidPolicy) rule(xid uint64) int {
+	for i, r := range p.Rules {
+		for _, rg := range r.ranges {
+			if xid >= rg[0] && xid <= rg[1] {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// xidTracker applies a policy to the XIDs reported by the GPUs, keeping the
+// history needed by the threshold rules.
+type xidTracker struct {
+	policy *xidPolicy
+
+	mu     sync.Mutex
+	events map[string][]time.Time
+}
+
+func newXIDTracker(policy *xidPolicy) *xidTracker {
+	return &xidTracker{policy: policy, events: make(map[string][]time.Time)}
+}
+
+// action returns the action to take for an XID reported at the given time by
+// a device.
+func (t *xidTracker) action(id string, xid uint64, now time.Time) xidAction {
+	i := t.policy.rule(xid)
+	if i == -1 {
+		return t.policy.Default
+	}
+	return t.apply(fmt.Sprintf("%s/xid/%d", id, i), t.policy.Rules[i].eventRule, now)
+}
+
+// eventAction returns the action to take for an event reported at the given
+// time by a device.
+func (t *xidTracker) eventAction(id, event string, now time.Time) xidAction {
+	return t.apply(fmt.Sprintf("%s/%s", id, event), t.policy.Events[event], now)
+}
+
+// apply returns the action of the rule, counting the events of the threshold
+// rules under the given key.
+func (t *xidTracker) apply(key string, r eventRule, now time.Time) xidAction {
+	if r.Action != xidThreshold {
+		return r.Action
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var events []time.Time
+	for _, e := range t.events[key] {
+		if now.Sub(e) < r.Window {
+			events = append(events, e)
+		}
+	}
+	events = append(events, now)
+
+	if uint(len(events)) >= r.Count {
+		delete(t.events, key)
+		return xidUnhealthy
+	}
+	t.events[key] = events
+	return xidIgnore
+}
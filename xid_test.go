@@ -0,0 +1,217 @@
+// Copyright (c) 2017, NVIDIA CORPORATION. All rights reserved.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestParseXIDRanges(t *testing.T) {
+	tests := []struct {
+		s    string
+		want [][2]uint64
+		err  bool
+	}{
+		{s: "13", want: [][2]uint64{{13, 13}}},
+		{s: "13,31,61-64", want: [][2]uint64{{13, 13}, {31, 31}, {61, 64}}},
+		{s: " 13 , 61 - 64 ", want: [][2]uint64{{13, 13}, {61, 64}}},
+		{s: "48-48", want: [][2]uint64{{48, 48}}},
+		{s: "", err: true},
+		{s: "13,", err: true},
+		{s: "xid", err: true},
+		{s: "-13", err: true},
+		{s: "64-61", err: true},
+		{s: "61-", err: true},
+		{s: "61-64-79", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseXIDRanges(tt.s)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", tt.s, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tt.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestXIDPolicyCompile(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy xidPolicy
+		err    bool
+	}{
+		{name: "empty", policy: xidPolicy{}},
+		{name: "default", policy: defaultXIDPolicy},
+		{name: "threshold", policy: xidPolicy{Rules: []xidRule{{XIDs: "63", eventRule: eventRule{Action: xidThreshold, Count: 3, Window: time.Hour}}}}},
+		{name: "event override", policy: xidPolicy{Events: map[string]eventRule{eventPState: {Action: xidUnhealthy}}}},
+		{name: "invalid default", policy: xidPolicy{Default: xidThreshold}, err: true},
+		{name: "invalid action", policy: xidPolicy{Rules: []xidRule{{XIDs: "13", eventRule: eventRule{Action: "reboot"}}}}, err: true},
+		{name: "invalid XIDs", policy: xidPolicy{Rules: []xidRule{{XIDs: "13-", eventRule: eventRule{Action: xidIgnore}}}}, err: true},
+		{name: "threshold without window", policy: xidPolicy{Rules: []xidRule{{XIDs: "63", eventRule: eventRule{Action: xidThreshold, Count: 3}}}}, err: true},
+		{name: "threshold without count", policy: xidPolicy{Rules: []xidRule{{XIDs: "63", eventRule: eventRule{Action: xidThreshold, Window: time.Hour}}}}, err: true},
+		{name: "unknown event", policy: xidPolicy{Events: map[string]eventRule{"fan": {Action: xidIgnore}}}, err: true},
+	}
+
+	for _, tt := range tests {
+		p := tt.policy
+		err := p.compile()
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		if p.Default == "" {
+			t.Errorf("%s: no default action", tt.name)
+		}
+		for name := range defaultEventRules {
+			if _, ok := p.Events[name]; !ok {
+				t.Errorf("%s: no rule for the %s events", tt.name, name)
+			}
+		}
+	}
+}
+
+func TestXIDTrackerAction(t *testing.T) {
+	policy := xidPolicy{
+		Rules: []xidRule{
+			{XIDs: "13,31", eventRule: eventRule{Action: xidIgnore}},
+			{XIDs: "61-64", eventRule: eventRule{Action: xidThreshold, Count: 3, Window: time.Minute}},
+			{XIDs: "79", eventRule: eventRule{Action: xidAllUnhealthy}},
+			{XIDs: "13", eventRule: eventRule{Action: xidUnhealthy}},
+		},
+		Default: xidUnhealthy,
+	}
+	if err := policy.compile(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	start := time.Now()
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	tests := []struct {
+		name   string
+		device string
+		xid    uint64
+		time   time.Time
+		want   xidAction
+	}{
+		{"first matching rule", "GPU-a", 13, at(0), xidIgnore},
+		{"default", "GPU-a", 48, at(0), xidUnhealthy},
+		{"all devices", "GPU-a", 79, at(0), xidAllUnhealthy},
+
+		{"below threshold", "GPU-a", 61, at(0), xidIgnore},
+		{"same rule", "GPU-a", 63, at(10 * time.Second), xidIgnore},
+		{"other device", "GPU-b", 61, at(20 * time.Second), xidIgnore},
+		{"threshold reached", "GPU-a", 64, at(30 * time.Second), xidUnhealthy},
+		{"count reset", "GPU-a", 61, at(40 * time.Second), xidIgnore},
+
+		{"first of the window", "GPU-b", 61, at(50 * time.Second), xidIgnore},
+		{"first event expired", "GPU-b", 61, at(80 * time.Second), xidIgnore},
+		{"within the window", "GPU-b", 61, at(100 * time.Second), xidUnhealthy},
+	}
+
+	tracker := newXIDTracker(&policy)
+	for _, tt := range tests {
+		if got := tracker.action(tt.device, tt.xid, tt.time); got != tt.want {
+			t.Errorf("%s: XID %d on %s: got %s, want %s", tt.name, tt.xid, tt.device, got, tt.want)
+		}
+	}
+}
+
+func TestXIDTrackerEventAction(t *testing.T) {
+	policy := xidPolicy{Events: map[string]eventRule{
+		eventSingleBitECC: {Action: xidThreshold, Count: 2, Window: time.Hour},
+	}}
+	if err := policy.compile(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	now := time.Now()
+	tracker := newXIDTracker(&policy)
+	if got := tracker.eventAction("GPU-a", eventSingleBitECC, now); got != xidIgnore {
+		t.Errorf("first single bit ECC error: got %s, want %s", got, xidIgnore)
+	}
+	if got := tracker.eventAction("GPU-a", eventDoubleBitECC, now); got != xidUnhealthy {
+		t.Errorf("double bit ECC error: got %s, want %s", got, xidUnhealthy)
+	}
+	if got := tracker.eventAction("GPU-a", eventSingleBitECC, now.Add(time.Minute)); got != xidUnhealthy {
+		t.Errorf("second single bit ECC error: got %s, want %s", got, xidUnhealthy)
+	}
+
+	if mask := policy.eventMask(); mask != nvmlEventSingleBitECC|nvmlEventDoubleBitECC {
+		t.Errorf("event mask is %#x, want the ECC events", mask)
+	}
+}
+
+func TestHandleXID(t *testing.T) {
+	policy := xidPolicy{
+		Rules: []xidRule{
+			{XIDs: "13", eventRule: eventRule{Action: xidIgnore}},
+			{XIDs: "63", eventRule: eventRule{Action: xidThreshold, Count: 2, Window: time.Hour}},
+			{XIDs: "79", eventRule: eventRule{Action: xidAllUnhealthy}},
+		},
+		Default: xidUnhealthy,
+	}
+	if err := policy.compile(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	devs := []*Device{{Device: pluginapi.Device{ID: "GPU-a"}}, {Device: pluginapi.Device{ID: "GPU-b"}}, {Device: pluginapi.Device{ID: "GPU-c"}}}
+	uuid := func(s string) *string { return &s }
+
+	tests := []struct {
+		name string
+		uuid *string
+		xid  uint64
+		want []string // reasons of the health events
+	}{
+		{name: "ignored for all devices", xid: 13},
+		{name: "ignored with an empty UUID", uuid: uuid(""), xid: 13},
+		{name: "unhealthy", uuid: uuid("GPU-b"), xid: 48, want: []string{"GPU-b: XID 48"}},
+		{name: "unhealthy for all devices", xid: 48, want: []string{"GPU-a: XID 48", "GPU-b: XID 48", "GPU-c: XID 48"}},
+		{name: "all unhealthy", uuid: uuid("GPU-c"), xid: 79, want: []string{"GPU-a: XID 79 on GPU-c", "GPU-b: XID 79 on GPU-c", "GPU-c: XID 79 on GPU-c"}},
+		{name: "all unhealthy for all devices", xid: 79, want: []string{"GPU-a: XID 79 on GPU-a", "GPU-b: XID 79 on GPU-a", "GPU-c: XID 79 on GPU-a"}},
+		{name: "below threshold for all devices", xid: 63},
+		{name: "threshold reached", uuid: uuid("GPU-a"), xid: 63, want: []string{"GPU-a: XID 63"}},
+		{name: "threshold for all devices", xid: 63, want: []string{"GPU-b: XID 63", "GPU-c: XID 63"}},
+		{name: "unknown device", uuid: uuid("GPU-d"), xid: 48},
+	}
+
+	b := &nvmlBackend{xids: newXIDTracker(&policy), journal: newJournal(journalConfig{Enabled: new(bool)})}
+	for _, tt := range tests {
+		events := make(chan healthEvent, 2*len(devs))
+		b.handleXID(context.Background(), devs, nvml.Event{UUID: tt.uuid, Etype: nvml.XidCriticalError, Edata: tt.xid}, events)
+		close(events)
+
+		var got []string
+		for e := range events {
+			if e.XID != tt.xid {
+				t.Errorf("%s: event for XID %d", tt.name, e.XID)
+			}
+			got = append(got, e.Device.ID+": "+e.Reason)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}